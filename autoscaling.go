@@ -4,16 +4,25 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	// sqsErrorBackoff paces the polling loop when GetMessages keeps failing, so a
-	// persistent error (throttling, permissions) doesn't spin the loop.
+	// sqsErrorBackoff paces the polling loop when GetMessages keeps failing for a
+	// reason that isn't classified, so a persistent error doesn't spin the loop.
+	// Classified errors have backoffs of their own.
 	sqsErrorBackoff = 5 * time.Second
 
 	// cleanupTimeout bounds the queue and subscription teardown that runs on a
@@ -26,6 +35,10 @@ const (
 	// context after the handler returns, so an unreachable endpoint can't wedge
 	// the process while leaving room for the SDK's default retries to land.
 	awsActionTimeout = 30 * time.Second
+
+	// subscriptionCheckInterval is how often the listener checks that its queue
+	// is still subscribed to the SNS topic.
+	subscriptionCheckInterval = 5 * time.Minute
 )
 
 // AutoscalingClient is the subset of the EC2 Auto Scaling API used by the daemon.
@@ -34,6 +47,8 @@ const (
 type AutoscalingClient interface {
 	CompleteLifecycleAction(context.Context, *autoscaling.CompleteLifecycleActionInput, ...func(*autoscaling.Options)) (*autoscaling.CompleteLifecycleActionOutput, error)
 	RecordLifecycleActionHeartbeat(context.Context, *autoscaling.RecordLifecycleActionHeartbeatInput, ...func(*autoscaling.Options)) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error)
+	DescribeLifecycleHooks(context.Context, *autoscaling.DescribeLifecycleHooksInput, ...func(*autoscaling.Options)) (*autoscaling.DescribeLifecycleHooksOutput, error)
+	DescribeAutoScalingInstances(context.Context, *autoscaling.DescribeAutoScalingInstancesInput, ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingInstancesOutput, error)
 }
 
 // Envelope ...
@@ -42,6 +57,16 @@ type Envelope struct {
 	Subject string    `json:"Subject"`
 	Time    time.Time `json:"Time"`
 	Message string    `json:"Message"`
+
+	// Fields covered by, or used to check, the SNS message signature.
+	MessageID        string `json:"MessageId,omitempty"`
+	TopicArn         string `json:"TopicArn,omitempty"`
+	Timestamp        string `json:"Timestamp,omitempty"`
+	SubscribeURL     string `json:"SubscribeURL,omitempty"`
+	Token            string `json:"Token,omitempty"`
+	SignatureVersion string `json:"SignatureVersion,omitempty"`
+	Signature        string `json:"Signature,omitempty"`
+	SigningCertURL   string `json:"SigningCertURL,omitempty"`
 }
 
 // Message ...
@@ -52,6 +77,24 @@ type Message struct {
 	ActionToken string    `json:"LifecycleActionToken"`
 	Transition  string    `json:"LifecycleTransition"`
 	HookName    string    `json:"LifecycleHookName"`
+
+	// TargetState is the lifecycle state the instance is headed for, when it was
+	// read from instance metadata rather than a notification.
+	TargetState string `json:"TargetLifecycleState,omitempty"`
+}
+
+// hookKey identifies the lifecycle hook a message is for.
+func (m *Message) hookKey() string {
+	return m.GroupName + "/" + m.HookName + "/" + m.InstanceID
+}
+
+// actionToken returns the message's lifecycle action token, or nil when it has
+// none, in which case Auto Scaling identifies the action by instance id.
+func (m *Message) actionToken() *string {
+	if m.ActionToken == "" {
+		return nil
+	}
+	return aws.String(m.ActionToken)
 }
 
 // NewAutoscalingListener ...
@@ -62,6 +105,9 @@ func NewAutoscalingListener(instanceID string, queue *Queue, autoscaling Autosca
 		queue:             queue,
 		autoscaling:       autoscaling,
 		heartbeatInterval: heartbeatInterval,
+		seen:              newSeenMessages(nil),
+		subscriptionCheck: subscriptionCheckInterval,
+		setupBackoff:      setupBackoffBase,
 	}
 }
 
@@ -72,6 +118,26 @@ type AutoscalingListener struct {
 	queue             *Queue
 	autoscaling       AutoscalingClient
 	heartbeatInterval time.Duration
+	seen              *seenMessages
+
+	// verifier, when set, rejects messages without a valid SNS signature.
+	verifier *snsVerifier
+
+	// hookWindow, when set, keeps the listener collecting termination notices for
+	// this instance for a while after the first, so that when the group has
+	// several termination hooks they are all heartbeated and completed together.
+	hookWindow time.Duration
+
+	// subscriptionCheck is how often the listener checks that its subscription to
+	// the SNS topic still exists, resubscribing if it doesn't.
+	subscriptionCheck time.Duration
+
+	// setupJitter, when set, delays creating the queue by a random time up to it,
+	// so a fleet launched together doesn't set up all at once, and setupTimeout is
+	// how long throttled setup calls are retried for.
+	setupJitter  time.Duration
+	setupTimeout time.Duration
+	setupBackoff time.Duration
 }
 
 // Type returns a string describing the listener type.
@@ -81,20 +147,50 @@ func (l *AutoscalingListener) Type() string {
 
 // Start the autoscaling lifecycle hook listener.
 func (l *AutoscalingListener) Start(ctx context.Context, notices chan<- TerminationNotice, log *logrus.Entry) error {
+	if err := l.seen.load(); err != nil {
+		log.WithError(err).Error("Failed to load seen lifecycle action tokens")
+	}
+
+	if l.verifier != nil {
+		if err := l.verifier.load(); err != nil {
+			return err
+		}
+	}
+
+	if l.queue.existing {
+		log.WithField("queue", l.queue.name).Debug("Using existing sqs queue")
+		return l.listen(ctx, notices, log)
+	}
+
+	start := time.Now()
+	if l.setupJitter > 0 {
+		delay := rand.N(l.setupJitter)
+		log.WithField("delay", delay).Debug("Delaying setup")
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+	var deadline time.Time
+	if l.setupTimeout > 0 {
+		deadline = time.Now().Add(l.setupTimeout)
+	}
+
 	log.WithField("queue", l.queue.name).Debug("Creating sqs queue")
-	if err := l.queue.Create(ctx); err != nil {
+	createRetries, err := retryThrottled(ctx, deadline, l.setupBackoff, log, "CreateQueue", l.queue.Create)
+	if err != nil {
 		return err
 	}
-	subscribed := false
-	// Tear down the subscription and queue on a fresh, bounded context so cleanup
+	// Tear down the subscriptions and queue on a fresh, bounded context so cleanup
 	// still runs after ctx is cancelled during shutdown, sharing one short deadline
 	// so a slow endpoint can't delay the handler or outlast the supervisor's stop
 	// timeout.
 	defer func() {
 		cleanupCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
 		defer cancel()
-		if subscribed {
-			log.WithField("arn", l.queue.subscriptionArn).Debug("Deleting sns subscription")
+		if len(l.queue.subscriptionArns) > 0 {
+			log.WithField("topics", l.queue.topicArns).Debug("Deleting sns subscriptions")
 			if err := l.queue.Unsubscribe(cleanupCtx); err != nil {
 				log.WithError(err).Error("Failed to unsubscribe from sns topic")
 			}
@@ -105,78 +201,337 @@ func (l *AutoscalingListener) Start(ctx context.Context, notices chan<- Terminat
 		}
 	}()
 
-	log.WithField("topic", l.queue.topicArn).Debug("Subscribing queue to sns topic")
-	if err := l.queue.Subscribe(ctx); err != nil {
+	log.WithField("topics", l.queue.topicArns).Debug("Subscribing queue to sns topics")
+	subscribeRetries, err := retryThrottled(ctx, deadline, l.setupBackoff, log, "Subscribe", l.queue.Subscribe)
+	if err != nil {
 		return err
 	}
-	subscribed = true
+	log.WithFields(logrus.Fields{
+		"queue":   l.queue.name,
+		"latency": time.Since(start),
+		"retries": createRetries + subscribeRetries,
+	}).Info("Set up sqs queue and sns subscriptions")
+
+	return l.listen(ctx, notices, log)
+}
+
+// ValidateHookWindow returns an error if window is too long to collect hooks
+// in: the first message collected would become visible again, and be delivered
+// to another receive, before it is handed off.
+func ValidateHookWindow(window time.Duration) error {
+	if limit := messageVisibilityTimeout * time.Second; window >= limit {
+		return fmt.Errorf("hook window %s must be shorter than the sqs visibility timeout of %s", window, limit)
+	}
+	return nil
+}
 
+// listen polls the queue until it has a termination notice for this instance.
+func (l *AutoscalingListener) listen(ctx context.Context, notices chan<- TerminationNotice, log *logrus.Entry) error {
+	// Termination notices for this instance, and their SQS message ids and
+	// receipt handles, collected until the hook window closes. They are only
+	// recorded as seen once handed off, so a crash before then leaves them to be
+	// handled when redelivered.
+	var (
+		matches    []*Message
+		messageIDs []string
+		handles    []string
+		collected  = newSeenMessages(nil)
+		deadline   time.Time
+		checkedAt  = time.Now()
+		pacing     releaseBackoff
+	)
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		default:
-			log.WithField("queueURL", l.queue.url).Debug("Polling sqs for messages")
-			messages, err := l.queue.GetMessages(ctx)
-			if err != nil {
-				log.WithError(err).Warn("Failed to get messages from SQS")
-				select {
-				case <-ctx.Done():
-					return nil
-				case <-time.After(sqsErrorBackoff):
-				}
-				continue
-			}
-			for _, m := range messages {
-				var env Envelope
-				var msg Message
+		}
 
-				if err := l.queue.DeleteMessage(ctx, aws.ToString(m.ReceiptHandle)); err != nil {
-					log.WithError(err).Warn("Failed to delete message")
-				}
+		if l.subscriptionCheck > 0 && time.Since(checkedAt) >= l.subscriptionCheck {
+			l.checkSubscription(ctx, log)
+			checkedAt = time.Now()
+		}
 
-				// unmarshal outer layer
-				if err := json.Unmarshal([]byte(aws.ToString(m.Body)), &env); err != nil {
-					log.WithError(err).Error("Failed to unmarshal envelope")
+		// While collecting further hooks, only poll until the window closes.
+		pollCtx, cancelPoll := ctx, context.CancelFunc(func() {})
+		if len(matches) > 0 {
+			pollCtx, cancelPoll = context.WithDeadline(ctx, deadline)
+		}
+		log.WithField("queueURL", l.queue.url).Debug("Polling sqs for messages")
+		messages, err := l.queue.GetMessages(pollCtx)
+		cancelPoll()
+		if err != nil {
+			var backoff time.Duration
+			if queueMissing(err) && !l.queue.existing {
+				// Deleted from underneath us, by hand or by the queue cleaner: without
+				// a queue the instance isn't protected, so put it back.
+				log.WithError(err).WithField("queue", l.queue.name).Error("Sqs queue is missing, recreating it")
+				if err = l.queue.Recreate(ctx); err == nil {
+					checkedAt = time.Now()
 					continue
 				}
+				backoff = logPollError(log, err, "Failed to recreate sqs queue")
+			} else {
+				backoff = logPollError(log, err, "Failed to get messages from SQS")
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			continue
+		}
 
-				log.WithFields(logrus.Fields{
-					"type":    env.Type,
-					"subject": env.Subject,
-				}).Debug("Received an SQS message")
-
-				// unmarshal inner layer
-				if err := json.Unmarshal([]byte(env.Message), &msg); err != nil {
-					log.WithError(err).Error("Failed to unmarshal autoscaling message")
+		// Messages are acknowledged only once processed: those that don't call
+		// for the handler are deleted together, and termination notices are
+		// deleted once handed off, so a crash in between leaves them on the queue
+		// to be delivered again. An existing queue may be shared with other
+		// consumers, so its messages are released for them instead of deleted.
+		var (
+			discard []string
+			release []string
+		)
+		skip := func(m sqstypes.Message) {
+			if l.queue.existing {
+				release = append(release, aws.ToString(m.ReceiptHandle))
+			} else {
+				discard = append(discard, aws.ToString(m.ReceiptHandle))
+			}
+		}
+		for _, m := range messages {
+			handle := aws.ToString(m.ReceiptHandle)
+			msg, ok := l.parseMessage(ctx, m, log)
+			if !ok {
+				skip(m)
+				continue
+			}
+			if msg.Transition != terminatingTransition {
+				log.WithField("transition", msg.Transition).Debug("Skipping autoscaling event, not a termination notice")
+				skip(m)
+				continue
+			}
+			// A collected message received again is still pending, not a
+			// duplicate, and only its latest receipt handle can delete it.
+			if id := aws.ToString(m.MessageId); id != "" {
+				if i := slices.Index(messageIDs, id); i >= 0 {
+					handles[i] = handle
 					continue
 				}
+			}
+			// SNS and SQS are at-least-once, so the same action can arrive again.
+			if l.seen.contains(msg) || collected.contains(msg) {
+				log.WithField("hook", msg.HookName).Debug("Skipping duplicate lifecycle message")
+				skip(m)
+				continue
+			}
+			// Without a hook window, further matches in the same batch are left
+			// unacknowledged.
+			if len(matches) > 0 && l.hookWindow == 0 {
+				continue
+			}
+			_ = collected.add(msg)
+			matches = append(matches, msg)
+			messageIDs = append(messageIDs, aws.ToString(m.MessageId))
+			handles = append(handles, handle)
+		}
 
-				if msg.InstanceID != l.instanceID {
-					log.WithField("target", msg.InstanceID).Debug("Skipping autoscaling event, doesn't match instance id")
-					continue
-				}
+		if len(discard) > 0 {
+			if err := l.queue.DeleteMessages(ctx, discard); err != nil {
+				log.WithError(err).Warn("Failed to delete messages")
+			}
+		}
+		if len(release) > 0 {
+			if err := l.queue.ReleaseMessages(ctx, release); err != nil {
+				log.WithError(err).Warn("Failed to release messages")
+			}
+		}
 
-				if msg.Transition != "autoscaling:EC2_INSTANCE_TERMINATING" {
-					log.WithField("transition", msg.Transition).Debug("Skipping autoscaling event, not a termination notice")
-					continue
+		if len(matches) == 0 {
+			if wait := pacing.next(len(messages), len(release)); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(wait):
 				}
+			}
+			continue
+		}
+		if deadline.IsZero() && l.hookWindow > 0 {
+			deadline = time.Now().Add(l.hookWindow)
+			log.WithField("window", l.hookWindow.String()).Debug("Collecting further lifecycle hooks for this instance")
+		}
+		if time.Now().Before(deadline) {
+			continue
+		}
 
-				notices <- &autoscalingTerminationNotice{
-					noticeType:        l.Type(),
-					message:           &msg,
-					autoscaling:       l.autoscaling,
-					heartbeatInterval: l.heartbeatInterval,
-				}
-				return nil
+		notices <- &autoscalingTerminationNotice{
+			noticeType:        l.Type(),
+			messages:          matches,
+			autoscaling:       l.autoscaling,
+			heartbeatInterval: l.heartbeatInterval,
+		}
+		if err := l.seen.add(matches...); err != nil {
+			log.WithError(err).Error("Failed to persist lifecycle action token")
+		}
+		// The daemon stops listening once it has the notice, so acknowledge on a
+		// fresh, bounded context that outlives ctx.
+		ackCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		for _, handle := range handles {
+			if err := l.queue.DeleteMessage(ackCtx, handle); err != nil {
+				log.WithError(err).Warn("Failed to delete message")
 			}
 		}
+		cancel()
+		return nil
 	}
 }
 
+// checkSubscription resubscribes the queue to any SNS topic whose subscription
+// has been deleted, since the queue would otherwise wait forever for messages
+// that never arrive.
+func (l *AutoscalingListener) checkSubscription(ctx context.Context, log *logrus.Entry) {
+	missing, err := l.queue.MissingSubscriptions(ctx)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			logPollError(log, err, "Failed to check sns subscriptions")
+		}
+		return
+	}
+	for _, topic := range missing {
+		log := log.WithField("topic", topic)
+		log.Error("Sns subscription is missing, resubscribing")
+		if err := l.queue.subscribe(ctx, topic); err != nil {
+			logPollError(log, err, "Failed to resubscribe queue to sns topic")
+		}
+	}
+}
+
+// parseMessage decodes an SQS message, reporting false if it can't be read or
+// isn't for this instance. The body is either an SNS envelope wrapping the
+// autoscaling message or, with raw message delivery, the message itself.
+func (l *AutoscalingListener) parseMessage(ctx context.Context, m sqstypes.Message, log *logrus.Entry) (*Message, bool) {
+	var env Envelope
+	var msg Message
+
+	body := []byte(aws.ToString(m.Body))
+	if err := json.Unmarshal(body, &env); err != nil {
+		log.WithError(err).Error("Failed to unmarshal message")
+		return nil, false
+	}
+
+	// A raw message has no Message field of its own.
+	if env.Message != "" {
+		log.WithFields(logrus.Fields{
+			"type":    env.Type,
+			"subject": env.Subject,
+		}).Debug("Received an SQS message")
+		if l.verifier != nil {
+			if err := l.verifier.verify(ctx, &env); err != nil {
+				log.WithError(err).Error("Rejecting SNS message that failed signature verification")
+				return nil, false
+			}
+		}
+		// A topic in another account sends one of these when it subscribes the
+		// queue on the topic owner's behalf.
+		if env.Type == "SubscriptionConfirmation" {
+			log := log.WithField("topic", env.TopicArn)
+			if err := l.queue.ConfirmSubscription(ctx, env.TopicArn, env.Token); err != nil {
+				log.WithError(err).Warn("Failed to confirm sns subscription")
+			} else {
+				log.Info("Confirmed sns subscription")
+			}
+			return nil, false
+		}
+		body = []byte(env.Message)
+	} else {
+		log.Debug("Received a raw SQS message")
+		if l.verifier != nil {
+			log.Error("Rejecting raw SQS message, it carries no SNS signature to verify")
+			return nil, false
+		}
+	}
+
+	if err := json.Unmarshal(body, &msg); err != nil {
+		log.WithError(err).Error("Failed to unmarshal autoscaling message")
+		return nil, false
+	}
+
+	if msg.InstanceID != l.instanceID {
+		log.WithField("target", msg.InstanceID).Debug("Skipping autoscaling event, doesn't match instance id")
+		return nil, false
+	}
+	return &msg, true
+}
+
+// seenMessages records the lifecycle action tokens and hooks the listener has
+// already accepted, so a redelivered message isn't handled twice. With a state
+// store the tokens survive a restart. The hooks don't: an instance returned to
+// a warm pool and scaled in again has the same hook, but a new token.
+type seenMessages struct {
+	mu     sync.Mutex
+	tokens map[string]struct{}
+	hooks  map[string]struct{}
+	store  *stateStore
+}
+
+// seenRecord is the persisted form of seenMessages.
+type seenRecord struct {
+	Tokens []string `json:"tokens"`
+}
+
+func newSeenMessages(store *stateStore) *seenMessages {
+	return &seenMessages{
+		tokens: map[string]struct{}{},
+		hooks:  map[string]struct{}{},
+		store:  store,
+	}
+}
+
+// load merges in the record persisted by a previous run.
+func (s *seenMessages) load() error {
+	if s.store == nil {
+		return nil
+	}
+	var record seenRecord
+	if _, err := s.store.load(seenMessagesFile, &record); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range record.Tokens {
+		s.tokens[t] = struct{}{}
+	}
+	return nil
+}
+
+// contains reports whether the message's token or hook has already been seen.
+func (s *seenMessages) contains(m *Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, token := s.tokens[m.ActionToken]
+	_, hook := s.hooks[m.hookKey()]
+	return token || hook
+}
+
+// add records the messages' tokens and hooks, persisting the tokens if there is
+// a store.
+func (s *seenMessages) add(messages ...*Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range messages {
+		s.tokens[m.ActionToken] = struct{}{}
+		s.hooks[m.hookKey()] = struct{}{}
+	}
+	if s.store == nil {
+		return nil
+	}
+	record := seenRecord{Tokens: slices.Sorted(maps.Keys(s.tokens))}
+	return s.store.save(seenMessagesFile, &record)
+}
+
 type autoscalingTerminationNotice struct {
 	noticeType        string
-	message           *Message
+	messages          []*Message
 	autoscaling       AutoscalingClient
 	heartbeatInterval time.Duration
 }
@@ -186,27 +541,64 @@ func (n *autoscalingTerminationNotice) Type() string {
 }
 
 func (n *autoscalingTerminationNotice) Handle(ctx context.Context, handler Handler, log *logrus.Entry) error {
+	status := newActionStatus()
 	defer func() {
 		// Fresh, bounded context so completion runs even if ctx was cancelled mid-shutdown.
 		completeCtx, cancel := context.WithTimeout(context.Background(), awsActionTimeout)
 		defer cancel()
-		_, err := n.autoscaling.CompleteLifecycleAction(completeCtx, &autoscaling.CompleteLifecycleActionInput{
-			AutoScalingGroupName:  aws.String(n.message.GroupName),
-			LifecycleHookName:     aws.String(n.message.HookName),
-			InstanceId:            aws.String(n.message.InstanceID),
-			LifecycleActionToken:  aws.String(n.message.ActionToken),
-			LifecycleActionResult: aws.String("CONTINUE"),
-		})
-		if err != nil {
-			log.WithError(err).Error("Failed to complete lifecycle action")
-		} else {
-			log.Info("Lifecycle action completed successfully")
+		for _, m := range n.messages {
+			log := log.WithField("hook", m.HookName)
+			if status.isLost(m) {
+				log.Info("Lifecycle action is no longer active, skipping completion")
+				continue
+			}
+			_, err := n.autoscaling.CompleteLifecycleAction(completeCtx, &autoscaling.CompleteLifecycleActionInput{
+				AutoScalingGroupName:  aws.String(m.GroupName),
+				LifecycleHookName:     aws.String(m.HookName),
+				InstanceId:            aws.String(m.InstanceID),
+				LifecycleActionToken:  m.actionToken(),
+				LifecycleActionResult: aws.String("CONTINUE"),
+			})
+			if err != nil {
+				log.WithError(err).Error("Failed to complete lifecycle action")
+			} else {
+				log.Info("Lifecycle action completed successfully")
+			}
 		}
 	}()
 
-	ticker := time.NewTicker(n.heartbeatInterval)
+	timing := n.lifecycleTiming(ctx, log)
+	log.WithField("interval", timing.interval.String()).Debug("Heartbeating lifecycle action")
+	ticker := time.NewTicker(timing.interval)
 	defer ticker.Stop()
 
+	// Past the global timeout the group moves on however often we heartbeat, so
+	// warn as it approaches and give the handler that deadline. Once the action
+	// is lost the deadline is no longer known, so it no longer applies.
+	if !timing.deadline.IsZero() {
+		log := log.WithField("deadline", timing.deadline.Format(time.RFC3339))
+		log.Info("Lifecycle action must complete before the global timeout")
+		warning := time.AfterFunc(time.Until(timing.warnAt()), func() {
+			if status.anyLost() {
+				return
+			}
+			log.WithField("remaining", time.Until(timing.deadline).Round(time.Second).String()).
+				Warn("Handler is about to hit the lifecycle action's global timeout")
+		})
+		defer warning.Stop()
+
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		expire := time.AfterFunc(time.Until(timing.deadline), func() {
+			if !status.anyLost() {
+				cancel(context.DeadlineExceeded)
+			}
+		})
+		defer expire.Stop()
+		ctx = &actionDeadlineContext{Context: ctx, deadline: timing.deadline, status: status}
+	}
+
 	// Stop the heartbeat goroutine when Handle returns; ticker.Stop alone doesn't
 	// close the channel, so a bare "for range ticker.C" would park forever.
 	heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
@@ -218,24 +610,124 @@ func (n *autoscalingTerminationNotice) Handle(ctx context.Context, handler Handl
 			case <-heartbeatCtx.Done():
 				return
 			case <-ticker.C:
-				log.Debug("Sending heartbeat")
-				_, err := n.autoscaling.RecordLifecycleActionHeartbeat(
-					heartbeatCtx,
-					&autoscaling.RecordLifecycleActionHeartbeatInput{
-						AutoScalingGroupName: aws.String(n.message.GroupName),
-						LifecycleHookName:    aws.String(n.message.HookName),
-						InstanceId:           aws.String(n.message.InstanceID),
-						LifecycleActionToken: aws.String(n.message.ActionToken),
-					},
-				)
-				// A heartbeat cancelled because Handle returned is a clean stop, not
-				// a failure worth logging.
-				if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-					log.WithError(err).Warn("Failed to send heartbeat")
+				active := 0
+				for _, m := range n.messages {
+					if status.isLost(m) {
+						continue
+					}
+					log := log.WithField("hook", m.HookName)
+					log.Debug("Sending heartbeat")
+					_, err := n.autoscaling.RecordLifecycleActionHeartbeat(
+						heartbeatCtx,
+						&autoscaling.RecordLifecycleActionHeartbeatInput{
+							AutoScalingGroupName: aws.String(m.GroupName),
+							LifecycleHookName:    aws.String(m.HookName),
+							InstanceId:           aws.String(m.InstanceID),
+							LifecycleActionToken: m.actionToken(),
+						},
+					)
+					switch {
+					case err == nil:
+						active++
+					// A heartbeat cancelled because Handle returned is a clean stop, not
+					// a failure worth logging.
+					case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+						active++
+					// The group has already moved on, so termination is imminent and
+					// retrying can't bring the action back.
+					case lifecycleActionGone(err):
+						log.WithError(err).Error("Lifecycle action is no longer active, stopping heartbeats; termination is imminent")
+						status.markLost(m)
+					default:
+						active++
+						log.WithError(err).Warn("Failed to send heartbeat")
+					}
+				}
+				if active == 0 {
+					return
 				}
 			}
 		}
 	}()
 
-	return handler.Execute(ctx, n.message.Transition, n.message.InstanceID)
+	args := []string{n.messages[0].Transition, n.messages[0].InstanceID}
+	if state := n.messages[0].TargetState; state != "" {
+		args = append(args, state)
+	}
+	return handler.Execute(withActionStatus(ctx, status), args...)
+}
+
+// lifecycleActionGone reports whether err means the lifecycle action no longer
+// exists: it was completed or abandoned, or it timed out. Auto Scaling reports
+// this as a ValidationError ("No active Lifecycle Action found"); its other
+// validation errors, such as for bad parameters, don't mean the action is gone.
+func lifecycleActionGone(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "ValidationError" &&
+		strings.Contains(apiErr.ErrorMessage(), "No active Lifecycle Action found")
+}
+
+// actionDeadlineContext reports the lifecycle action's global timeout as its
+// deadline until the action is lost, after which the deadline is unknown.
+type actionDeadlineContext struct {
+	context.Context
+	deadline time.Time
+	status   *actionStatus
+}
+
+func (c *actionDeadlineContext) Deadline() (time.Time, bool) {
+	if c.status.anyLost() {
+		return c.Context.Deadline()
+	}
+	return c.deadline, true
+}
+
+type actionStatusKey struct{}
+
+// actionStatus tracks which of a notice's lifecycle actions are no longer active
+// and tells the handler once one is lost.
+type actionStatus struct {
+	mu       sync.Mutex
+	lost     map[string]struct{}
+	lostOnce sync.Once
+	lostCh   chan struct{}
+}
+
+func newActionStatus() *actionStatus {
+	return &actionStatus{lost: map[string]struct{}{}, lostCh: make(chan struct{})}
+}
+
+func (s *actionStatus) markLost(m *Message) {
+	s.mu.Lock()
+	s.lost[m.hookKey()] = struct{}{}
+	s.mu.Unlock()
+	s.lostOnce.Do(func() { close(s.lostCh) })
+}
+
+func (s *actionStatus) isLost(m *Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.lost[m.hookKey()]
+	return ok
+}
+
+func (s *actionStatus) anyLost() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.lost) > 0
+}
+
+func withActionStatus(ctx context.Context, status *actionStatus) context.Context {
+	return context.WithValue(ctx, actionStatusKey{}, status)
+}
+
+// ActionLost returns a channel that is closed if the lifecycle action the handler
+// is running for stops being valid. The group has then moved on: termination is
+// imminent and the deadline the handler was given no longer applies. It returns
+// nil for a handler that isn't running for an autoscaling notice.
+func ActionLost(ctx context.Context) <-chan struct{} {
+	if status, ok := ctx.Value(actionStatusKey{}).(*actionStatus); ok {
+		return status.lostCh
+	}
+	return nil
 }
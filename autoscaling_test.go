@@ -5,16 +5,24 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	astypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
 	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
 	"github.com/sirupsen/logrus"
 	logrustest "github.com/sirupsen/logrus/hooks/test"
 )
@@ -36,6 +44,10 @@ func (s *stubSQSClient) CreateQueue(context.Context, *sqs.CreateQueueInput, ...f
 	return &sqs.CreateQueueOutput{QueueUrl: aws.String("url")}, nil
 }
 
+func (*stubSQSClient) GetQueueUrl(_ context.Context, in *sqs.GetQueueUrlInput, _ ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String("https://sqs.us-east-1.amazonaws.com/" + aws.ToString(in.QueueOwnerAWSAccountId) + "/" + aws.ToString(in.QueueName))}, nil
+}
+
 func (s *stubSQSClient) GetQueueAttributes(context.Context, *sqs.GetQueueAttributesInput, ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
 	return &sqs.GetQueueAttributesOutput{Attributes: map[string]string{"QueueArn": "arn"}}, nil
 }
@@ -52,6 +64,14 @@ func (s *stubSQSClient) DeleteMessage(context.Context, *sqs.DeleteMessageInput,
 	return &sqs.DeleteMessageOutput{}, nil
 }
 
+func (s *stubSQSClient) DeleteMessageBatch(context.Context, *sqs.DeleteMessageBatchInput, ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	return &sqs.DeleteMessageBatchOutput{}, nil
+}
+
+func (*stubSQSClient) ChangeMessageVisibilityBatch(context.Context, *sqs.ChangeMessageVisibilityBatchInput, ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	return &sqs.ChangeMessageVisibilityBatchOutput{}, nil
+}
+
 func (s *stubSQSClient) DeleteQueue(ctx context.Context, _ *sqs.DeleteQueueInput, _ ...func(*sqs.Options)) (*sqs.DeleteQueueOutput, error) {
 	_, s.deleteQueueHadDeadline = ctx.Deadline()
 	atomic.AddInt64(&s.deleteQueueCalls, 1)
@@ -61,18 +81,36 @@ func (s *stubSQSClient) DeleteQueue(ctx context.Context, _ *sqs.DeleteQueueInput
 	return &sqs.DeleteQueueOutput{}, nil
 }
 
-// stubSNSClient counts Unsubscribe calls and records whether its context carried
-// a deadline, so a test can assert the subscription teardown runs on a bounded
-// context during shutdown.
+// stubSNSClient counts Subscribe and Unsubscribe calls and records whether the
+// Unsubscribe context carried a deadline, so a test can assert the subscription
+// teardown runs on a bounded context during shutdown. GetSubscriptionAttributes
+// returns subscriptionErr, and ConfirmSubscription records the tokens it is
+// given.
 type stubSNSClient struct {
+	subscribeCalls         int64
 	unsubscribeCalls       int64
 	unsubscribeHadDeadline bool
+	subscriptionErr        error
+	confirmed              []string
+}
+
+func (s *stubSNSClient) ConfirmSubscription(_ context.Context, in *sns.ConfirmSubscriptionInput, _ ...func(*sns.Options)) (*sns.ConfirmSubscriptionOutput, error) {
+	s.confirmed = append(s.confirmed, aws.ToString(in.Token))
+	return &sns.ConfirmSubscriptionOutput{SubscriptionArn: aws.String("confirmed")}, nil
 }
 
-func (*stubSNSClient) Subscribe(context.Context, *sns.SubscribeInput, ...func(*sns.Options)) (*sns.SubscribeOutput, error) {
+func (s *stubSNSClient) Subscribe(context.Context, *sns.SubscribeInput, ...func(*sns.Options)) (*sns.SubscribeOutput, error) {
+	atomic.AddInt64(&s.subscribeCalls, 1)
 	return &sns.SubscribeOutput{SubscriptionArn: aws.String("arn")}, nil
 }
 
+func (s *stubSNSClient) GetSubscriptionAttributes(context.Context, *sns.GetSubscriptionAttributesInput, ...func(*sns.Options)) (*sns.GetSubscriptionAttributesOutput, error) {
+	if s.subscriptionErr != nil {
+		return nil, s.subscriptionErr
+	}
+	return &sns.GetSubscriptionAttributesOutput{}, nil
+}
+
 func (s *stubSNSClient) Unsubscribe(ctx context.Context, _ *sns.UnsubscribeInput, _ ...func(*sns.Options)) (*sns.UnsubscribeOutput, error) {
 	_, s.unsubscribeHadDeadline = ctx.Deadline()
 	atomic.AddInt64(&s.unsubscribeCalls, 1)
@@ -80,11 +118,20 @@ func (s *stubSNSClient) Unsubscribe(ctx context.Context, _ *sns.UnsubscribeInput
 }
 
 // stubAutoscalingClient counts heartbeat and completion calls and records whether
-// the completion call was given a deadline.
+// the completion call was given a deadline. DescribeLifecycleHooks returns hooks.
 type stubAutoscalingClient struct {
 	heartbeats          int64
 	completes           int64
 	completeHadDeadline bool
+	hooks               []astypes.LifecycleHook
+}
+
+func (s *stubAutoscalingClient) DescribeLifecycleHooks(context.Context, *autoscaling.DescribeLifecycleHooksInput, ...func(*autoscaling.Options)) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	return &autoscaling.DescribeLifecycleHooksOutput{LifecycleHooks: s.hooks}, nil
+}
+
+func (s *stubAutoscalingClient) DescribeAutoScalingInstances(context.Context, *autoscaling.DescribeAutoScalingInstancesInput, ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+	return &autoscaling.DescribeAutoScalingInstancesOutput{}, nil
 }
 
 func (s *stubAutoscalingClient) RecordLifecycleActionHeartbeat(context.Context, *autoscaling.RecordLifecycleActionHeartbeatInput, ...func(*autoscaling.Options)) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
@@ -117,6 +164,10 @@ func (c *recordingSQSClient) CreateQueue(context.Context, *sqs.CreateQueueInput,
 	return &sqs.CreateQueueOutput{QueueUrl: aws.String("url")}, nil
 }
 
+func (*recordingSQSClient) GetQueueUrl(_ context.Context, in *sqs.GetQueueUrlInput, _ ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String("https://sqs.us-east-1.amazonaws.com/" + aws.ToString(in.QueueOwnerAWSAccountId) + "/" + aws.ToString(in.QueueName))}, nil
+}
+
 func (c *recordingSQSClient) GetQueueAttributes(context.Context, *sqs.GetQueueAttributesInput, ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
 	return &sqs.GetQueueAttributesOutput{Attributes: map[string]string{"QueueArn": "arn"}}, nil
 }
@@ -131,6 +182,14 @@ func (c *recordingSQSClient) DeleteMessage(context.Context, *sqs.DeleteMessageIn
 	return &sqs.DeleteMessageOutput{}, nil
 }
 
+func (c *recordingSQSClient) DeleteMessageBatch(context.Context, *sqs.DeleteMessageBatchInput, ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	return &sqs.DeleteMessageBatchOutput{}, nil
+}
+
+func (*recordingSQSClient) ChangeMessageVisibilityBatch(context.Context, *sqs.ChangeMessageVisibilityBatchInput, ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	return &sqs.ChangeMessageVisibilityBatchOutput{}, nil
+}
+
 func (c *recordingSQSClient) DeleteQueue(ctx context.Context, _ *sqs.DeleteQueueInput, _ ...func(*sqs.Options)) (*sqs.DeleteQueueOutput, error) {
 	select {
 	case <-time.After(50 * time.Millisecond):
@@ -140,41 +199,61 @@ func (c *recordingSQSClient) DeleteQueue(ctx context.Context, _ *sqs.DeleteQueue
 	return &sqs.DeleteQueueOutput{}, ctx.Err()
 }
 
-// batchSQSClient returns one batch holding another instance's event followed by
-// the target instance's, then empty batches, so a test can prove the listener
-// scans the whole batch rather than only the first message. It also records the
-// last MaxNumberOfMessages it was asked for so a test can assert the batch size.
+// batchSQSClient returns one batch holding another instance's event, an
+// undecodable message and the target instance's event, then empty batches, so a
+// test can prove the listener scans the whole batch rather than only the first
+// message. It records the last MaxNumberOfMessages and VisibilityTimeout it was
+// asked for, and how the messages were acknowledged.
 type batchSQSClient struct {
-	match       string
-	received    int64
-	deletes     int64
-	maxMessages int64
+	match             string
+	received          int64
+	deletes           int64
+	deleteHadDeadline bool
+	batchDeletes      int64
+	maxMessages       int64
+	visibilityTimeout int64
 }
 
 func (c *batchSQSClient) CreateQueue(context.Context, *sqs.CreateQueueInput, ...func(*sqs.Options)) (*sqs.CreateQueueOutput, error) {
 	return &sqs.CreateQueueOutput{QueueUrl: aws.String("url")}, nil
 }
 
+func (*batchSQSClient) GetQueueUrl(_ context.Context, in *sqs.GetQueueUrlInput, _ ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String("https://sqs.us-east-1.amazonaws.com/" + aws.ToString(in.QueueOwnerAWSAccountId) + "/" + aws.ToString(in.QueueName))}, nil
+}
+
 func (c *batchSQSClient) GetQueueAttributes(context.Context, *sqs.GetQueueAttributesInput, ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
 	return &sqs.GetQueueAttributesOutput{Attributes: map[string]string{"QueueArn": "arn"}}, nil
 }
 
 func (c *batchSQSClient) ReceiveMessage(_ context.Context, in *sqs.ReceiveMessageInput, _ ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
 	atomic.StoreInt64(&c.maxMessages, int64(in.MaxNumberOfMessages))
+	atomic.StoreInt64(&c.visibilityTimeout, int64(in.VisibilityTimeout))
 	if atomic.AddInt64(&c.received, 1) != 1 {
 		return &sqs.ReceiveMessageOutput{}, nil
 	}
 	return &sqs.ReceiveMessageOutput{Messages: []sqstypes.Message{
 		batchMessage("i-999999999999", "h1"),
-		batchMessage(c.match, "h2"),
+		{Body: aws.String("not json"), ReceiptHandle: aws.String("h2")},
+		batchMessage(c.match, "h3"),
 	}}, nil
 }
 
-func (c *batchSQSClient) DeleteMessage(context.Context, *sqs.DeleteMessageInput, ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+func (c *batchSQSClient) DeleteMessage(ctx context.Context, _ *sqs.DeleteMessageInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	_, c.deleteHadDeadline = ctx.Deadline()
 	atomic.AddInt64(&c.deletes, 1)
 	return &sqs.DeleteMessageOutput{}, nil
 }
 
+func (c *batchSQSClient) DeleteMessageBatch(_ context.Context, in *sqs.DeleteMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	atomic.AddInt64(&c.batchDeletes, int64(len(in.Entries)))
+	return &sqs.DeleteMessageBatchOutput{}, nil
+}
+
+func (*batchSQSClient) ChangeMessageVisibilityBatch(context.Context, *sqs.ChangeMessageVisibilityBatchInput, ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	return &sqs.ChangeMessageVisibilityBatchOutput{}, nil
+}
+
 func (c *batchSQSClient) DeleteQueue(context.Context, *sqs.DeleteQueueInput, ...func(*sqs.Options)) (*sqs.DeleteQueueOutput, error) {
 	return &sqs.DeleteQueueOutput{}, nil
 }
@@ -193,6 +272,14 @@ func (c *recordingSNSClient) Subscribe(context.Context, *sns.SubscribeInput, ...
 	return &sns.SubscribeOutput{SubscriptionArn: aws.String("arn")}, nil
 }
 
+func (c *recordingSNSClient) ConfirmSubscription(context.Context, *sns.ConfirmSubscriptionInput, ...func(*sns.Options)) (*sns.ConfirmSubscriptionOutput, error) {
+	return &sns.ConfirmSubscriptionOutput{}, nil
+}
+
+func (c *recordingSNSClient) GetSubscriptionAttributes(context.Context, *sns.GetSubscriptionAttributesInput, ...func(*sns.Options)) (*sns.GetSubscriptionAttributesOutput, error) {
+	return &sns.GetSubscriptionAttributesOutput{}, nil
+}
+
 func (c *recordingSNSClient) Unsubscribe(ctx context.Context, _ *sns.UnsubscribeInput, _ ...func(*sns.Options)) (*sns.UnsubscribeOutput, error) {
 	select {
 	case <-time.After(50 * time.Millisecond):
@@ -204,6 +291,14 @@ func (c *recordingSNSClient) Unsubscribe(ctx context.Context, _ *sns.Unsubscribe
 
 type noopASGClient struct{}
 
+func (noopASGClient) DescribeLifecycleHooks(context.Context, *autoscaling.DescribeLifecycleHooksInput, ...func(*autoscaling.Options)) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	return &autoscaling.DescribeLifecycleHooksOutput{}, nil
+}
+
+func (noopASGClient) DescribeAutoScalingInstances(context.Context, *autoscaling.DescribeAutoScalingInstancesInput, ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+	return &autoscaling.DescribeAutoScalingInstancesOutput{}, nil
+}
+
 func (noopASGClient) CompleteLifecycleAction(context.Context, *autoscaling.CompleteLifecycleActionInput, ...func(*autoscaling.Options)) (*autoscaling.CompleteLifecycleActionOutput, error) {
 	return &autoscaling.CompleteLifecycleActionOutput{}, nil
 }
@@ -251,6 +346,14 @@ type recordingASGClient struct {
 	completeErr error
 }
 
+func (c *recordingASGClient) DescribeLifecycleHooks(context.Context, *autoscaling.DescribeLifecycleHooksInput, ...func(*autoscaling.Options)) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	return &autoscaling.DescribeLifecycleHooksOutput{}, nil
+}
+
+func (c *recordingASGClient) DescribeAutoScalingInstances(context.Context, *autoscaling.DescribeAutoScalingInstancesInput, ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+	return &autoscaling.DescribeAutoScalingInstancesOutput{}, nil
+}
+
 func (c *recordingASGClient) CompleteLifecycleAction(ctx context.Context, _ *autoscaling.CompleteLifecycleActionInput, _ ...func(*autoscaling.Options)) (*autoscaling.CompleteLifecycleActionOutput, error) {
 	c.completeErr = ctx.Err()
 	return &autoscaling.CompleteLifecycleActionOutput{}, ctx.Err()
@@ -276,7 +379,7 @@ func TestAutoscalingNoticeCompletesOnCancellation(t *testing.T) {
 	as := &recordingASGClient{}
 	notice := &autoscalingTerminationNotice{
 		noticeType:        "autoscaling",
-		message:           &Message{GroupName: "g", HookName: "h", InstanceID: "i", ActionToken: "t"},
+		messages:          []*Message{{GroupName: "g", HookName: "h", InstanceID: "i", ActionToken: "t"}},
 		autoscaling:       as,
 		heartbeatInterval: time.Hour,
 	}
@@ -305,6 +408,14 @@ type countingASGClient struct {
 	heartbeats int64
 }
 
+func (c *countingASGClient) DescribeLifecycleHooks(context.Context, *autoscaling.DescribeLifecycleHooksInput, ...func(*autoscaling.Options)) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	return &autoscaling.DescribeLifecycleHooksOutput{}, nil
+}
+
+func (c *countingASGClient) DescribeAutoScalingInstances(context.Context, *autoscaling.DescribeAutoScalingInstancesInput, ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+	return &autoscaling.DescribeAutoScalingInstancesOutput{}, nil
+}
+
 func (c *countingASGClient) CompleteLifecycleAction(context.Context, *autoscaling.CompleteLifecycleActionInput, ...func(*autoscaling.Options)) (*autoscaling.CompleteLifecycleActionOutput, error) {
 	return &autoscaling.CompleteLifecycleActionOutput{}, nil
 }
@@ -406,13 +517,13 @@ func TestAutoscalingNoticeStopsHeartbeatWhenHandleReturns(t *testing.T) {
 	as := &stubAutoscalingClient{}
 	notice := &autoscalingTerminationNotice{
 		noticeType: "autoscaling",
-		message: &Message{
+		messages: []*Message{{
 			GroupName:   "group",
 			HookName:    "hook",
 			InstanceID:  "i-1234567890",
 			ActionToken: "token",
 			Transition:  "autoscaling:EC2_INSTANCE_TERMINATING",
-		},
+		}},
 		autoscaling:       as,
 		heartbeatInterval: 10 * time.Millisecond,
 	}
@@ -472,10 +583,23 @@ func TestAutoscalingListenerScansMessageBatch(t *testing.T) {
 		t.Fatal("expected a notice from the matching message later in the batch, got none")
 	}
 
-	// Both the non-matching message and the match ahead of the return are deleted,
-	// proving the loop walked past the first message.
-	if got := atomic.LoadInt64(&sq.deletes); got < 2 {
-		t.Errorf("DeleteMessage calls = %d, want >= 2 (the whole batch up to the match is scanned)", got)
+	// The messages that don't concern this instance are deleted together, proving
+	// the loop walked past the first message; the match is deleted on its own once
+	// handed off, on a bounded context that outlives the listener's.
+	if got := atomic.LoadInt64(&sq.batchDeletes); got != 2 {
+		t.Errorf("DeleteMessageBatch entries = %d, want 2 (the other instance's event and the undecodable message)", got)
+	}
+	if got := atomic.LoadInt64(&sq.deletes); got != 1 {
+		t.Errorf("DeleteMessage calls = %d, want 1 (the handed-off termination notice)", got)
+	}
+	if !sq.deleteHadDeadline {
+		t.Error("DeleteMessage context had no deadline; acknowledging the notice must be bounded by a timeout")
+	}
+
+	// Messages stay hidden while they are processed, so an unacknowledged notice
+	// is redelivered rather than lost or seen twice at once.
+	if got := atomic.LoadInt64(&sq.visibilityTimeout); got <= 0 {
+		t.Errorf("ReceiveMessage VisibilityTimeout = %d, want > 0", got)
 	}
 
 	// The poll must request a full batch; at MaxNumberOfMessages: 1 the fan-out
@@ -506,7 +630,7 @@ func TestAutoscalingNoticeStopsHeartbeat(t *testing.T) {
 	as := &countingASGClient{}
 	notice := &autoscalingTerminationNotice{
 		noticeType:        "autoscaling",
-		message:           &Message{GroupName: "g", HookName: "h", InstanceID: "i", ActionToken: "t"},
+		messages:          []*Message{{GroupName: "g", HookName: "h", InstanceID: "i", ActionToken: "t"}},
 		autoscaling:       as,
 		heartbeatInterval: 5 * time.Millisecond,
 	}
@@ -536,3 +660,724 @@ func TestAutoscalingNoticeStopsHeartbeat(t *testing.T) {
 	}
 	t.Errorf("heartbeat goroutine still running after Handle returned (goroutines: before=%d, now=%d)", before, runtime.NumGoroutine())
 }
+
+// scriptedSQSClient returns each of batches from successive receives, then empty
+// batches, and records the batch-deleted receipt handles.
+type scriptedSQSClient struct {
+	stubSQSClient
+	mu       sync.Mutex
+	batches  [][]sqstypes.Message
+	received int
+	deleted  []string
+}
+
+func (c *scriptedSQSClient) ReceiveMessage(context.Context, *sqs.ReceiveMessageInput, ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.received >= len(c.batches) {
+		return &sqs.ReceiveMessageOutput{}, nil
+	}
+	c.received++
+	return &sqs.ReceiveMessageOutput{Messages: c.batches[c.received-1]}, nil
+}
+
+func (c *scriptedSQSClient) DeleteMessageBatch(_ context.Context, in *sqs.DeleteMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range in.Entries {
+		c.deleted = append(c.deleted, aws.ToString(e.ReceiptHandle))
+	}
+	return &sqs.DeleteMessageBatchOutput{}, nil
+}
+
+func lifecycleMessage(instanceID, hook, token, handle string) sqstypes.Message {
+	inner := `{"AutoScalingGroupName":"group","EC2InstanceId":"` + instanceID + `","LifecycleActionToken":"` + token + `","LifecycleTransition":"autoscaling:EC2_INSTANCE_TERMINATING","LifecycleHookName":"` + hook + `"}`
+	env, _ := json.Marshal(&Envelope{Type: "t", Message: inner})
+	return sqstypes.Message{Body: aws.String(string(env)), ReceiptHandle: aws.String(handle)}
+}
+
+// A redelivered action token, or a repeat of a hook that is already being
+// handled, is acknowledged and skipped with a debug log naming the hook.
+func TestAutoscalingListenerSkipsDuplicates(t *testing.T) {
+	const instanceID = "i-000000000000"
+	sq := &scriptedSQSClient{batches: [][]sqstypes.Message{
+		{lifecycleMessage(instanceID, "handled-hook", "seen-token", "h1")},
+		{lifecycleMessage(instanceID, "handled-hook", "new-token", "h2")},
+		{lifecycleMessage(instanceID, "other-hook", "other-token", "h3")},
+	}}
+	queue := NewQueue("queue", "topic", sq, &stubSNSClient{}, "")
+	listener := NewAutoscalingListener(instanceID, queue, &stubAutoscalingClient{}, time.Minute)
+	if err := listener.seen.add(&Message{GroupName: "group", HookName: "handled-hook", InstanceID: instanceID, ActionToken: "seen-token"}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	logger, hook := logrustest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	notices := make(chan TerminationNotice, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := listener.Start(ctx, notices, logrus.NewEntry(logger)); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	n := (<-notices).(*autoscalingTerminationNotice)
+	if got := n.messages[0].ActionToken; got != "other-token" {
+		t.Errorf("notice token = %q, want %q", got, "other-token")
+	}
+	if want := []string{"h1", "h2"}; !slices.Equal(sq.deleted, want) {
+		t.Errorf("acknowledged duplicates = %v, want %v", sq.deleted, want)
+	}
+
+	var duplicates int
+	for _, e := range hook.AllEntries() {
+		if e.Message == "Skipping duplicate lifecycle message" {
+			duplicates++
+			if e.Level != logrus.DebugLevel || e.Data["hook"] != "handled-hook" {
+				t.Errorf("duplicate logged at %s with hook %v, want debug with handled-hook", e.Level, e.Data["hook"])
+			}
+		}
+	}
+	if duplicates != 2 {
+		t.Errorf("logged %d duplicates, want 2", duplicates)
+	}
+}
+
+// A token is only recorded as seen once its notice has been handed off, so a
+// listener stopped before then, by a crash say, handles the redelivery.
+func TestAutoscalingListenerRecordsTokenOnHandoff(t *testing.T) {
+	const instanceID = "i-000000000000"
+	store := newStateStore(t.TempDir())
+	listen := func(hookWindow time.Duration, token string) (*logrustest.Hook, chan TerminationNotice, func()) {
+		sq := &scriptedSQSClient{batches: [][]sqstypes.Message{{lifecycleMessage(instanceID, "hook", token, "h1")}}}
+		listener := NewAutoscalingListener(instanceID, NewQueue("queue", "topic", sq, &stubSNSClient{}, ""), &stubAutoscalingClient{}, time.Minute)
+		listener.seen = newSeenMessages(store)
+		listener.hookWindow = hookWindow
+		logger, hook := logrustest.NewNullLogger()
+		logger.SetLevel(logrus.DebugLevel)
+		notices := make(chan TerminationNotice, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_ = listener.Start(ctx, notices, logrus.NewEntry(logger))
+		}()
+		return hook, notices, func() { cancel(); <-done }
+	}
+	persisted := func(token string) bool {
+		seen := newSeenMessages(store)
+		if err := seen.load(); err != nil {
+			t.Fatalf("load: %v", err)
+		}
+		return seen.contains(&Message{ActionToken: token})
+	}
+
+	hook, _, stop := listen(time.Hour, "collected-token")
+	waitFor(t, func() bool { return logged(hook.AllEntries(), "Collecting further lifecycle hooks") })
+	stop()
+	if persisted("collected-token") {
+		t.Error("a token collected but never handed off was recorded as seen")
+	}
+
+	_, notices, stop := listen(0, "handed-off-token")
+	<-notices
+	stop()
+	if !persisted("handed-off-token") {
+		t.Error("expected the handed off token to be recorded as seen")
+	}
+}
+
+// Seen tokens are persisted to the state directory so a restarted daemon still
+// recognises them. Hooks aren't, since an instance back from a warm pool is
+// terminated again through the same hook.
+func TestSeenMessagesPersist(t *testing.T) {
+	store := newStateStore(t.TempDir())
+	msg := &Message{GroupName: "group", HookName: "hook", InstanceID: "i-1", ActionToken: "token"}
+	if err := newSeenMessages(store).add(msg); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	restarted := newSeenMessages(store)
+	if err := restarted.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !restarted.contains(&Message{ActionToken: "token"}) {
+		t.Error("expected the persisted token to be recognised after a restart")
+	}
+	if restarted.contains(&Message{GroupName: "group", HookName: "hook", InstanceID: "i-1", ActionToken: "new"}) {
+		t.Error("a new token for a hook seen before a restart must not be treated as a duplicate")
+	}
+}
+
+// hookRecordingASGClient records the hooks heartbeated and completed.
+type hookRecordingASGClient struct {
+	mu         sync.Mutex
+	heartbeats map[string]int
+	completed  []string
+}
+
+func (c *hookRecordingASGClient) RecordLifecycleActionHeartbeat(_ context.Context, in *autoscaling.RecordLifecycleActionHeartbeatInput, _ ...func(*autoscaling.Options)) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.heartbeats == nil {
+		c.heartbeats = map[string]int{}
+	}
+	c.heartbeats[aws.ToString(in.LifecycleHookName)]++
+	return &autoscaling.RecordLifecycleActionHeartbeatOutput{}, nil
+}
+
+func (c *hookRecordingASGClient) DescribeLifecycleHooks(context.Context, *autoscaling.DescribeLifecycleHooksInput, ...func(*autoscaling.Options)) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	return &autoscaling.DescribeLifecycleHooksOutput{}, nil
+}
+
+func (c *hookRecordingASGClient) DescribeAutoScalingInstances(context.Context, *autoscaling.DescribeAutoScalingInstancesInput, ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+	return &autoscaling.DescribeAutoScalingInstancesOutput{}, nil
+}
+
+func (c *hookRecordingASGClient) CompleteLifecycleAction(_ context.Context, in *autoscaling.CompleteLifecycleActionInput, _ ...func(*autoscaling.Options)) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.completed = append(c.completed, aws.ToString(in.LifecycleHookName))
+	return &autoscaling.CompleteLifecycleActionOutput{}, nil
+}
+
+// With a hook window, every termination hook for this instance that arrives
+// within the window is collected into one notice, and all of them are
+// heartbeated and completed together.
+func TestAutoscalingListenerCollectsHooksWithinWindow(t *testing.T) {
+	const instanceID = "i-000000000000"
+	sq := &scriptedSQSClient{batches: [][]sqstypes.Message{
+		{lifecycleMessage(instanceID, "lifecycled", "token-1", "h1")},
+		{lifecycleMessage("i-999999999999", "lifecycled", "token-2", "h2")},
+		{lifecycleMessage(instanceID, "log-archiver", "token-3", "h3")},
+	}}
+	as := &hookRecordingASGClient{}
+	queue := NewQueue("queue", "topic", sq, &stubSNSClient{}, "")
+	listener := NewAutoscalingListener(instanceID, queue, as, 5*time.Millisecond)
+	listener.hookWindow = 100 * time.Millisecond
+
+	logger, _ := logrustest.NewNullLogger()
+	notices := make(chan TerminationNotice, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := listener.Start(ctx, notices, logrus.NewEntry(logger)); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	notice := <-notices
+	if err := notice.Handle(ctx, sleepHandler{d: 30 * time.Millisecond}, logrus.NewEntry(logger)); err != nil {
+		t.Fatalf("Handle returned error: %v", err)
+	}
+
+	// A heartbeat may still be in flight after Handle returns.
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	want := []string{"lifecycled", "log-archiver"}
+	if !slices.Equal(as.completed, want) {
+		t.Errorf("completed hooks = %v, want %v", as.completed, want)
+	}
+	for _, hook := range want {
+		if as.heartbeats[hook] == 0 {
+			t.Errorf("hook %q was never heartbeated", hook)
+		}
+	}
+}
+
+// ackingSQSClient also records the receipt handles of messages deleted singly,
+// as termination notices are once handed off.
+type ackingSQSClient struct {
+	scriptedSQSClient
+	acked []string
+}
+
+func (c *ackingSQSClient) DeleteMessage(_ context.Context, in *sqs.DeleteMessageInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.acked = append(c.acked, aws.ToString(in.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+// A collected message received again while the window is open is still
+// pending: it isn't discarded as a duplicate, and is acknowledged with its
+// latest receipt handle.
+func TestAutoscalingListenerKeepsRedeliveredCollectedMessage(t *testing.T) {
+	const instanceID = "i-000000000000"
+	first := lifecycleMessage(instanceID, "lifecycled", "token-1", "h1")
+	first.MessageId = aws.String("m1")
+	again := lifecycleMessage(instanceID, "lifecycled", "token-1", "h1-again")
+	again.MessageId = aws.String("m1")
+	sq := &ackingSQSClient{scriptedSQSClient: scriptedSQSClient{batches: [][]sqstypes.Message{{first}, {again}}}}
+	queue := NewQueue("queue", "topic", sq, &stubSNSClient{}, "")
+	listener := NewAutoscalingListener(instanceID, queue, &stubAutoscalingClient{}, time.Minute)
+	listener.hookWindow = 50 * time.Millisecond
+
+	logger, _ := logrustest.NewNullLogger()
+	notices := make(chan TerminationNotice, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := listener.Start(ctx, notices, logrus.NewEntry(logger)); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	if n := (<-notices).(*autoscalingTerminationNotice); len(n.messages) != 1 {
+		t.Errorf("notice has %d messages, want 1", len(n.messages))
+	}
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	if len(sq.deleted) != 0 {
+		t.Errorf("batch deleted %v, want the redelivered message kept", sq.deleted)
+	}
+	if want := []string{"h1-again"}; !slices.Equal(sq.acked, want) {
+		t.Errorf("acknowledged %v, want %v", sq.acked, want)
+	}
+}
+
+func TestValidateHookWindow(t *testing.T) {
+	for _, tc := range []struct {
+		window  time.Duration
+		wantErr bool
+	}{
+		{window: 0},
+		{window: 10 * time.Second},
+		{window: 59 * time.Second},
+		{window: time.Minute, wantErr: true},
+		{window: time.Hour, wantErr: true},
+	} {
+		if err := ValidateHookWindow(tc.window); (err != nil) != tc.wantErr {
+			t.Errorf("ValidateHookWindow(%s) = %v, want error %v", tc.window, err, tc.wantErr)
+		}
+	}
+}
+
+// goneASGClient fails every heartbeat the way Auto Scaling does once the
+// lifecycle action has been completed, abandoned or timed out.
+type goneASGClient struct {
+	countingASGClient
+	completes int64
+}
+
+func (c *goneASGClient) RecordLifecycleActionHeartbeat(ctx context.Context, in *autoscaling.RecordLifecycleActionHeartbeatInput, opts ...func(*autoscaling.Options)) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+	_, _ = c.countingASGClient.RecordLifecycleActionHeartbeat(ctx, in, opts...)
+	return nil, &smithy.GenericAPIError{Code: "ValidationError", Message: "No active Lifecycle Action found with token"}
+}
+
+func (c *goneASGClient) CompleteLifecycleAction(context.Context, *autoscaling.CompleteLifecycleActionInput, ...func(*autoscaling.Options)) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	atomic.AddInt64(&c.completes, 1)
+	return &autoscaling.CompleteLifecycleActionOutput{}, nil
+}
+
+// lostActionHandler waits for the daemon to report that the lifecycle action was
+// lost, failing if it isn't told within a second.
+type lostActionHandler struct{}
+
+func (lostActionHandler) Execute(ctx context.Context, _ ...string) error {
+	select {
+	case <-ActionLost(ctx):
+		return nil
+	case <-time.After(time.Second):
+		return errors.New("handler was not told the lifecycle action was lost")
+	}
+}
+
+// A heartbeat rejected because the lifecycle action no longer exists stops the
+// heartbeats, is logged as an error, and is reported to the handler; the action
+// is not completed, since there is nothing left to complete.
+func TestAutoscalingNoticeStopsHeartbeatWhenActionIsGone(t *testing.T) {
+	as := &goneASGClient{}
+	notice := &autoscalingTerminationNotice{
+		noticeType:        "autoscaling",
+		messages:          []*Message{{GroupName: "g", HookName: "h", InstanceID: "i", ActionToken: "t"}},
+		autoscaling:       as,
+		heartbeatInterval: 5 * time.Millisecond,
+	}
+	logger, hook := logrustest.NewNullLogger()
+
+	if err := notice.Handle(context.Background(), lostActionHandler{}, logrus.NewEntry(logger)); err != nil {
+		t.Fatalf("Handle returned error: %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if got := atomic.LoadInt64(&as.heartbeats); got != 1 {
+		t.Errorf("heartbeats = %d, want 1; heartbeats must stop once the action is gone", got)
+	}
+	if got := atomic.LoadInt64(&as.completes); got != 0 {
+		t.Errorf("CompleteLifecycleAction called %d times, want 0 for a lost action", got)
+	}
+
+	var escalated bool
+	for _, e := range hook.AllEntries() {
+		if strings.HasPrefix(e.Message, "Lifecycle action is no longer active, stopping heartbeats") && e.Level == logrus.ErrorLevel {
+			escalated = true
+		}
+	}
+	if !escalated {
+		t.Errorf("expected the lost action to be logged at error level, got %v", messages(hook.AllEntries()))
+	}
+}
+
+// shortGoneASGClient is a goneASGClient whose hooks have a one second global
+// timeout.
+type shortGoneASGClient struct {
+	goneASGClient
+}
+
+func (c *shortGoneASGClient) DescribeLifecycleHooks(context.Context, *autoscaling.DescribeLifecycleHooksInput, ...func(*autoscaling.Options)) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	return &autoscaling.DescribeLifecycleHooksOutput{LifecycleHooks: []astypes.LifecycleHook{{
+		HeartbeatTimeout: aws.Int32(30),
+		GlobalTimeout:    aws.Int32(1),
+	}}}, nil
+}
+
+// lostDeadlineHandler records whether its context had a deadline before and after
+// the action was lost, and whether the context was still live well past the
+// original deadline.
+type lostDeadlineHandler struct {
+	before, after, alive bool
+}
+
+func (h *lostDeadlineHandler) Execute(ctx context.Context, _ ...string) error {
+	_, h.before = ctx.Deadline()
+	select {
+	case <-ActionLost(ctx):
+	case <-time.After(time.Second):
+		return errors.New("handler was not told the lifecycle action was lost")
+	}
+	_, h.after = ctx.Deadline()
+	time.Sleep(200 * time.Millisecond)
+	h.alive = ctx.Err() == nil
+	return nil
+}
+
+// Once the action is lost, the global timeout no longer applies, so the
+// handler is neither given it nor stopped by it.
+func TestAutoscalingNoticeDropsDeadlineWhenActionIsGone(t *testing.T) {
+	notice := &autoscalingTerminationNotice{
+		noticeType: "autoscaling",
+		messages: []*Message{{
+			GroupName:   "g",
+			HookName:    "h",
+			InstanceID:  "i",
+			ActionToken: "t",
+			// The global timeout passes 100ms from now.
+			Time: time.Now().Add(-900 * time.Millisecond),
+		}},
+		autoscaling:       &shortGoneASGClient{},
+		heartbeatInterval: 5 * time.Millisecond,
+	}
+	logger, _ := logrustest.NewNullLogger()
+	handler := &lostDeadlineHandler{}
+
+	if err := notice.Handle(context.Background(), handler, logrus.NewEntry(logger)); err != nil {
+		t.Fatalf("Handle returned error: %v", err)
+	}
+	if !handler.before {
+		t.Error("handler had no deadline while the action was active")
+	}
+	if handler.after {
+		t.Error("handler still had a deadline once the action was lost")
+	}
+	if !handler.alive {
+		t.Error("handler was stopped at the global timeout after the action was lost")
+	}
+}
+
+func TestLifecycleActionGone(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "no active lifecycle action", err: &smithy.GenericAPIError{Code: "ValidationError", Message: "No active Lifecycle Action found"}, want: true},
+		{name: "other validation error", err: &smithy.GenericAPIError{Code: "ValidationError", Message: "1 validation error detected: Value at 'lifecycleHookName' failed to satisfy constraint"}, want: false},
+		{name: "throttling", err: &smithy.GenericAPIError{Code: "Throttling"}, want: false},
+		{name: "network error", err: errors.New("connection reset"), want: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := lifecycleActionGone(tc.err); got != tc.want {
+				t.Errorf("lifecycleActionGone() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// A file handler learns the action was lost through the file named by
+// LIFECYCLED_ACTION_LOST_FILE.
+func TestFileHandlerSignalsLostAction(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "handler.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nwhile [ ! -e \"$LIFECYCLED_ACTION_LOST_FILE\" ]; do sleep 0.01; done\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	status := newActionStatus()
+	ctx, cancel := context.WithTimeout(withActionStatus(context.Background(), status), 5*time.Second)
+	defer cancel()
+	time.AfterFunc(20*time.Millisecond, func() { status.markLost(&Message{HookName: "h"}) })
+
+	if err := NewFileHandler(f).Execute(ctx); err != nil {
+		t.Fatalf("Execute returned %v; the handler should exit once the signal file appears", err)
+	}
+}
+
+// With an existing, possibly shared, queue the listener doesn't delete it, and
+// releases every message but the termination notice for other consumers,
+// including this instance's other messages and duplicates.
+func TestAutoscalingListenerExistingQueue(t *testing.T) {
+	const instanceID = "i-000000000000"
+	launch := `{"AutoScalingGroupName":"group","EC2InstanceId":"` + instanceID + `","LifecycleActionToken":"launch-token","LifecycleTransition":"autoscaling:EC2_INSTANCE_LAUNCHING","LifecycleHookName":"launch"}`
+	env, _ := json.Marshal(&Envelope{Type: "t", Message: launch})
+
+	sq := &eventSQSClient{scriptedSQSClient: scriptedSQSClient{batches: [][]sqstypes.Message{{
+		lifecycleMessage("i-999999999999", "hook", "other-token", "h1"),
+		{Body: aws.String("not json"), ReceiptHandle: aws.String("h2")},
+		{Body: aws.String(string(env)), ReceiptHandle: aws.String("h3")},
+		lifecycleMessage(instanceID, "hook", "token", "h4"),
+		lifecycleMessage(instanceID, "hook", "token", "h5"),
+	}}}}
+	queue := NewExistingQueue("https://sqs.us-east-1.amazonaws.com/123456789012/shared", sq)
+	listener := NewAutoscalingListener(instanceID, queue, &stubAutoscalingClient{}, time.Minute)
+
+	logger, _ := logrustest.NewNullLogger()
+	notices := make(chan TerminationNotice, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := listener.Start(ctx, notices, logrus.NewEntry(logger)); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	n := (<-notices).(*autoscalingTerminationNotice)
+	if got := n.messages[0].ActionToken; got != "token" {
+		t.Errorf("notice token = %q, want %q", got, "token")
+	}
+	if want := []string{"h1", "h2", "h3", "h5"}; !slices.Equal(sq.released, want) {
+		t.Errorf("released = %v, want %v", sq.released, want)
+	}
+	if len(sq.deleted) != 0 {
+		t.Errorf("deleted = %v, want none", sq.deleted)
+	}
+	if got := atomic.LoadInt64(&sq.deleteQueueCalls); got != 0 {
+		t.Errorf("DeleteQueue called %d times for an existing queue, want 0", got)
+	}
+}
+
+// A body is decoded as an SNS envelope or, with raw message delivery, as the
+// autoscaling message itself, without logging an error for either.
+func TestAutoscalingListenerParseMessage(t *testing.T) {
+	const instanceID = "i-000000000000"
+	raw := `{"Time":"2016-02-26T21:09:59.517Z","AutoScalingGroupName":"group","EC2InstanceId":"` + instanceID + `","LifecycleActionToken":"token","LifecycleTransition":"autoscaling:EC2_INSTANCE_TERMINATING","LifecycleHookName":"hook"}`
+	env, _ := json.Marshal(&Envelope{Type: "Notification", Message: raw})
+
+	tests := []struct {
+		name    string
+		body    string
+		wantOK  bool
+		wantErr bool
+	}{
+		{name: "sns envelope", body: string(env), wantOK: true},
+		{name: "raw message", body: raw, wantOK: true},
+		{name: "not json", body: "not json", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			listener := NewAutoscalingListener(instanceID, nil, &stubAutoscalingClient{}, time.Minute)
+			logger, hook := logrustest.NewNullLogger()
+
+			msg, ok := listener.parseMessage(context.Background(), sqstypes.Message{Body: aws.String(tc.body)}, logrus.NewEntry(logger))
+			if ok != tc.wantOK {
+				t.Fatalf("parseMessage ok = %v, want %v", ok, tc.wantOK)
+			}
+			if ok && (msg.ActionToken != "token" || msg.HookName != "hook") {
+				t.Errorf("parsed %+v, want the lifecycle action", msg)
+			}
+			var errored bool
+			for _, e := range hook.AllEntries() {
+				errored = errored || e.Level == logrus.ErrorLevel
+			}
+			if errored != tc.wantErr {
+				t.Errorf("logged an error = %v, want %v: %v", errored, tc.wantErr, messages(hook.AllEntries()))
+			}
+		})
+	}
+}
+
+// missingQueueSQSClient fails the first receive as if the queue had been
+// deleted, then behaves like scriptedSQSClient, counting queue creations.
+type missingQueueSQSClient struct {
+	scriptedSQSClient
+	creates int64
+	missing int64
+}
+
+func (c *missingQueueSQSClient) CreateQueue(context.Context, *sqs.CreateQueueInput, ...func(*sqs.Options)) (*sqs.CreateQueueOutput, error) {
+	atomic.AddInt64(&c.creates, 1)
+	return &sqs.CreateQueueOutput{QueueUrl: aws.String("url")}, nil
+}
+
+func (c *missingQueueSQSClient) ReceiveMessage(ctx context.Context, in *sqs.ReceiveMessageInput, opts ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	if atomic.AddInt64(&c.missing, -1) >= 0 {
+		return nil, &sqstypes.QueueDoesNotExist{Message: aws.String("The specified queue does not exist.")}
+	}
+	return c.scriptedSQSClient.ReceiveMessage(ctx, in, opts...)
+}
+
+// A queue deleted from underneath the listener is recreated and resubscribed,
+// logged as an error, and the listener goes on to receive from it.
+func TestAutoscalingListenerRecreatesMissingQueue(t *testing.T) {
+	sq := &missingQueueSQSClient{
+		scriptedSQSClient: scriptedSQSClient{batches: [][]sqstypes.Message{{lifecycleMessage("i-1", "hook", "token", "h1")}}},
+		missing:           1,
+	}
+	sn := &stubSNSClient{}
+	listener := NewAutoscalingListener("i-1", NewQueue("queue", "topic", sq, sn, ""), &stubAutoscalingClient{}, time.Minute)
+	logger, hook := logrustest.NewNullLogger()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	notices := make(chan TerminationNotice, 1)
+	if err := listener.Start(ctx, notices, logrus.NewEntry(logger)); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	select {
+	case <-notices:
+	default:
+		t.Fatal("expected a termination notice from the recreated queue")
+	}
+	if got := atomic.LoadInt64(&sq.creates); got != 2 {
+		t.Errorf("CreateQueue called %d times, want 2", got)
+	}
+	if got := atomic.LoadInt64(&sn.subscribeCalls); got != 2 {
+		t.Errorf("Subscribe called %d times, want 2", got)
+	}
+	if !loggedAt(hook.AllEntries(), logrus.ErrorLevel, "Sqs queue is missing") {
+		t.Errorf("expected the repair to be logged as an error, got %v", messages(hook.AllEntries()))
+	}
+}
+
+// recreateFailingSQSClient refuses to create the queue again after it was first
+// created, like SQS does for a minute after a queue is deleted, and records the
+// queue URLs it is asked to receive from.
+type recreateFailingSQSClient struct {
+	missingQueueSQSClient
+	receivedFrom []string
+}
+
+func (c *recreateFailingSQSClient) CreateQueue(ctx context.Context, in *sqs.CreateQueueInput, opts ...func(*sqs.Options)) (*sqs.CreateQueueOutput, error) {
+	if atomic.LoadInt64(&c.creates) > 0 {
+		return nil, &smithy.GenericAPIError{Code: "AWS.SimpleQueueService.QueueDeletedRecently", Message: "You must wait 60 seconds after deleting a queue"}
+	}
+	return c.missingQueueSQSClient.CreateQueue(ctx, in, opts...)
+}
+
+func (c *recreateFailingSQSClient) ReceiveMessage(ctx context.Context, in *sqs.ReceiveMessageInput, opts ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	c.mu.Lock()
+	c.receivedFrom = append(c.receivedFrom, aws.ToString(in.QueueUrl))
+	c.mu.Unlock()
+	return c.missingQueueSQSClient.ReceiveMessage(ctx, in, opts...)
+}
+
+// A queue that can't be recreated yet keeps its URL, so the listener goes on
+// finding it missing and trying again, rather than receiving from no queue.
+func TestAutoscalingListenerRecreateFails(t *testing.T) {
+	sq := &recreateFailingSQSClient{missingQueueSQSClient: missingQueueSQSClient{missing: 1}}
+	queue := NewQueue("queue", "topic", sq, &stubSNSClient{}, "")
+	listener := NewAutoscalingListener("i-1", queue, &stubAutoscalingClient{}, time.Minute)
+	logger, hook := logrustest.NewNullLogger()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- listener.Start(ctx, make(chan TerminationNotice, 1), logrus.NewEntry(logger))
+	}()
+
+	waitFor(t, func() bool { return logged(hook.AllEntries(), "Failed to recreate sqs queue") })
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	if queue.url != "url" {
+		t.Errorf("queue url = %q after a failed recreate, want the old url kept", queue.url)
+	}
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	for _, url := range sq.receivedFrom {
+		if url != "url" {
+			t.Errorf("received from %q, want only the queue's url", url)
+		}
+	}
+}
+
+// A subscription deleted from underneath the listener is noticed by the periodic
+// check and recreated, logged as an error.
+func TestAutoscalingListenerResubscribes(t *testing.T) {
+	sq := &scriptedSQSClient{}
+	sn := &stubSNSClient{subscriptionErr: &snstypes.NotFoundException{Message: aws.String("Subscription does not exist")}}
+	listener := NewAutoscalingListener("i-1", NewQueue("queue", "topic", sq, sn, ""), &stubAutoscalingClient{}, time.Minute)
+	listener.subscriptionCheck = time.Nanosecond
+	logger, hook := logrustest.NewNullLogger()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- listener.Start(ctx, make(chan TerminationNotice, 1), logrus.NewEntry(logger))
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&sn.subscribeCalls) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	if got := atomic.LoadInt64(&sn.subscribeCalls); got < 2 {
+		t.Fatalf("Subscribe called %d times, want a resubscribe", got)
+	}
+	if !loggedAt(hook.AllEntries(), logrus.ErrorLevel, "Sns subscription is missing") {
+		t.Errorf("expected the repair to be logged as an error, got %v", messages(hook.AllEntries()))
+	}
+}
+
+// A subscription confirmation for one of the queue's topics is confirmed with
+// its token and not treated as an autoscaling message; one for any other topic
+// is ignored.
+func TestAutoscalingListenerConfirmsSubscriptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		topic         string
+		wantConfirmed []string
+	}{
+		{name: "own topic", topic: "topic", wantConfirmed: []string{"token"}},
+		{name: "other topic", topic: "other"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sn := &stubSNSClient{}
+			queue := NewQueue("queue", "topic", &stubSQSClient{}, sn, "")
+			listener := NewAutoscalingListener("i-1", queue, &stubAutoscalingClient{}, time.Minute)
+			logger, _ := logrustest.NewNullLogger()
+
+			body, _ := json.Marshal(&Envelope{Type: "SubscriptionConfirmation", TopicArn: tc.topic, Token: "token", Message: "You have chosen to subscribe"})
+			if _, ok := listener.parseMessage(context.Background(), sqstypes.Message{Body: aws.String(string(body))}, logrus.NewEntry(logger)); ok {
+				t.Error("expected the confirmation not to be handled as an autoscaling message")
+			}
+			if !slices.Equal(sn.confirmed, tc.wantConfirmed) {
+				t.Errorf("confirmed %v, want %v", sn.confirmed, tc.wantConfirmed)
+			}
+			if tc.wantConfirmed != nil && queue.subscriptionArns["topic"] != "confirmed" {
+				t.Errorf("subscription arn = %q, want the confirmed one", queue.subscriptionArns["topic"])
+			}
+		})
+	}
+}
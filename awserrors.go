@@ -0,0 +1,175 @@
+package lifecycled
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrorClass is a kind of AWS API failure, which decides how lifecycled and
+// lifecycled-queue-cleaner react to it.
+type ErrorClass int
+
+const (
+	// ErrorOther is any failure not classified below, transient or not.
+	ErrorOther ErrorClass = iota
+	// ErrorThrottled is a request the API throttled, worth trying again later.
+	ErrorThrottled
+	// ErrorAccessDenied is a request the credentials aren't allowed to make.
+	ErrorAccessDenied
+	// ErrorCredentials is a request made with expired or invalid credentials.
+	ErrorCredentials
+	// ErrorNotFound is a request for a resource that doesn't exist.
+	ErrorNotFound
+)
+
+// throttlingCodes are the error codes that SNS and SQS throttle with, beyond
+// the ones the SDK's retryer already knows.
+var throttlingCodes = map[string]struct{}{
+	"Throttled":     {},
+	"KMSThrottling": {},
+	"KmsThrottled":  {},
+}
+
+// accessDeniedCodes are the error codes for an authorization failure that
+// don't contain AccessDenied.
+var accessDeniedCodes = map[string]struct{}{
+	"AuthorizationError":    {},
+	"UnauthorizedOperation": {},
+}
+
+// credentialCodes are the error codes meaning the credentials (temporary STS
+// credentials or the cached SSO token) expired, or were never valid, and need
+// replacing.
+var credentialCodes = map[string]struct{}{
+	"ExpiredToken":                {},
+	"ExpiredTokenException":       {},
+	"RequestExpired":              {},
+	"SSOProviderInvalidToken":     {},
+	"InvalidClientTokenId":        {},
+	"UnrecognizedClientException": {},
+	"InvalidAccessKeyId":          {},
+	"SignatureDoesNotMatch":       {},
+	"AuthFailure":                 {},
+}
+
+// notFoundCodes are the error codes for a missing resource.
+var notFoundCodes = map[string]struct{}{
+	"NotFound":                                {},
+	"NotFoundException":                       {},
+	"ResourceNotFoundException":               {},
+	"AWS.SimpleQueueService.NonExistentQueue": {},
+}
+
+// ClassifyError returns the class of an AWS API error, or ErrorOther for any
+// other error.
+func ClassifyError(err error) ErrorClass {
+	var notExist *sqstypes.QueueDoesNotExist
+	if errors.As(err, &notExist) {
+		return ErrorNotFound
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return ErrorOther
+	}
+	code := apiErr.ErrorCode()
+	if _, ok := retry.DefaultThrottleErrorCodes[code]; ok {
+		return ErrorThrottled
+	}
+	if _, ok := throttlingCodes[code]; ok {
+		return ErrorThrottled
+	}
+	if _, ok := credentialCodes[code]; ok {
+		return ErrorCredentials
+	}
+	if _, ok := accessDeniedCodes[code]; ok || strings.Contains(code, "AccessDenied") {
+		return ErrorAccessDenied
+	}
+	if _, ok := notFoundCodes[code]; ok || strings.HasSuffix(code, ".NotFound") {
+		return ErrorNotFound
+	}
+	return ErrorOther
+}
+
+// String returns the class's name, for logging.
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorThrottled:
+		return "throttled"
+	case ErrorAccessDenied:
+		return "access denied"
+	case ErrorCredentials:
+		return "invalid credentials"
+	case ErrorNotFound:
+		return "not found"
+	default:
+		return "other"
+	}
+}
+
+// pollBackoff is how long a polling loop waits after a failure of the class
+// before trying again. Failures that need an operator to fix them are retried
+// slowly, since trying sooner only adds to the noise, but never given up on, so
+// the daemon recovers by itself once they are fixed.
+func (c ErrorClass) pollBackoff() time.Duration {
+	switch c {
+	case ErrorThrottled:
+		return 15 * time.Second
+	case ErrorAccessDenied, ErrorNotFound:
+		return time.Minute
+	case ErrorCredentials:
+		return 30 * time.Second
+	default:
+		return sqsErrorBackoff
+	}
+}
+
+// logLevel is the level to log a failure of the class at: a warning for what
+// is likely to pass by itself, and an error for what needs fixing.
+func (c ErrorClass) logLevel() logrus.Level {
+	switch c {
+	case ErrorAccessDenied, ErrorCredentials, ErrorNotFound:
+		return logrus.ErrorLevel
+	default:
+		return logrus.WarnLevel
+	}
+}
+
+// iamServicePrefixes are the IAM action prefixes of the services whose SDK
+// service ID doesn't give them.
+var iamServicePrefixes = map[string]string{
+	"cloudwatchlogs": "logs",
+}
+
+// FailedAction returns the IAM action of the API call that err came from, like
+// "sqs:ReceiveMessage", or "" if it didn't come from one.
+func FailedAction(err error) string {
+	var opErr *smithy.OperationError
+	if !errors.As(err, &opErr) {
+		return ""
+	}
+	service := strings.ToLower(strings.ReplaceAll(opErr.ServiceID, " ", ""))
+	if prefix, ok := iamServicePrefixes[service]; ok {
+		service = prefix
+	}
+	return service + ":" + opErr.OperationName
+}
+
+// logPollError logs a polling loop's failed call at the level its class calls
+// for, naming the missing permission when access was denied, and returns how
+// long to wait before trying again.
+func logPollError(log *logrus.Entry, err error, msg string) time.Duration {
+	class := ClassifyError(err)
+	log = log.WithError(err).WithField("errorClass", class.String())
+	if action := FailedAction(err); class == ErrorAccessDenied && action != "" {
+		log = log.WithField("action", action)
+		msg += ", missing permission for " + action
+	}
+	log.Log(class.logLevel(), msg)
+	return class.pollBackoff()
+}
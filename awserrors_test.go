@@ -0,0 +1,99 @@
+package lifecycled
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{name: "nil", err: nil, want: ErrorOther},
+		{name: "not an api error", err: errors.New("connection refused"), want: ErrorOther},
+		{name: "other api error", err: &smithy.GenericAPIError{Code: "InvalidParameterValue"}, want: ErrorOther},
+		{name: "sns throttled", err: &snstypes.ThrottledException{}, want: ErrorThrottled},
+		{name: "sqs throttled", err: &sqstypes.RequestThrottled{}, want: ErrorThrottled},
+		{name: "generic throttling", err: &smithy.GenericAPIError{Code: "Throttling"}, want: ErrorThrottled},
+		{name: "wrapped", err: fmt.Errorf("subscribe: %w", &smithy.GenericAPIError{Code: "ThrottlingException"}), want: ErrorThrottled},
+		{name: "access denied", err: &smithy.GenericAPIError{Code: "AccessDenied"}, want: ErrorAccessDenied},
+		{name: "access denied exception", err: &smithy.GenericAPIError{Code: "AccessDeniedException"}, want: ErrorAccessDenied},
+		{name: "sns authorization error", err: &snstypes.AuthorizationErrorException{}, want: ErrorAccessDenied},
+		{name: "ec2 unauthorized", err: &smithy.GenericAPIError{Code: "UnauthorizedOperation"}, want: ErrorAccessDenied},
+		{name: "expired token", err: &smithy.GenericAPIError{Code: "ExpiredToken"}, want: ErrorCredentials},
+		{name: "sso token", err: &smithy.GenericAPIError{Code: "SSOProviderInvalidToken"}, want: ErrorCredentials},
+		{name: "invalid token", err: &smithy.GenericAPIError{Code: "InvalidClientTokenId"}, want: ErrorCredentials},
+		{name: "missing queue", err: &sqstypes.QueueDoesNotExist{}, want: ErrorNotFound},
+		{name: "missing topic", err: &snstypes.NotFoundException{}, want: ErrorNotFound},
+		{name: "missing instance", err: &smithy.GenericAPIError{Code: "InvalidInstanceID.NotFound"}, want: ErrorNotFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ClassifyError(tc.err); got != tc.want {
+				t.Errorf("ClassifyError(%v) = %s, want %s", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFailedAction(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: &smithy.OperationError{ServiceID: "SQS", OperationName: "ReceiveMessage", Err: errors.New("denied")}, want: "sqs:ReceiveMessage"},
+		{err: &smithy.OperationError{ServiceID: "Auto Scaling", OperationName: "CompleteLifecycleAction", Err: errors.New("denied")}, want: "autoscaling:CompleteLifecycleAction"},
+		{err: &smithy.OperationError{ServiceID: "CloudWatch Logs", OperationName: "PutLogEvents", Err: errors.New("denied")}, want: "logs:PutLogEvents"},
+		{err: errors.New("denied"), want: ""},
+	}
+	for _, tc := range tests {
+		if got := FailedAction(tc.err); got != tc.want {
+			t.Errorf("FailedAction(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+// A permission error in a polling loop is logged as an error naming the missing
+// action, and retried slowly, rather than warned about every few seconds.
+func TestLogPollError(t *testing.T) {
+	denied := &smithy.OperationError{
+		ServiceID:     "SQS",
+		OperationName: "ReceiveMessage",
+		Err:           &smithy.GenericAPIError{Code: "AccessDenied", Message: "not authorized to perform: sqs:receivemessage"},
+	}
+	tests := []struct {
+		name        string
+		err         error
+		wantLevel   logrus.Level
+		wantMessage string
+		wantBackoff time.Duration
+	}{
+		{name: "access denied", err: denied, wantLevel: logrus.ErrorLevel, wantMessage: "Failed to get messages from SQS, missing permission for sqs:ReceiveMessage", wantBackoff: time.Minute},
+		{name: "throttled", err: &sqstypes.RequestThrottled{Message: aws.String("slow down")}, wantLevel: logrus.WarnLevel, wantMessage: "Failed to get messages from SQS", wantBackoff: 15 * time.Second},
+		{name: "other", err: errors.New("connection reset"), wantLevel: logrus.WarnLevel, wantMessage: "Failed to get messages from SQS", wantBackoff: sqsErrorBackoff},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logger, hook := logrustest.NewNullLogger()
+			backoff := logPollError(logrus.NewEntry(logger), tc.err, "Failed to get messages from SQS")
+			if backoff != tc.wantBackoff {
+				t.Errorf("backoff = %s, want %s", backoff, tc.wantBackoff)
+			}
+			entry := hook.LastEntry()
+			if entry == nil || entry.Level != tc.wantLevel || entry.Message != tc.wantMessage {
+				t.Fatalf("logged %v, want %q at %s", entry, tc.wantMessage, tc.wantLevel)
+			}
+		})
+	}
+}
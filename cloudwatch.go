@@ -1,18 +1,36 @@
 package lifecycled
 
 import (
+	"cmp"
 	"context"
 	"errors"
-	"strings"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	cwltypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
-	"github.com/aws/smithy-go"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// cloudWatchPutTimeout bounds each PutLogEvents call made without a deadline
+	// of the caller's.
+	cloudWatchPutTimeout = 5 * time.Second
+
+	// maxBatchEvents and maxBatchBytes are the most one PutLogEvents call
+	// accepts, where each event counts as its message plus eventOverhead bytes.
+	maxBatchEvents = 10000
+	maxBatchBytes  = 1048576
+	eventOverhead  = 26
+
+	// maxBatchSpan is the longest time one PutLogEvents call's events may span.
+	maxBatchSpan = 24 * time.Hour
+)
+
 // CloudWatchLogsClient is the subset of the CloudWatch Logs API the hook uses.
 type CloudWatchLogsClient interface {
 	CreateLogGroup(context.Context, *cloudwatchlogs.CreateLogGroupInput, ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogGroupOutput, error)
@@ -23,11 +41,43 @@ type CloudWatchLogsClient interface {
 // CloudWatchLogsHook is a logrus hook that ships log entries to a CloudWatch
 // Logs stream. Entries are written synchronously so each line is delivered
 // before the daemon continues, which matters when handling a termination notice
-// that ends with the instance shutting down.
+// that ends with the instance shutting down. With StartBatching, entries are
+// buffered and sent in the background instead, and Flush delivers them at the
+// points that matter. EnableSpool keeps entries that fail to send on disk, and
+// LimitLineSize and LimitRate bound what a runaway caller can send.
 type CloudWatchLogsHook struct {
 	client     CloudWatchLogsClient
 	groupName  string
 	streamName string
+
+	// mu guards the batching state: the events waiting to be sent, their size
+	// as PutLogEvents counts it, and how many were dropped for want of room.
+	mu           sync.Mutex
+	batching     bool
+	pending      []cwltypes.InputLogEvent
+	pendingBytes int
+	dropped      int
+
+	// sendMu keeps flushes in order, so events arrive in the order they were
+	// logged, and guards the spool.
+	sendMu sync.Mutex
+	spool  *cloudWatchSpool
+
+	// limitMu guards the line size and rate limits, and the rate limit's
+	// current window and the entries it dropped.
+	limitMu      sync.Mutex
+	maxLineBytes int
+	rateLines    int
+	rateWindow   time.Duration
+	windowStart  time.Time
+	windowLines  int
+	rateDropped  int
+
+	// full wakes the flusher before its interval when the buffer fills, and
+	// stop and done stop it.
+	full chan struct{}
+	stop chan struct{}
+	done chan struct{}
 }
 
 // NewCloudWatchLogsHook creates the log group and stream if they don't already
@@ -59,11 +109,9 @@ func alreadyExists(err error) bool {
 	return errors.As(err, &e)
 }
 
-// accessDenied reports whether err is an IAM authorization failure, covering both
-// "AccessDenied" and "AccessDeniedException" codes.
+// accessDenied reports whether err is an IAM authorization failure.
 func accessDenied(err error) bool {
-	var apiErr smithy.APIError
-	return errors.As(err, &apiErr) && strings.Contains(apiErr.ErrorCode(), "AccessDenied")
+	return ClassifyError(err) == ErrorAccessDenied
 }
 
 // Levels returns the log levels the hook fires on.
@@ -78,10 +126,284 @@ func (h *CloudWatchLogsHook) Levels() []logrus.Level {
 	}
 }
 
+// StartBatching buffers entries rather than sending each as it is logged, and
+// sends them every interval, or sooner once the buffer holds half of what one
+// PutLogEvents call can take. The buffer holds at most one call's worth: if
+// CloudWatch falls that far behind, further entries are dropped and counted.
+// Entries at fatal level and above are sent straight away, since logrus exits
+// after them. Call Close when done to send what is left.
+func (h *CloudWatchLogsHook) StartBatching(interval time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.batching {
+		return
+	}
+	h.batching = true
+	h.full = make(chan struct{}, 1)
+	h.stop = make(chan struct{})
+	h.done = make(chan struct{})
+	go h.flushLoop(interval)
+}
+
+// flushLoop sends the buffered entries every interval until Close. It can't log
+// its failures through logrus, which would feed them back to the hook, so like
+// logrus with a failed hook it writes them to stderr.
+func (h *CloudWatchLogsHook) flushLoop(interval time.Duration) {
+	defer close(h.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		case <-h.full:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cloudWatchPutTimeout)
+		if err := h.Flush(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to send logs to CloudWatch: %v\n", err)
+		}
+		cancel()
+	}
+}
+
+// Flush sends the buffered entries, giving up when ctx is done. Without a
+// spool, those that fail to send are buffered again for the next flush. Without
+// batching there is nothing to send.
+func (h *CloudWatchLogsHook) Flush(ctx context.Context) error {
+	h.sendMu.Lock()
+	defer h.sendMu.Unlock()
+
+	h.mu.Lock()
+	events, dropped := h.pending, h.dropped
+	h.pending, h.pendingBytes, h.dropped = nil, 0, 0
+	h.mu.Unlock()
+
+	if dropped > 0 {
+		events = append(events, droppedEvent(dropped, "CloudWatch couldn't keep up"))
+	}
+	if dropped := h.takeRateDropped(); dropped > 0 {
+		events = append(events, droppedEvent(dropped, "over the rate limit"))
+	}
+	return h.send(ctx, events)
+}
+
+// EnableSpool keeps events that fail to send in the file at path, up to
+// maxBytes, and sends them ahead of later events once CloudWatch can be
+// reached, so a flaky network doesn't lose the lines logged during a drain.
+// Events left in the file by a previous run are sent on the next Fire or
+// Flush. Events CloudWatch no longer accepts, at 14 days old, are dropped, and
+// dropped events are counted in the stream. Call it before adding the hook to a
+// logger.
+func (h *CloudWatchLogsHook) EnableSpool(path string, maxBytes int64) error {
+	spool, err := newCloudWatchSpool(path, maxBytes)
+	if err != nil {
+		return err
+	}
+	h.sendMu.Lock()
+	defer h.sendMu.Unlock()
+	h.spool = spool
+	return nil
+}
+
+// send delivers events in order. With a spool, the events spooled by earlier
+// failures go first, and whatever can't be sent now is spooled for next time.
+// The caller holds sendMu when there is a spool.
+func (h *CloudWatchLogsHook) send(ctx context.Context, events []cwltypes.InputLogEvent) error {
+	// A spool that can't be read is left as it is, and new events are spooled
+	// after it, rather than risk sending its events twice.
+	var (
+		spoolErr error
+		expired  int
+	)
+	fresh := events
+	spooled := h.spool != nil && !h.spool.empty()
+	if spooled {
+		old, n, err := h.spool.load(time.Now())
+		if err != nil {
+			spooled, spoolErr = false, fmt.Errorf("read spool: %w", err)
+		} else {
+			events, expired = append(old, events...), n
+		}
+	}
+	// Entries logged concurrently can be buffered slightly out of order, which
+	// PutLogEvents rejects.
+	slices.SortStableFunc(events, func(a, b cwltypes.InputLogEvent) int {
+		return cmp.Compare(aws.ToInt64(a.Timestamp), aws.ToInt64(b.Timestamp))
+	})
+
+	var (
+		sent     int
+		rejected error
+	)
+	for _, batch := range batchEvents(events) {
+		err := h.put(ctx, batch)
+		if err != nil && !permanentPutError(err) {
+			if h.spool == nil {
+				if h.requeue(events[sent:]) {
+					return fmt.Errorf("%w (kept for the next flush)", err)
+				}
+				return err
+			}
+			// Sending again won't help an event CloudWatch refused, but it
+			// will help one that didn't arrive.
+			// Events expired in the spool are only counted once they have left
+			// it, so they aren't counted again on every failed send.
+			switch unsent := events[sent:]; {
+			case !spooled:
+				spoolErr = errors.Join(spoolErr, h.spool.append(unsent))
+			case sent == 0:
+				// The spool still holds everything it did, so only the new events
+				// need adding, not the whole spool rewriting.
+				spoolErr = h.spool.append(fresh)
+			default:
+				if spoolErr = h.spool.replace(unsent); spoolErr == nil {
+					h.spool.expired += expired
+				}
+			}
+			if spoolErr != nil {
+				return fmt.Errorf("%w (and spooling failed: %w)", err, spoolErr)
+			}
+			return fmt.Errorf("%w (spooled for later)", err)
+		}
+		if err != nil && rejected == nil {
+			rejected = err
+		}
+		sent += len(batch)
+	}
+	if spooled {
+		if spoolErr = h.spool.clear(); spoolErr == nil {
+			h.spool.expired += expired
+		}
+	}
+	// Report what the spool lost once it is caught up, so the report itself
+	// isn't spooled, and keep counting until the report is sent.
+	if h.spool != nil {
+		if report := h.spool.report(); len(report) > 0 {
+			if err := h.put(ctx, report); err == nil || permanentPutError(err) {
+				h.spool.expired, h.spool.dropped = 0, 0
+			}
+		}
+	}
+	return errors.Join(rejected, spoolErr)
+}
+
+// droppedEvent returns an event recording that count events were dropped.
+func droppedEvent(count int, reason string) cwltypes.InputLogEvent {
+	return cwltypes.InputLogEvent{
+		Message:   aws.String(fmt.Sprintf("Dropped %d log events, %s", count, reason)),
+		Timestamp: aws.Int64(time.Now().UnixMilli()),
+	}
+}
+
+// errRejected is CloudWatch accepting a call but refusing some of its events.
+var errRejected = errors.New("cloudwatch rejected log events (too old, too new, or expired)")
+
+// permanentPutError reports whether sending the same events again would fail
+// the same way.
+func permanentPutError(err error) bool {
+	var invalid *cwltypes.InvalidParameterException
+	return errors.Is(err, errRejected) || errors.As(err, &invalid)
+}
+
+// Close stops batching and sends what is left, giving up when ctx is done.
+// Entries logged afterwards are sent synchronously again.
+func (h *CloudWatchLogsHook) Close(ctx context.Context) error {
+	h.mu.Lock()
+	batching := h.batching
+	h.batching = false
+	h.mu.Unlock()
+	if batching {
+		close(h.stop)
+		select {
+		case <-h.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return h.Flush(ctx)
+}
+
+// enqueue buffers events for the flusher, reporting false if batching is off.
+func (h *CloudWatchLogsHook) enqueue(events ...cwltypes.InputLogEvent) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.batching {
+		return false
+	}
+	h.buffer(events)
+	if len(h.pending) >= maxBatchEvents/2 || h.pendingBytes >= maxBatchBytes/2 {
+		select {
+		case h.full <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// requeue puts events that failed to send back ahead of those buffered since,
+// to be sent again with the next flush, reporting false if batching was never
+// started. A flush that fails while Close stops the flusher still requeues, so
+// Close's own flush tries its events again.
+func (h *CloudWatchLogsHook) requeue(events []cwltypes.InputLogEvent) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.full == nil {
+		return false
+	}
+	buffered := h.pending
+	h.pending, h.pendingBytes = nil, 0
+	h.buffer(events)
+	h.buffer(buffered)
+	return true
+}
+
+// buffer adds events to the buffer, dropping and counting those that don't fit.
+// The caller holds mu.
+func (h *CloudWatchLogsHook) buffer(events []cwltypes.InputLogEvent) {
+	for _, event := range events {
+		size := len(aws.ToString(event.Message)) + eventOverhead
+		if len(h.pending) >= maxBatchEvents || h.pendingBytes+size > maxBatchBytes {
+			h.dropped++
+			continue
+		}
+		h.pending = append(h.pending, event)
+		h.pendingBytes += size
+	}
+}
+
+// batchEvents splits events, in chronological order, into batches that
+// PutLogEvents accepts.
+func batchEvents(events []cwltypes.InputLogEvent) [][]cwltypes.InputLogEvent {
+	var (
+		batches [][]cwltypes.InputLogEvent
+		start   int
+		size    int
+	)
+	for i, event := range events {
+		eventSize := len(aws.ToString(event.Message)) + eventOverhead
+		span := time.Duration(aws.ToInt64(event.Timestamp)-aws.ToInt64(events[start].Timestamp)) * time.Millisecond
+		if i > start && (i-start >= maxBatchEvents || size+eventSize > maxBatchBytes || span > maxBatchSpan) {
+			batches = append(batches, events[start:i])
+			start, size = i, 0
+		}
+		size += eventSize
+	}
+	if start < len(events) {
+		batches = append(batches, events[start:])
+	}
+	return batches
+}
+
 // Fire ships the formatted entry to CloudWatch Logs on a background context with
 // a timeout, so a line is still delivered during shutdown without an unreachable
-// endpoint wedging the logging goroutine.
+// endpoint wedging the logging goroutine. When batching, it buffers the entry
+// instead. A line too long for one event is split or truncated, and one over
+// the rate limit is dropped.
 func (h *CloudWatchLogsHook) Fire(entry *logrus.Entry) error {
+	if !h.allow(entry.Level, time.Now()) {
+		return nil
+	}
 	line, err := entry.String()
 	if err != nil {
 		return err
@@ -94,18 +416,46 @@ func (h *CloudWatchLogsHook) Fire(entry *logrus.Entry) error {
 		ts = time.Now()
 	}
 
-	// No lock needed: Fire reads only immutable fields and PutLogEvents accepts
-	// parallel calls on the same stream.
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	var events []cwltypes.InputLogEvent
+	if dropped := h.takeRateDropped(); dropped > 0 {
+		// Stamp the count with the entry's time, so it comes first.
+		report := droppedEvent(dropped, "over the rate limit")
+		report.Timestamp = aws.Int64(ts.UnixMilli())
+		events = append(events, report)
+	}
+	h.limitMu.Lock()
+	maxLine := h.maxLineBytes
+	h.limitMu.Unlock()
+	for _, part := range splitMessage(line, maxLine) {
+		events = append(events, cwltypes.InputLogEvent{
+			Message:   aws.String(part),
+			Timestamp: aws.Int64(ts.UnixMilli()),
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cloudWatchPutTimeout)
 	defer cancel()
+	if h.enqueue(events...) {
+		if entry.Level <= logrus.FatalLevel {
+			return h.Flush(ctx)
+		}
+		return nil
+	}
+	// PutLogEvents accepts parallel calls on the same stream, so synchronous
+	// sends need no lock, unless they share a spool.
+	if h.spool != nil {
+		h.sendMu.Lock()
+		defer h.sendMu.Unlock()
+	}
+	return h.send(ctx, events)
+}
 
+// put sends events to the stream in one call.
+func (h *CloudWatchLogsHook) put(ctx context.Context, events []cwltypes.InputLogEvent) error {
 	out, err := h.client.PutLogEvents(ctx, &cloudwatchlogs.PutLogEventsInput{
 		LogGroupName:  aws.String(h.groupName),
 		LogStreamName: aws.String(h.streamName),
-		LogEvents: []cwltypes.InputLogEvent{{
-			Message:   aws.String(line),
-			Timestamp: aws.Int64(ts.UnixMilli()),
-		}},
+		LogEvents:     events,
 	})
 	if err != nil {
 		return err
@@ -113,7 +463,7 @@ func (h *CloudWatchLogsHook) Fire(entry *logrus.Entry) error {
 	// A 200 with RejectedLogEventsInfo means the line was dropped (too old, too
 	// new, or expired). Surface it rather than reporting success.
 	if out.RejectedLogEventsInfo != nil {
-		return errors.New("cloudwatch rejected the log event (too old, too new, or expired)")
+		return errRejected
 	}
 	return nil
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
@@ -238,3 +239,199 @@ func TestCloudWatchLogsHookFireZeroTime(t *testing.T) {
 		t.Errorf("timestamp = %d, want > 0 (zero entry.Time should fall back to now)", got)
 	}
 }
+
+// puts returns a copy of the PutLogEvents calls made so far.
+func (c *fakeCloudWatchLogsClient) puts() []*cloudwatchlogs.PutLogEventsInput {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.putInputs)
+}
+
+func entryAt(level logrus.Level, message string, at time.Time) *logrus.Entry {
+	entry := logrus.NewEntry(logrus.New())
+	entry.Level, entry.Message, entry.Time = level, message, at
+	return entry
+}
+
+// With batching, entries are held until flushed, then sent in one call in the
+// order they were logged; after Close, entries are sent synchronously again.
+func TestCloudWatchLogsHookBatching(t *testing.T) {
+	client := &fakeCloudWatchLogsClient{}
+	hook, err := NewCloudWatchLogsHook(context.Background(), client, "group", "stream")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hook.StartBatching(time.Hour)
+
+	now := time.Now()
+	for _, entry := range []*logrus.Entry{
+		entryAt(logrus.InfoLevel, "second", now.Add(time.Millisecond)),
+		entryAt(logrus.InfoLevel, "first", now),
+		entryAt(logrus.DebugLevel, "third", now.Add(2*time.Millisecond)),
+	} {
+		if err := hook.Fire(entry); err != nil {
+			t.Fatalf("Fire() error = %v", err)
+		}
+	}
+	if got := len(client.puts()); got != 0 {
+		t.Fatalf("PutLogEvents calls before flush = %d, want 0", got)
+	}
+
+	if err := hook.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	puts := client.puts()
+	if len(puts) != 1 || len(puts[0].LogEvents) != 3 {
+		t.Fatalf("PutLogEvents calls = %v, want one with 3 events", puts)
+	}
+	for i, want := range []string{"first", "second", "third"} {
+		if got := aws.ToString(puts[0].LogEvents[i].Message); !strings.Contains(got, want) {
+			t.Errorf("event %d = %q, want %q", i, got, want)
+		}
+	}
+
+	if err := hook.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := hook.Fire(entryAt(logrus.InfoLevel, "after close", time.Now())); err != nil {
+		t.Fatalf("Fire() error = %v", err)
+	}
+	if got := len(client.puts()); got != 2 {
+		t.Errorf("PutLogEvents calls = %d, want the entry after Close sent straight away", got)
+	}
+}
+
+// logrus exits after a fatal entry, so it can't wait for the next batch.
+func TestCloudWatchLogsHookBatchingSendsFatal(t *testing.T) {
+	client := &fakeCloudWatchLogsClient{}
+	hook, err := NewCloudWatchLogsHook(context.Background(), client, "group", "stream")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hook.StartBatching(time.Hour)
+	defer func() { _ = hook.Close(context.Background()) }()
+
+	_ = hook.Fire(entryAt(logrus.InfoLevel, "before", time.Now()))
+	if err := hook.Fire(entryAt(logrus.FatalLevel, "fatal", time.Now())); err != nil {
+		t.Fatalf("Fire() error = %v", err)
+	}
+	puts := client.puts()
+	if len(puts) != 1 || len(puts[0].LogEvents) != 2 {
+		t.Fatalf("PutLogEvents calls = %v, want one with both events", puts)
+	}
+}
+
+func TestCloudWatchLogsHookBatchingInterval(t *testing.T) {
+	client := &fakeCloudWatchLogsClient{}
+	hook, err := NewCloudWatchLogsHook(context.Background(), client, "group", "stream")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hook.StartBatching(10 * time.Millisecond)
+	defer func() { _ = hook.Close(context.Background()) }()
+
+	_ = hook.Fire(entryAt(logrus.InfoLevel, "batched", time.Now()))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(client.puts()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := len(client.puts()); got != 1 {
+		t.Errorf("PutLogEvents calls = %d, want 1 after the interval", got)
+	}
+}
+
+// Without a spool, events that fail to send stay buffered, ahead of those
+// logged since, for the next flush.
+func TestCloudWatchLogsHookBatchingRequeues(t *testing.T) {
+	client := &fakeCloudWatchLogsClient{putErr: errors.New("network down")}
+	hook, err := NewCloudWatchLogsHook(context.Background(), client, "group", "stream")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hook.StartBatching(time.Hour)
+	defer func() { _ = hook.Close(context.Background()) }()
+
+	now := time.Now()
+	_ = hook.Fire(entryAt(logrus.InfoLevel, "first", now))
+	if err := hook.Flush(context.Background()); err == nil {
+		t.Fatal("Flush() succeeded, want the put error")
+	}
+	_ = hook.Fire(entryAt(logrus.InfoLevel, "second", now.Add(time.Millisecond)))
+
+	client.mu.Lock()
+	client.putErr = nil
+	client.mu.Unlock()
+	if err := hook.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	puts := client.puts()
+	if len(puts) != 2 || len(puts[1].LogEvents) != 2 {
+		t.Fatalf("PutLogEvents calls = %v, want the retry to send both events", puts)
+	}
+	for i, want := range []string{"first", "second"} {
+		if got := aws.ToString(puts[1].LogEvents[i].Message); !strings.Contains(got, want) {
+			t.Errorf("event %d = %q, want %q", i, got, want)
+		}
+	}
+}
+
+// The buffer holds one call's worth of events; beyond that events are dropped,
+// and the drop is reported in the stream.
+func TestCloudWatchLogsHookBatchingDrops(t *testing.T) {
+	client := &fakeCloudWatchLogsClient{}
+	hook := &CloudWatchLogsHook{client: client, batching: true, full: make(chan struct{}, 1)}
+
+	for i := 0; i < maxBatchEvents+5; i++ {
+		if !hook.enqueue(cwltypes.InputLogEvent{Message: aws.String("line"), Timestamp: aws.Int64(1)}) {
+			t.Fatal("enqueue reported batching off")
+		}
+	}
+	if hook.dropped != 5 {
+		t.Errorf("dropped = %d, want 5", hook.dropped)
+	}
+	if len(hook.full) != 1 {
+		t.Error("expected the flusher to be woken once the buffer filled")
+	}
+	if err := hook.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	var events []cwltypes.InputLogEvent
+	for _, put := range client.puts() {
+		events = append(events, put.LogEvents...)
+	}
+	if len(events) != maxBatchEvents+1 || !strings.Contains(aws.ToString(events[len(events)-1].Message), "Dropped 5 log events") {
+		t.Errorf("sent %d events, want %d ending with the drop count", len(events), maxBatchEvents+1)
+	}
+}
+
+func TestBatchEvents(t *testing.T) {
+	event := func(size int) cwltypes.InputLogEvent {
+		return cwltypes.InputLogEvent{Message: aws.String(strings.Repeat("x", size))}
+	}
+	tests := []struct {
+		name   string
+		events []cwltypes.InputLogEvent
+		want   []int
+	}{
+		{name: "none", want: nil},
+		{name: "one batch", events: slices.Repeat([]cwltypes.InputLogEvent{event(10)}, 3), want: []int{3}},
+		{name: "by count", events: slices.Repeat([]cwltypes.InputLogEvent{event(1)}, maxBatchEvents+1), want: []int{maxBatchEvents, 1}},
+		{name: "by size", events: slices.Repeat([]cwltypes.InputLogEvent{event(250 * 1024)}, 5), want: []int{4, 1}},
+		{name: "by span", events: []cwltypes.InputLogEvent{
+			{Message: aws.String("a"), Timestamp: aws.Int64(0)},
+			{Message: aws.String("b"), Timestamp: aws.Int64(maxBatchSpan.Milliseconds())},
+			{Message: aws.String("c"), Timestamp: aws.Int64(maxBatchSpan.Milliseconds() + 1)},
+		}, want: []int{2, 1}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []int
+			for _, batch := range batchEvents(tc.events) {
+				got = append(got, len(batch))
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("batch sizes = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package lifecycled
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxEventBytes is the longest message CloudWatch accepts in one event,
+	// which it counts along with eventOverhead against a 256 KB limit.
+	maxEventBytes = 256*1024 - eventOverhead
+
+	// chunkPrefixBytes is the room kept in each part of a split line for its
+	// number.
+	chunkPrefixBytes = 32
+)
+
+// LimitLineSize truncates lines longer than maxBytes, ending them with a marker
+// saying how much was cut. Shorter lines that are still too long for one
+// CloudWatch event are split into numbered parts instead. Zero means no limit.
+// Call it before adding the hook to a logger.
+func (h *CloudWatchLogsHook) LimitLineSize(maxBytes int) {
+	h.limitMu.Lock()
+	defer h.limitMu.Unlock()
+	h.maxLineBytes = maxBytes
+}
+
+// LimitRate sends at most lines entries in each window and drops the rest, so a
+// runaway caller can't flood the stream or hold up the daemon on sends. The
+// number dropped is logged to the stream with the next entry sent. Entries at
+// fatal level and above are always sent. Call it before adding the hook to a
+// logger.
+func (h *CloudWatchLogsHook) LimitRate(lines int, window time.Duration) {
+	h.limitMu.Lock()
+	defer h.limitMu.Unlock()
+	h.rateLines, h.rateWindow = lines, window
+}
+
+// allow reports whether an entry at level logged at now may be sent, counting
+// it against the rate limit.
+func (h *CloudWatchLogsHook) allow(level logrus.Level, now time.Time) bool {
+	h.limitMu.Lock()
+	defer h.limitMu.Unlock()
+	if h.rateLines <= 0 {
+		return true
+	}
+	if now.Sub(h.windowStart) >= h.rateWindow {
+		h.windowStart, h.windowLines = now, 0
+	}
+	if h.windowLines >= h.rateLines && level > logrus.FatalLevel {
+		h.rateDropped++
+		return false
+	}
+	h.windowLines++
+	return true
+}
+
+// takeRateDropped returns how many entries the rate limit dropped since it was
+// last called.
+func (h *CloudWatchLogsHook) takeRateDropped() int {
+	h.limitMu.Lock()
+	defer h.limitMu.Unlock()
+	dropped := h.rateDropped
+	h.rateDropped = 0
+	return dropped
+}
+
+// splitMessage truncates line to maxLine bytes, unless maxLine is zero, and
+// splits what is left into parts that each fit in one event, numbered like
+// "[1/3] " when there is more than one.
+func splitMessage(line string, maxLine int) []string {
+	if maxLine > 0 && len(line) > maxLine {
+		cut := runeCut(line, maxLine)
+		line = fmt.Sprintf("%s... [truncated %d bytes]", line[:cut], len(line)-cut)
+	}
+	if len(line) <= maxEventBytes {
+		return []string{line}
+	}
+	var parts []string
+	for len(line) > 0 {
+		cut := len(line)
+		if cut > maxEventBytes-chunkPrefixBytes {
+			cut = runeCut(line, maxEventBytes-chunkPrefixBytes)
+		}
+		parts = append(parts, line[:cut])
+		line = line[cut:]
+	}
+	for i, part := range parts {
+		parts[i] = fmt.Sprintf("[%d/%d] %s", i+1, len(parts), part)
+	}
+	return parts
+}
+
+// runeCut returns the largest index no greater than n that doesn't cut line in
+// the middle of a UTF-8 sequence, or n itself if there is none.
+func runeCut(line string, n int) int {
+	for i := n; i > n-utf8.UTFMax && i > 0; i-- {
+		if utf8.RuneStart(line[i]) {
+			return i
+		}
+	}
+	return n
+}
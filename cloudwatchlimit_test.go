@@ -0,0 +1,111 @@
+package lifecycled
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSplitMessage(t *testing.T) {
+	long := strings.Repeat("x", 2*maxEventBytes)
+
+	t.Run("fits in one event", func(t *testing.T) {
+		if got := splitMessage("short", 0); len(got) != 1 || got[0] != "short" {
+			t.Errorf("splitMessage = %q, want it unchanged", got)
+		}
+	})
+
+	t.Run("split into numbered parts", func(t *testing.T) {
+		got := splitMessage(long, 0)
+		if len(got) != 3 {
+			t.Fatalf("split into %d parts, want 3", len(got))
+		}
+		var joined string
+		for i, part := range got {
+			if len(part) > maxEventBytes {
+				t.Errorf("part %d is %d bytes, over the %d an event takes", i, len(part), maxEventBytes)
+			}
+			prefix := fmt.Sprintf("[%d/3] ", i+1)
+			if !strings.HasPrefix(part, prefix) {
+				t.Errorf("part %d = %.20q, want it to start %q", i, part, prefix)
+			}
+			joined += strings.TrimPrefix(part, prefix)
+		}
+		if joined != long {
+			t.Error("parts don't add up to the line")
+		}
+	})
+
+	t.Run("truncated with a marker", func(t *testing.T) {
+		got := splitMessage(long, 1000)
+		if len(got) != 1 || !strings.HasSuffix(got[0], "... [truncated 523236 bytes]") || !strings.HasPrefix(got[0], strings.Repeat("x", 1000)+"...") {
+			t.Errorf("splitMessage = %.40q..., want 1000 bytes and the truncation marker", got)
+		}
+	})
+
+	t.Run("cuts between runes", func(t *testing.T) {
+		got := splitMessage(strings.Repeat("é", 10), 5)
+		if len(got) != 1 || !utf8.ValidString(got[0]) || !strings.HasPrefix(got[0], "éé...") {
+			t.Errorf("splitMessage = %q, want whole runes kept", got)
+		}
+	})
+}
+
+// Entries over the rate limit are dropped, apart from fatal ones, and the
+// number dropped is sent with the next entry that isn't.
+func TestCloudWatchLogsHookLimitRate(t *testing.T) {
+	client := &fakeCloudWatchLogsClient{}
+	hook, err := NewCloudWatchLogsHook(context.Background(), client, "group", "stream")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hook.LimitRate(2, 50*time.Millisecond)
+	fire := func(level logrus.Level, count int) {
+		for i := 0; i < count; i++ {
+			if err := hook.Fire(entryAt(level, "line", time.Now())); err != nil {
+				t.Fatalf("Fire() error = %v", err)
+			}
+		}
+	}
+
+	fire(logrus.InfoLevel, 4)
+	if got := sentMessages(client); len(got) != 2 {
+		t.Fatalf("sent %d events, want 2", len(got))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	fire(logrus.InfoLevel, 3)
+	fire(logrus.FatalLevel, 1)
+	got := sentMessages(client)[2:]
+	want := []string{"Dropped 2 log events, over the rate limit", "level=info", "level=info", "Dropped 1 log events, over the rate limit", "level=fatal"}
+	if len(got) != len(want) {
+		t.Fatalf("sent %q in the next window, want %q", got, want)
+	}
+	for i := range want {
+		if !strings.Contains(got[i], want[i]) {
+			t.Errorf("event %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+// A line too long for one event is sent as its parts, in order.
+func TestCloudWatchLogsHookSplitsLongLines(t *testing.T) {
+	client := &fakeCloudWatchLogsClient{}
+	hook, err := NewCloudWatchLogsHook(context.Background(), client, "group", "stream")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := hook.Fire(entryAt(logrus.ErrorLevel, strings.Repeat("x", maxEventBytes), time.Now())); err != nil {
+		t.Fatalf("Fire() error = %v", err)
+	}
+	got := sentMessages(client)
+	if len(got) != 2 || !strings.HasPrefix(got[0], "[1/2] ") || !strings.HasPrefix(got[1], "[2/2] ") {
+		t.Errorf("sent %d events, want the line in two numbered parts", len(got))
+	}
+}
@@ -0,0 +1,200 @@
+package lifecycled
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cwltypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+// cloudWatchRetention is how old an event CloudWatch Logs still accepts.
+const cloudWatchRetention = 14 * 24 * time.Hour
+
+// spooledEvent is a log event on disk, one JSON object per line.
+type spooledEvent struct {
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+// cloudWatchSpool keeps log events that couldn't be sent in a file, oldest
+// first, so they can be sent later, even after a restart. The file is kept
+// under maxBytes by refusing events that don't fit; those, and events that
+// have aged past what CloudWatch accepts, are counted so the loss can be
+// reported. The hook serializes calls, so the spool has no lock of its own.
+type cloudWatchSpool struct {
+	path     string
+	maxBytes int64
+	size     int64
+
+	// dropped and expired count the events that didn't fit and that were too
+	// old to send, since last reported.
+	dropped int
+	expired int
+}
+
+// newCloudWatchSpool returns a spool in the file at path, which may already
+// hold events from a previous run.
+func newCloudWatchSpool(path string, maxBytes int64) (*cloudWatchSpool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	s := &cloudWatchSpool{path: path, maxBytes: maxBytes}
+	info, err := os.Stat(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		s.size = info.Size()
+	}
+	return s, nil
+}
+
+// empty reports whether the spool holds no events.
+func (s *cloudWatchSpool) empty() bool {
+	return s.size == 0
+}
+
+// load returns the spooled events that CloudWatch will still accept, and how
+// many it won't, which stay in the file until it is replaced or cleared. A line
+// that doesn't decode, such as one cut short by a crash, is skipped.
+func (s *cloudWatchSpool) load(now time.Time) ([]cwltypes.InputLogEvent, int, error) {
+	if s.empty() {
+		return nil, 0, nil
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			s.size = 0
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	oldest := now.Add(-cloudWatchRetention).UnixMilli()
+	var (
+		events  []cwltypes.InputLogEvent
+		expired int
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 8*maxBatchBytes)
+	for scanner.Scan() {
+		var event spooledEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		if event.Timestamp < oldest {
+			expired++
+			continue
+		}
+		events = append(events, cwltypes.InputLogEvent{
+			Message:   aws.String(event.Message),
+			Timestamp: aws.Int64(event.Timestamp),
+		})
+	}
+	return events, expired, scanner.Err()
+}
+
+// encodeSpooled returns events as spool lines, as many as fit in room bytes,
+// and how many were left out.
+func encodeSpooled(events []cwltypes.InputLogEvent, room int64) ([]byte, int) {
+	var (
+		lines   []byte
+		dropped int
+	)
+	for i, event := range events {
+		line, err := json.Marshal(spooledEvent{Timestamp: aws.ToInt64(event.Timestamp), Message: aws.ToString(event.Message)})
+		if err != nil {
+			dropped++
+			continue
+		}
+		if int64(len(lines)+len(line)+1) > room {
+			return lines, dropped + len(events) - i
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	return lines, dropped
+}
+
+// append adds events to the end of the spool, as many as fit.
+func (s *cloudWatchSpool) append(events []cwltypes.InputLogEvent) error {
+	lines, dropped := encodeSpooled(events, s.maxBytes-s.size)
+	s.dropped += dropped
+	if len(lines) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		s.dropped += len(events) - dropped
+		return err
+	}
+	n, err := f.Write(lines)
+	s.size += int64(n)
+	if err != nil {
+		s.dropped += len(events) - dropped
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// report returns events recording what the spool has lost, if anything.
+func (s *cloudWatchSpool) report() []cwltypes.InputLogEvent {
+	var events []cwltypes.InputLogEvent
+	if s.expired > 0 {
+		events = append(events, droppedEvent(s.expired, "older than CloudWatch accepts"))
+	}
+	if s.dropped > 0 {
+		events = append(events, droppedEvent(s.dropped, "the spool was full"))
+	}
+	return events
+}
+
+// replace swaps the spool's contents for events, once some of what was spooled
+// has been sent. The new file is written alongside and renamed into place, so a
+// crash part way leaves the old spool rather than a truncated one.
+func (s *cloudWatchSpool) replace(events []cwltypes.InputLogEvent) error {
+	lines, dropped := encodeSpooled(events, s.maxBytes)
+	if len(lines) == 0 {
+		s.dropped += dropped
+		return s.clear()
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	if _, err := f.Write(lines); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return err
+	}
+	s.size = int64(len(lines))
+	s.dropped += dropped
+	return nil
+}
+
+// clear empties the spool.
+func (s *cloudWatchSpool) clear() error {
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	s.size = 0
+	return nil
+}
@@ -0,0 +1,242 @@
+package lifecycled
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwltypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/sirupsen/logrus"
+)
+
+// spooledHook returns a hook that spools to the file at path.
+func spooledHook(t *testing.T, client *fakeCloudWatchLogsClient, path string, maxBytes int64) *CloudWatchLogsHook {
+	t.Helper()
+	hook, err := NewCloudWatchLogsHook(context.Background(), client, "group", "stream")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := hook.EnableSpool(path, maxBytes); err != nil {
+		t.Fatalf("EnableSpool() error = %v", err)
+	}
+	return hook
+}
+
+// sentMessages returns the messages of every event sent so far, in order.
+func sentMessages(client *fakeCloudWatchLogsClient) []string {
+	var messages []string
+	for _, put := range client.puts() {
+		for _, event := range put.LogEvents {
+			messages = append(messages, aws.ToString(event.Message))
+		}
+	}
+	return messages
+}
+
+// Events that fail to send are spooled, then sent ahead of the next event once
+// CloudWatch can be reached.
+func TestCloudWatchLogsHookSpoolsFailedSends(t *testing.T) {
+	client := &fakeCloudWatchLogsClient{putErr: errors.New("network unreachable")}
+	path := filepath.Join(t.TempDir(), "spool", "events")
+	hook := spooledHook(t, client, path, 1<<20)
+
+	now := time.Now()
+	for i, message := range []string{"first", "second"} {
+		if err := hook.Fire(entryAt(logrus.InfoLevel, message, now.Add(time.Duration(i)*time.Millisecond))); err == nil {
+			t.Fatal("Fire() returned no error for a failed send")
+		}
+	}
+	if hook.spool.empty() {
+		t.Fatal("expected the failed events to be spooled")
+	}
+
+	client.putErr = nil
+	client.putInputs = nil
+	if err := hook.Fire(entryAt(logrus.InfoLevel, "third", now.Add(2*time.Millisecond))); err != nil {
+		t.Fatalf("Fire() error = %v", err)
+	}
+	got := sentMessages(client)
+	if len(got) != 3 {
+		t.Fatalf("sent %q, want the two spooled events and the new one", got)
+	}
+	for i, want := range []string{"first", "second", "third"} {
+		if !strings.Contains(got[i], want) {
+			t.Errorf("event %d = %q, want %q", i, got[i], want)
+		}
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the spool to be removed once sent, got %v", err)
+	}
+}
+
+// A spool left by a previous run is sent by the next one, and events too old
+// for CloudWatch are counted instead.
+func TestCloudWatchLogsHookSpoolFromPreviousRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events")
+	old := time.Now().Add(-cloudWatchRetention - time.Hour).UnixMilli()
+	recent := time.Now().Add(-time.Hour).UnixMilli()
+	contents := fmt.Sprintf("{\"timestamp\":%d,\"message\":\"expired\"}\n{not json\n{\"timestamp\":%d,\"message\":\"recent\"}\n", old, recent)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &fakeCloudWatchLogsClient{}
+	hook := spooledHook(t, client, path, 1<<20)
+	if err := hook.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	got := sentMessages(client)
+	if len(got) != 2 || got[0] != "recent" || !strings.Contains(got[1], "Dropped 1 log events, older than CloudWatch accepts") {
+		t.Errorf("sent %q, want the recent event and the expired count", got)
+	}
+}
+
+// Events beyond the spool's size are dropped, and counted once sending works.
+func TestCloudWatchLogsHookSpoolFull(t *testing.T) {
+	client := &fakeCloudWatchLogsClient{putErr: errors.New("network unreachable")}
+	hook := spooledHook(t, client, filepath.Join(t.TempDir(), "events"), 100)
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		_ = hook.Fire(entryAt(logrus.InfoLevel, "line", now.Add(time.Duration(i)*time.Millisecond)))
+	}
+	if hook.spool.size > 100 || hook.spool.dropped == 0 {
+		t.Fatalf("spool holds %d bytes with %d dropped, want at most 100 bytes and some dropped", hook.spool.size, hook.spool.dropped)
+	}
+	dropped := hook.spool.dropped
+
+	client.putErr = nil
+	if err := hook.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	got := sentMessages(client)
+	if want := fmt.Sprintf("Dropped %d log events, the spool was full", dropped); len(got) == 0 || got[len(got)-1] != want {
+		t.Errorf("sent %q, want it to end with %q", got, want)
+	}
+	if hook.spool.dropped != 0 {
+		t.Errorf("dropped = %d after reporting, want 0", hook.spool.dropped)
+	}
+}
+
+// Events CloudWatch refused would be refused again, so they aren't spooled.
+func TestCloudWatchLogsHookSpoolSkipsPermanentErrors(t *testing.T) {
+	for _, putErr := range []error{
+		errRejected,
+		&cwltypes.InvalidParameterException{Message: aws.String("bad event")},
+	} {
+		t.Run(putErr.Error(), func(t *testing.T) {
+			client := &fakeCloudWatchLogsClient{putErr: putErr}
+			hook := spooledHook(t, client, filepath.Join(t.TempDir(), "events"), 1<<20)
+
+			if err := hook.Fire(entryAt(logrus.InfoLevel, "refused", time.Now())); !errors.Is(err, putErr) {
+				t.Errorf("Fire() error = %v, want %v", err, putErr)
+			}
+			if !hook.spool.empty() {
+				t.Error("expected a refused event not to be spooled")
+			}
+		})
+	}
+}
+
+// A send that fails outright leaves the spool as it was, with the new events
+// added, and counts its expired events only once they are finally dropped.
+func TestCloudWatchLogsHookSpoolAppendsWhenNothingSent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events")
+	old := time.Now().Add(-cloudWatchRetention - time.Hour).UnixMilli()
+	recent := time.Now().Add(-time.Hour).UnixMilli()
+	contents := fmt.Sprintf("{\"timestamp\":%d,\"message\":\"expired\"}\n{\"timestamp\":%d,\"message\":\"recent\"}\n", old, recent)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &fakeCloudWatchLogsClient{putErr: errors.New("network unreachable")}
+	hook := spooledHook(t, client, path, 1<<20)
+	for i := 0; i < 2; i++ {
+		if err := hook.Fire(entryAt(logrus.InfoLevel, fmt.Sprintf("new %d", i), time.Now())); err == nil {
+			t.Fatal("Fire() returned no error for a failed send")
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), contents) || strings.Count(string(b), "\n") != 4 {
+		t.Errorf("spool = %q, want the original lines followed by the two new events", b)
+	}
+	if hook.spool.expired != 0 {
+		t.Errorf("expired = %d while the event is still spooled, want 0", hook.spool.expired)
+	}
+
+	client.putErr = nil
+	if err := hook.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	got := sentMessages(client)
+	if want := "Dropped 1 log events, older than CloudWatch accepts"; len(got) == 0 || got[len(got)-1] != want {
+		t.Errorf("sent %q, want it to end with %q", got, want)
+	}
+}
+
+// failingPutClient fails every PutLogEvents call after the first ok ones.
+type failingPutClient struct {
+	*fakeCloudWatchLogsClient
+	ok int
+}
+
+func (c *failingPutClient) PutLogEvents(ctx context.Context, in *cloudwatchlogs.PutLogEventsInput, opts ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	if len(c.puts()) >= c.ok {
+		return nil, errors.New("network unreachable")
+	}
+	return c.fakeCloudWatchLogsClient.PutLogEvents(ctx, in, opts...)
+}
+
+// Once part of the spool has been sent, the rest replaces it, written to a new
+// file that is renamed into place.
+func TestCloudWatchLogsHookSpoolReplacesAfterPartialSend(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events")
+	// More than a day apart, so they go in separate calls.
+	first := time.Now().Add(-48 * time.Hour).UnixMilli()
+	second := time.Now().Add(-time.Hour).UnixMilli()
+	contents := fmt.Sprintf("{\"timestamp\":%d,\"message\":\"first\"}\n{\"timestamp\":%d,\"message\":\"second\"}\n", first, second)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &failingPutClient{fakeCloudWatchLogsClient: &fakeCloudWatchLogsClient{}, ok: 1}
+	hook, err := NewCloudWatchLogsHook(context.Background(), client, "group", "stream")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := hook.EnableSpool(path, 1<<20); err != nil {
+		t.Fatalf("EnableSpool() error = %v", err)
+	}
+	if err := hook.Flush(context.Background()); err == nil {
+		t.Fatal("Flush() returned no error for a failed send")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("{\"timestamp\":%d,\"message\":\"second\"}\n", second); string(b) != want {
+		t.Errorf("spool = %q, want only the unsent event %q", b, want)
+	}
+	if hook.spool.size != int64(len(b)) {
+		t.Errorf("spool size = %d, want %d", hook.spool.size, len(b))
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("spool directory holds %d files, want no temporary file left", len(entries))
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"os"
 	"os/signal"
@@ -12,7 +13,9 @@ import (
 	"github.com/alecthomas/kingpin"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/buildkite/lifecycled"
 
 	"github.com/sirupsen/logrus"
@@ -32,15 +35,45 @@ func main() {
 	var (
 		instanceID                   string
 		snsTopic                     string
+		snsQueuePerTopic             bool
+		assumeRoleARN                string
+		snsRawDelivery               bool
+		snsVerifySignatures          bool
+		snsCertBundle                string
+		snsCertHosts                 string
+		sqsQueueURL                  string
+		autoscalingDiscovery         bool
+		queueNameTemplate            string
+		queuePrefix                  string
+		sqsManagedSSE                bool
+		sqsKMSKeyID                  string
+		sqsMessageRetention          time.Duration
+		sqsPolicyTopics              string
+		eventBridgeQueueURL          string
+		eventBridgeRebalance         bool
 		disableSpotListener          bool
 		handler                      *os.File
 		jsonLogging                  bool
 		debugLogging                 bool
 		cloudwatchGroup              string
 		cloudwatchStream             string
+		cloudwatchBatchInterval      time.Duration
+		cloudwatchFlushTimeout       time.Duration
+		cloudwatchSpoolFile          string
+		cloudwatchRateLimit          int
 		tags                         string
+		copyInstanceTags             string
 		spotListenerInterval         time.Duration
 		autoscalingHeartbeatInterval time.Duration
+		autoscalingHookWindow        time.Duration
+		setupJitter                  time.Duration
+		setupTimeout                 time.Duration
+		autoscalingPolling           bool
+		autoscalingPollingInterval   time.Duration
+		autoscalingMetadata          bool
+		autoscalingMetadataInterval  time.Duration
+		autoscalingHookName          string
+		stateDir                     string
 	)
 
 	app.Flag("instance-id", "The instance id to listen for events for").
@@ -49,9 +82,63 @@ func main() {
 	app.Flag("tags", "Comma separated list of tags to add to SQS queues").
 		StringVar(&tags)
 
-	app.Flag("sns-topic", "The SNS topic that receives events").
+	app.Flag("copy-instance-tags", "Comma separated list of instance tags to copy to SQS queues, each optionally renamed with =KEY").
+		StringVar(&copyInstanceTags)
+
+	app.Flag("sns-topic", "The SNS topic that receives events, or a comma separated list of them").
 		StringVar(&snsTopic)
 
+	app.Flag("sns-queue-per-topic", "With several SNS topics, subscribe a queue to each rather than one queue to all of them").
+		BoolVar(&snsQueuePerTopic)
+
+	app.Flag("assume-role-arn", "A role to assume for SNS and autoscaling calls, such as one in the account that owns the SNS topic").
+		StringVar(&assumeRoleARN)
+
+	app.Flag("sns-raw-delivery", "Subscribe the queue with raw message delivery, so messages aren't wrapped in SNS envelopes").
+		BoolVar(&snsRawDelivery)
+
+	app.Flag("sns-verify-signatures", "Reject SNS messages whose signature can't be verified").
+		BoolVar(&snsVerifySignatures)
+
+	app.Flag("sns-cert-bundle", "PEM bundle of pinned SNS signing certificates, used instead of fetching them").
+		StringVar(&snsCertBundle)
+
+	app.Flag("sns-cert-hosts", "Comma separated list of hosts SNS signing certificates may be fetched from, defaults to SNS's own").
+		StringVar(&snsCertHosts)
+
+	app.Flag("sqs-queue-url", "An existing SQS queue, shared or not, that is subscribed to the SNS topic; it is used instead of creating a queue for this instance").
+		StringVar(&sqsQueueURL)
+
+	app.Flag("autoscaling-discovery", "Without an SNS topic or SQS queue, listen to the notification target of the group's termination lifecycle hooks").
+		BoolVar(&autoscalingDiscovery)
+
+	app.Flag("queue-name-template", "Template for the queue's name, with the placeholders {prefix}, {instance_id} and {asg}").
+		Default(lifecycled.DefaultQueueNameTemplate).
+		StringVar(&queueNameTemplate)
+
+	app.Flag("queue-prefix", "What {prefix} stands for in the queue name template").
+		Default(lifecycled.DefaultQueuePrefix).
+		StringVar(&queuePrefix)
+
+	app.Flag("sqs-managed-sse", "Encrypt the queue with SQS managed keys").
+		BoolVar(&sqsManagedSSE)
+
+	app.Flag("sqs-kms-key-id", "Encrypt the queue with this KMS key, which the SNS topic must be allowed to use").
+		StringVar(&sqsKMSKeyID)
+
+	app.Flag("sqs-message-retention", "How long the queue keeps messages, between 1m and 336h, defaults to SQS's own").
+		Default("0s").
+		DurationVar(&sqsMessageRetention)
+
+	app.Flag("sqs-policy-topics", "Comma separated list of further SNS topic ARNs the queue policy allows to send to the queue").
+		StringVar(&sqsPolicyTopics)
+
+	app.Flag("eventbridge-queue-url", "An existing SQS queue, of this instance's or shared, that receives EC2 and autoscaling events from EventBridge").
+		StringVar(&eventBridgeQueueURL)
+
+	app.Flag("eventbridge-rebalance", "Run the handler for a rebalance recommendation from EventBridge, after which lifecycled exits and won't handle a later interruption or lifecycle action").
+		BoolVar(&eventBridgeRebalance)
+
 	app.Flag("no-spot", "Disable the spot termination listener").
 		BoolVar(&disableSpotListener)
 
@@ -68,6 +155,29 @@ func main() {
 	app.Flag("cloudwatch-stream", "Write logs to a specific Cloudwatch Logs stream, defaults to instance-id").
 		StringVar(&cloudwatchStream)
 
+	app.Flag("cloudwatch-batch-interval", "Buffer log lines and send them to Cloudwatch Logs at this interval, instead of one call per line").
+		Default("0s").
+		DurationVar(&cloudwatchBatchInterval)
+
+	app.Flag("cloudwatch-flush-timeout", "How long to wait for buffered log lines to reach Cloudwatch Logs after the handler finishes and on shutdown").
+		Default("10s").
+		DurationVar(&cloudwatchFlushTimeout)
+
+	app.Flag("cloudwatch-spool-file", "Keep log lines that fail to reach Cloudwatch Logs in this file, and send them once it can be reached").
+		StringVar(&cloudwatchSpoolFile)
+
+	cloudwatchSpoolMaxSize := app.Flag("cloudwatch-spool-max-size", "The largest the Cloudwatch Logs spool file may grow").
+		Default("10MB").
+		Bytes()
+
+	cloudwatchMaxLineSize := app.Flag("cloudwatch-max-line-size", "Truncate log lines sent to Cloudwatch Logs beyond this size, 0 for no limit; shorter lines too long for one event are split").
+		Default("1MB").
+		Bytes()
+
+	app.Flag("cloudwatch-rate-limit", "The most log lines to send to Cloudwatch Logs each second, dropping the rest, 0 for no limit").
+		Default("0").
+		IntVar(&cloudwatchRateLimit)
+
 	app.Flag("debug", "Show debugging info").
 		BoolVar(&debugLogging)
 
@@ -75,10 +185,42 @@ func main() {
 		Default("5s").
 		DurationVar(&spotListenerInterval)
 
-	app.Flag("autoscaling-heartbeat-interval", "Interval to send AWS Lifecycle Heartbeat Actions").
-		Default("10s").
+	app.Flag("autoscaling-heartbeat-interval", "Interval to send AWS Lifecycle Heartbeat Actions, derived from the hook's heartbeat timeout if unset").
+		Default("0s").
 		DurationVar(&autoscalingHeartbeatInterval)
 
+	app.Flag("autoscaling-hook-window", "Time to keep collecting termination hooks for this instance after the first, so all of them are heartbeated and completed").
+		Default("0s").
+		DurationVar(&autoscalingHookWindow)
+
+	app.Flag("setup-jitter", "Delay creating the SQS queue by a random time up to this, to spread out a fleet launched together").
+		Default("0s").
+		DurationVar(&setupJitter)
+
+	app.Flag("setup-timeout", "How long to keep retrying throttled calls while setting up the SQS queue and SNS subscription").
+		Default("5m").
+		DurationVar(&setupTimeout)
+
+	app.Flag("autoscaling-polling", "Detect autoscaling termination by polling the instance's lifecycle state, without an SNS topic or SQS queue").
+		BoolVar(&autoscalingPolling)
+
+	app.Flag("autoscaling-polling-interval", "Interval to poll the instance's lifecycle state").
+		Default("15s").
+		DurationVar(&autoscalingPollingInterval)
+
+	app.Flag("autoscaling-metadata", "Detect autoscaling termination and warm pool returns from the target lifecycle state in instance metadata").
+		BoolVar(&autoscalingMetadata)
+
+	app.Flag("autoscaling-metadata-interval", "Interval to check the target lifecycle state in instance metadata").
+		Default("5s").
+		DurationVar(&autoscalingMetadataInterval)
+
+	app.Flag("autoscaling-hook-name", "The termination lifecycle hook to complete when polling or discovering its target, required when the group has more than one").
+		StringVar(&autoscalingHookName)
+
+	app.Flag("state-dir", "Directory to persist in-flight termination notices to, so they resume after a restart").
+		StringVar(&stateDir)
+
 	app.Action(func(c *kingpin.ParseContext) error {
 		logger := logrus.New()
 		if jsonLogging {
@@ -128,10 +270,67 @@ func main() {
 			instanceID = strings.TrimSpace(string(b))
 		}
 
+		naming := lifecycled.QueueNaming{Template: queueNameTemplate, Prefix: queuePrefix}
+		if snsQueuePerTopic {
+			naming.Queues = len(strings.Split(snsTopic, ","))
+		}
+		if err := naming.Validate(); err != nil {
+			logger.WithError(err).Fatal("Invalid queue name template")
+		}
+		if err := lifecycled.ValidateMessageRetention(sqsMessageRetention); err != nil {
+			logger.WithError(err).Fatal("Invalid sqs message retention")
+		}
+		if err := lifecycled.ValidateHookWindow(autoscalingHookWindow); err != nil {
+			logger.WithError(err).Fatal("Invalid autoscaling hook window")
+		}
+		if err := lifecycled.ValidateTopicRegions(snsTopic); err != nil {
+			logger.WithError(err).Fatal("SNS topics must all be in the same region")
+		}
+		if snsQueuePerTopic {
+			if err := lifecycled.ValidateQueuePerTopic(snsTopic, autoscalingHookWindow); err != nil {
+				logger.WithError(err).Fatal("--sns-queue-per-topic needs --autoscaling-hook-window")
+			}
+		}
+		// The instance's own queue is only created to subscribe to a topic, given
+		// or discovered, so only then is its name, and the group in it, needed.
+		discovering := snsTopic == "" && autoscalingDiscovery && eventBridgeQueueURL == "" && !autoscalingPolling && !autoscalingMetadata
+		var group string
+		if sqsQueueURL == "" && (snsTopic != "" || discovering) {
+			if naming.UsesGroup() {
+				group, err = lifecycled.InstanceGroup(ctx, imds.NewFromConfig(cfg), autoscaling.NewFromConfig(cfg), instanceID)
+				if err != nil {
+					logger.WithError(err).Fatal("Failed to look up the autoscaling group for the queue name")
+				}
+			}
+			// Outside a group discovery finds no topic, and so needs no queue.
+			switch {
+			case naming.UsesGroup() && group == "" && snsTopic != "":
+				logger.Fatal("The queue name template uses {asg}, but the instance isn't part of an autoscaling group")
+			case !naming.UsesGroup() || group != "":
+				if _, err := naming.Name(instanceID, group); err != nil {
+					logger.WithError(err).Fatal("Invalid queue name")
+				}
+			}
+		}
+
+		copies, err := lifecycled.ParseCopyTags(copyInstanceTags)
+		if err != nil {
+			logger.WithError(err).Fatal("Invalid instance tags to copy")
+		}
+		// The queue is still worth having without its tags, so a failed lookup
+		// doesn't stop the daemon.
+		instanceTags, err := lifecycled.InstanceTags(ctx, imds.NewFromConfig(cfg), ec2.NewFromConfig(cfg), instanceID, copies)
+		if err != nil {
+			logger.WithError(err).Error("Failed to read instance tags, they won't be copied to the queue")
+		} else if len(copies) > 0 {
+			logger.WithField("tags", instanceTags).Debug("Copying instance tags to the queue")
+		}
+
 		if cloudwatchStream == "" {
 			cloudwatchStream = instanceID
 		}
 
+		flushLogs := func() {}
 		if cloudwatchGroup != "" {
 			hook, err := lifecycled.NewCloudWatchLogsHook(ctx, cloudwatchlogs.NewFromConfig(cfg), cloudwatchGroup, cloudwatchStream)
 			if err != nil {
@@ -143,7 +342,27 @@ func main() {
 				"stream": cloudwatchStream,
 			}).Info("Writing logs to CloudWatch")
 
+			if cloudwatchSpoolFile != "" {
+				if err := hook.EnableSpool(cloudwatchSpoolFile, int64(*cloudwatchSpoolMaxSize)); err != nil {
+					logger.WithError(err).Error("Failed to open the CloudWatch spool, lines that fail to send will be lost")
+				}
+			}
+
+			hook.LimitLineSize(int(*cloudwatchMaxLineSize))
+			hook.LimitRate(cloudwatchRateLimit, time.Second)
+
 			logger.AddHook(hook)
+
+			if cloudwatchSpoolFile != "" {
+				// Send what a previous run spooled without holding up startup.
+				go sendLogs(hook.Flush, cloudwatchFlushTimeout)
+			}
+
+			if cloudwatchBatchInterval > 0 {
+				hook.StartBatching(cloudwatchBatchInterval)
+				flushLogs = func() { sendLogs(hook.Flush, cloudwatchFlushTimeout) }
+				defer sendLogs(hook.Close, cloudwatchFlushTimeout)
+			}
 			if !jsonLogging {
 				logger.SetFormatter(&logrus.TextFormatter{
 					DisableColors:    true,
@@ -173,10 +392,37 @@ func main() {
 		daemon := lifecycled.New(&lifecycled.Config{
 			InstanceID:                   instanceID,
 			Tags:                         tags,
+			InstanceTags:                 instanceTags,
 			SNSTopic:                     snsTopic,
+			SNSQueuePerTopic:             snsQueuePerTopic,
+			AssumeRoleARN:                assumeRoleARN,
+			SNSRawDelivery:               snsRawDelivery,
+			SNSVerifySignatures:          snsVerifySignatures,
+			SNSCertBundle:                snsCertBundle,
+			SNSCertHosts:                 snsCertHosts,
+			SQSQueueURL:                  sqsQueueURL,
+			AutoscalingDiscovery:         autoscalingDiscovery,
+			QueueNameTemplate:            queueNameTemplate,
+			QueuePrefix:                  queuePrefix,
+			AutoscalingGroup:             group,
+			SQSManagedSSE:                sqsManagedSSE,
+			SQSKMSKeyID:                  sqsKMSKeyID,
+			SQSMessageRetention:          sqsMessageRetention,
+			SQSPolicyTopics:              sqsPolicyTopics,
+			EventBridgeQueueURL:          eventBridgeQueueURL,
+			EventBridgeRebalance:         eventBridgeRebalance,
 			SpotListener:                 !disableSpotListener,
 			SpotListenerInterval:         spotListenerInterval,
 			AutoscalingHeartbeatInterval: autoscalingHeartbeatInterval,
+			AutoscalingHookWindow:        autoscalingHookWindow,
+			SetupJitter:                  setupJitter,
+			SetupTimeout:                 setupTimeout,
+			AutoscalingPolling:           autoscalingPolling,
+			AutoscalingPollingInterval:   autoscalingPollingInterval,
+			AutoscalingMetadata:          autoscalingMetadata,
+			AutoscalingMetadataInterval:  autoscalingMetadataInterval,
+			AutoscalingHookName:          autoscalingHookName,
+			StateDir:                     stateDir,
 		}, cfg, logger)
 
 		notice, err := daemon.Start(ctx)
@@ -196,6 +442,9 @@ func main() {
 				log.WithError(err).Error("Failed to execute handler")
 			}
 			log.Info("Handler finished successfully")
+			// The instance may be gone soon after the handler, so don't leave its
+			// output waiting for the next batch.
+			flushLogs()
 
 		}
 		return nil
@@ -203,3 +452,14 @@ func main() {
 
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 }
+
+// sendLogs sends the log lines buffered for CloudWatch Logs with flush, giving
+// up after timeout. A failure can't be logged through the logger whose lines
+// failed to send, so it is written to stderr.
+func sendLogs(flush func(context.Context) error, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := flush(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to send logs to CloudWatch: %v\n", err)
+	}
+}
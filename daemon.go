@@ -6,29 +6,95 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
 	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
 	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/sirupsen/logrus"
 )
 
-// New creates a new lifecycle Daemon.
+// New creates a new lifecycle Daemon. The queue is created, and SNS called, in
+// the SNS topic's region, which need not be the instance's. With AssumeRoleARN
+// set, the SNS and autoscaling calls are made as that role, so a topic or group
+// managed from another account can be used.
 func New(config *Config, cfg aws.Config, logger *logrus.Logger) *Daemon {
+	topicCfg := cfg.Copy()
+	if region := topicRegion(splitList(config.SNSTopic), logger); region != "" {
+		topicCfg.Region = region
+	}
+	snsCfg, asgCfg := topicCfg.Copy(), cfg.Copy()
+	if config.AssumeRoleARN != "" {
+		creds := aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), config.AssumeRoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = fmt.Sprintf("lifecycled-%s", config.InstanceID)
+		}))
+		snsCfg.Credentials, asgCfg.Credentials = creds, creds
+	}
 	return NewDaemon(
 		config,
-		sqs.NewFromConfig(cfg),
-		sns.NewFromConfig(cfg),
-		autoscaling.NewFromConfig(cfg),
+		sqs.NewFromConfig(topicCfg),
+		sns.NewFromConfig(snsCfg),
+		autoscaling.NewFromConfig(asgCfg),
 		imds.NewFromConfig(cfg),
 		logger,
 	)
 }
 
+// topicRegion returns the region of the SNS topics, or "" if there are none.
+// One queue and SNS client serve every topic, so they must share a region.
+func topicRegion(topics []string, logger *logrus.Logger) string {
+	var region string
+	for _, topic := range topics {
+		parsed, err := arn.Parse(topic)
+		if err != nil {
+			continue
+		}
+		if region == "" {
+			region = parsed.Region
+		} else if parsed.Region != region {
+			logger.WithFields(logrus.Fields{"topic": topic, "region": region}).Warn("SNS topics are in different regions, using the first topic's")
+		}
+	}
+	return region
+}
+
+// ValidateTopicRegions returns an error if the SNS topics are in different
+// regions: the queue and SNS client are made in one region, so the topics in
+// any other couldn't be subscribed to.
+func ValidateTopicRegions(topics string) error {
+	var first arn.ARN
+	for _, topic := range splitList(topics) {
+		parsed, err := arn.Parse(topic)
+		if err != nil {
+			continue
+		}
+		if first.Region == "" {
+			first = parsed
+		} else if parsed.Region != first.Region {
+			return fmt.Errorf("topic %s is in region %s, but %s is in %s", topic, parsed.Region, first, first.Region)
+		}
+	}
+	return nil
+}
+
+// clientRegion returns the region the SQS client calls, or "" if it can't be
+// told, as for a test's fake.
+func clientRegion(client SQSClient) string {
+	if c, ok := client.(interface{ Options() sqs.Options }); ok {
+		return c.Options().Region
+	}
+	return ""
+}
+
 // NewDaemon creates a new Daemon.
 func NewDaemon(
 	config *Config,
@@ -39,46 +105,221 @@ func NewDaemon(
 	logger *logrus.Logger,
 ) *Daemon {
 	daemon := &Daemon{
-		instanceID: config.InstanceID,
-		logger:     logger,
+		instanceID:        config.InstanceID,
+		autoscaling:       asgClient,
+		heartbeatInterval: config.AutoscalingHeartbeatInterval,
+		hookWindow:        config.AutoscalingHookWindow,
+		logger:            logger,
+	}
+	// Every listener records the messages it has seen in the one record, so they
+	// share the state directory's file rather than overwrite each other's.
+	var seen *seenMessages
+	if config.StateDir != "" {
+		daemon.state = newStateStore(config.StateDir)
+		seen = newSeenMessages(daemon.state)
 	}
 	if config.SpotListener {
 		daemon.AddListener(NewSpotListener(config.InstanceID, metadata, config.SpotListenerInterval))
 	}
-	if config.SNSTopic != "" {
-		queue := NewQueue(
-			fmt.Sprintf("lifecycled-%s", config.InstanceID),
-			config.SNSTopic,
-			sqsClient,
-			snsClient,
-			config.Tags,
-		)
-		daemon.AddListener(NewAutoscalingListener(config.InstanceID, queue, asgClient, config.AutoscalingHeartbeatInterval))
+	// autoscalingListeners returns a listener for each existing queue, and for
+	// the instance's own queue subscribed to topics, or a queue per topic.
+	autoscalingListeners := func(topics, queueURLs []string) []Listener {
+		var queues []*Queue
+		for _, url := range queueURLs {
+			queues = append(queues, NewExistingQueue(url, sqsClient))
+		}
+		queues = append(queues, instanceQueues(config, topics, sqsClient, snsClient)...)
+
+		verifyTopics := topics
+		if len(verifyTopics) == 0 {
+			verifyTopics = splitList(config.SNSTopic)
+		}
+		var listeners []Listener
+		for _, queue := range queues {
+			listener := NewAutoscalingListener(config.InstanceID, queue, asgClient, config.AutoscalingHeartbeatInterval)
+			listener.hookWindow = config.AutoscalingHookWindow
+			listener.setupJitter = config.SetupJitter
+			listener.setupTimeout = config.SetupTimeout
+			if config.SNSVerifySignatures {
+				listener.verifier = newSNSVerifier(config.SNSCertBundle, config.SNSCertHosts, verifyTopics)
+			}
+			if seen != nil {
+				listener.seen = seen
+			}
+			listeners = append(listeners, listener)
+		}
+		return listeners
+	}
+	switch {
+	case config.SQSQueueURL != "":
+		for _, l := range autoscalingListeners(nil, []string{config.SQSQueueURL}) {
+			daemon.AddListener(l)
+		}
+	case config.SNSTopic != "":
+		listeners := autoscalingListeners(splitList(config.SNSTopic), nil)
+		for _, l := range listeners {
+			daemon.AddListener(l)
+		}
+		daemon.hookQueues = len(listeners)
+	case config.AutoscalingDiscovery && config.EventBridgeQueueURL == "" && !config.AutoscalingPolling && !config.AutoscalingMetadata:
+		// Nothing says where autoscaling events come from, so ask the group.
+		discovery := NewDiscoveryListener(config.InstanceID, metadata, asgClient, sqsClient, autoscalingListeners)
+		discovery.region = clientRegion(sqsClient)
+		discovery.hookName = config.AutoscalingHookName
+		daemon.AddListener(discovery)
+	}
+	if config.EventBridgeQueueURL != "" {
+		queue := NewExistingQueue(config.EventBridgeQueueURL, sqsClient)
+		listener := NewEventBridgeListener(config.InstanceID, queue, asgClient, config.AutoscalingHeartbeatInterval)
+		listener.rebalance = config.EventBridgeRebalance
+		if seen != nil {
+			listener.seen = seen
+		}
+		daemon.AddListener(listener)
+	}
+	if config.AutoscalingPolling {
+		listener := NewPollingListener(config.InstanceID, asgClient, config.AutoscalingPollingInterval, config.AutoscalingHeartbeatInterval)
+		listener.hookName = config.AutoscalingHookName
+		daemon.AddListener(listener)
+	}
+	if config.AutoscalingMetadata {
+		listener := NewTargetLifecycleListener(config.InstanceID, metadata, asgClient, config.AutoscalingMetadataInterval, config.AutoscalingHeartbeatInterval)
+		listener.hookName = config.AutoscalingHookName
+		daemon.AddListener(listener)
 	}
 	return daemon
 }
 
+// instanceQueues returns the instance's own queue subscribed to topics or, with
+// SNSQueuePerTopic, a queue for each topic.
+func instanceQueues(config *Config, topics []string, sqsClient SQSClient, snsClient SNSClient) []*Queue {
+	if len(topics) == 0 {
+		return nil
+	}
+	naming := QueueNaming{Template: config.QueueNameTemplate, Prefix: config.QueuePrefix}
+	if config.SNSQueuePerTopic {
+		naming.Queues = len(topics)
+	}
+	name, err := naming.Name(config.InstanceID, config.AutoscalingGroup)
+	if err != nil {
+		// The name is checked at startup, so this is a Config built without the
+		// group; the default name still gives the instance a queue.
+		name, _ = QueueNaming{}.Name(config.InstanceID, "")
+	}
+	if !config.SNSQueuePerTopic {
+		return []*Queue{newInstanceQueue(config, name, topics, sqsClient, snsClient)}
+	}
+	var queues []*Queue
+	for i, topic := range topics {
+		queues = append(queues, newInstanceQueue(config, name+queueSuffix(i), []string{topic}, sqsClient, snsClient))
+	}
+	return queues
+}
+
+// newInstanceQueue returns a queue of the instance's own, subscribed to topics.
+func newInstanceQueue(config *Config, name string, topics []string, sqsClient SQSClient, snsClient SNSClient) *Queue {
+	queue := NewQueue(name, topics[0], sqsClient, snsClient, config.Tags)
+	queue.topicArns = topics
+	queue.instanceID = config.InstanceID
+	queue.rawDelivery = config.SNSRawDelivery
+	queue.managedSSE = config.SQSManagedSSE
+	queue.kmsKeyID = config.SQSKMSKeyID
+	queue.messageRetention = config.SQSMessageRetention
+	queue.policyTopicArns = splitList(config.SQSPolicyTopics)
+	queue.instanceTags = config.InstanceTags
+	return queue
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// ValidateQueuePerTopic returns an error if the topics each get a queue of
+// their own with no hook window, in which lifecycled would handle the first
+// queue's termination hook and leave the others to their timeout.
+func ValidateQueuePerTopic(topics string, window time.Duration) error {
+	if n := len(splitList(topics)); n > 1 && window <= 0 {
+		return fmt.Errorf("%d topics with a queue each need a hook window to collect every queue's hook in", n)
+	}
+	return nil
+}
+
 // Config for the Lifecycled Daemon.
 type Config struct {
 	InstanceID                   string
 	Tags                         string
+	InstanceTags                 map[string]string
 	SNSTopic                     string
+	AssumeRoleARN                string
+	SNSQueuePerTopic             bool
+	SNSRawDelivery               bool
+	SNSVerifySignatures          bool
+	SNSCertBundle                string
+	SNSCertHosts                 string
+	SQSQueueURL                  string
+	QueueNameTemplate            string
+	QueuePrefix                  string
+	AutoscalingGroup             string
+	AutoscalingDiscovery         bool
+	SQSManagedSSE                bool
+	SQSKMSKeyID                  string
+	SQSMessageRetention          time.Duration
+	SQSPolicyTopics              string
+	EventBridgeQueueURL          string
+	EventBridgeRebalance         bool
 	SpotListener                 bool
 	SpotListenerInterval         time.Duration
 	AutoscalingHeartbeatInterval time.Duration
+	AutoscalingHookWindow        time.Duration
+	SetupJitter                  time.Duration
+	SetupTimeout                 time.Duration
+	AutoscalingPolling           bool
+	AutoscalingPollingInterval   time.Duration
+	AutoscalingMetadata          bool
+	AutoscalingMetadataInterval  time.Duration
+	AutoscalingHookName          string
+	StateDir                     string
 }
 
 // Daemon is what orchestrates the listening and execution of the handler on a termination notice.
 type Daemon struct {
-	instanceID string
-	listeners  []Listener
-	logger     *logrus.Logger
+	instanceID        string
+	listeners         []Listener
+	autoscaling       AutoscalingClient
+	heartbeatInterval time.Duration
+	state             *stateStore
+	logger            *logrus.Logger
+
+	// hookQueues is how many of the instance's queues, one per SNS topic, may
+	// each deliver a termination hook. Their notices are merged for up to
+	// hookWindow, so every hook is heartbeated and completed.
+	hookQueues int
+	hookWindow time.Duration
 }
 
 // Start the Daemon.
 func (d *Daemon) Start(ctx context.Context) (notice TerminationNotice, err error) {
 	log := d.logger.WithField("instanceId", d.instanceID)
 
+	// A notice persisted by a previous run is still in flight: resume it rather
+	// than waiting for a notice that has already been delivered.
+	if d.state != nil {
+		n, err := d.resumeNotice(log)
+		if err != nil {
+			log.WithError(err).Error("Failed to resume persisted termination notice")
+		} else if n != nil {
+			log.WithField("notice", n.Type()).Info("Resuming persisted termination notice")
+			return n, nil
+		}
+	}
+
 	// Use a buffered channel to avoid deadlocking a goroutine when we stop listening
 	notices := make(chan TerminationNotice, len(d.listeners))
 	defer close(notices)
@@ -123,12 +364,49 @@ Listener:
 		case n := <-notices:
 			log.WithField("notice", n.Type()).Info("Received termination notice")
 			notice = n
+			if n, ok := n.(*autoscalingTerminationNotice); ok && d.hookQueues > 1 {
+				notice = d.collectHooks(listenerCtx, n, notices, log)
+			}
+			if d.state != nil {
+				notice = d.persistNotice(notice, log)
+			}
 			break Listener
 		}
 	}
 	return notice, err
 }
 
+// collectHooks waits up to the hook window for the notices of the instance's
+// other queues, and returns n with their lifecycle actions added.
+func (d *Daemon) collectHooks(ctx context.Context, n *autoscalingTerminationNotice, notices <-chan TerminationNotice, log *logrus.Entry) *autoscalingTerminationNotice {
+	merged := *n
+	merged.messages = slices.Clone(n.messages)
+	window := time.NewTimer(d.hookWindow)
+	defer window.Stop()
+	for pending := d.hookQueues - 1; pending > 0; {
+		select {
+		case <-ctx.Done():
+			return &merged
+		case <-window.C:
+			log.WithField("pending", pending).Warn("Hook window closed before every queue had a termination notice")
+			return &merged
+		case other := <-notices:
+			o, ok := other.(*autoscalingTerminationNotice)
+			if !ok {
+				log.WithField("notice", other.Type()).Info("Ignoring termination notice while collecting lifecycle hooks")
+				continue
+			}
+			pending--
+			for _, m := range o.messages {
+				if !slices.ContainsFunc(merged.messages, func(c *Message) bool { return c.hookKey() == m.hookKey() }) {
+					merged.messages = append(merged.messages, m)
+				}
+			}
+		}
+	}
+	return &merged
+}
+
 // AddListener to the Daemon.
 func (d *Daemon) AddListener(l Listener) {
 	d.listeners = append(d.listeners, l)
@@ -161,10 +439,44 @@ type FileHandler struct {
 	file *os.File
 }
 
-// Execute the file handler.
+// Execute the file handler. When the notice carries a deadline it is passed to
+// the handler as LIFECYCLED_DEADLINE, and the handler is killed once it passes.
+// For an autoscaling notice, LIFECYCLED_ACTION_LOST_FILE names a file that is
+// created if the lifecycle action stops being valid, at which point termination
+// is imminent and the deadline no longer applies.
 func (h *FileHandler) Execute(ctx context.Context, args ...string) error {
 	cmd := exec.CommandContext(ctx, h.file.Name(), args...)
 	cmd.Env = os.Environ()
+	if deadline, ok := ctx.Deadline(); ok {
+		cmd.Env = append(cmd.Env, "LIFECYCLED_DEADLINE="+deadline.UTC().Format(time.RFC3339))
+	}
+	if lost := ActionLost(ctx); lost != nil {
+		dir, err := os.MkdirTemp("", "lifecycled-")
+		if err != nil {
+			return err
+		}
+		defer func() { _ = os.RemoveAll(dir) }()
+
+		path := filepath.Join(dir, "action-lost")
+		cmd.Env = append(cmd.Env, "LIFECYCLED_ACTION_LOST_FILE="+path)
+
+		// Wait for the watcher before the directory is removed, so it can't
+		// recreate the file afterwards.
+		var wg sync.WaitGroup
+		done := make(chan struct{})
+		defer wg.Wait()
+		defer close(done)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-lost:
+				_ = os.WriteFile(path, []byte("lifecycle action is no longer active; termination is imminent and the deadline is unknown\n"), 0o600)
+			case <-done:
+			}
+		}()
+	}
 	cmd.Stdout = os.Stderr
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
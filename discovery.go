@@ -0,0 +1,179 @@
+package lifecycled
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/sirupsen/logrus"
+)
+
+// groupNameTagPath is the instance metadata path of the tag naming the
+// instance's group, present when instance tags are allowed in metadata.
+const groupNameTagPath = "tags/instance/aws:autoscaling:groupName"
+
+// NewDiscoveryListener returns a listener that finds where the instance's
+// termination hooks send their notifications, and listens there with the
+// listeners that newListeners returns for the SNS topics and SQS queues found.
+func NewDiscoveryListener(instanceID string, metadata MetadataClient, autoscaling AutoscalingClient, sqsClient SQSClient, newListeners func(topics, queueURLs []string) []Listener) *DiscoveryListener {
+	return &DiscoveryListener{
+		listenerType: "autoscaling",
+		instanceID:   instanceID,
+		metadata:     metadata,
+		autoscaling:  autoscaling,
+		sqsClient:    sqsClient,
+		newListeners: newListeners,
+	}
+}
+
+// DiscoveryListener saves configuring the SNS topic on every instance: the
+// group's termination hooks already name their notification target. A topic is
+// subscribed to as if given with --sns-topic, and a queue is consumed directly
+// as if given with --sqs-queue-url. Every hook notifying the target is
+// completed, so the group's termination hooks must share one target, or
+// hookName must pick lifecycled's own.
+type DiscoveryListener struct {
+	listenerType string
+	instanceID   string
+	metadata     MetadataClient
+	autoscaling  AutoscalingClient
+	sqsClient    SQSClient
+	newListeners func(topics, queueURLs []string) []Listener
+
+	// region is the region the SQS and SNS clients call, when known. A target
+	// in any other region can't be reached with them.
+	region string
+
+	// hookName is the termination hook whose target to listen to, if set.
+	hookName string
+}
+
+// Type returns a string describing the listener type.
+func (l *DiscoveryListener) Type() string {
+	return l.listenerType
+}
+
+// Start discovers the notification target and runs its listener until it
+// returns. When it finds nothing to listen to, or fails, it logs and returns
+// without stopping the daemon, so its other listeners, such as the spot
+// listener, carry on.
+func (l *DiscoveryListener) Start(ctx context.Context, notices chan<- TerminationNotice, log *logrus.Entry) error {
+	group, err := InstanceGroup(ctx, l.metadata, l.autoscaling, l.instanceID)
+	if err != nil {
+		log.WithError(err).Error("Failed to find the autoscaling group, autoscaling events won't be handled")
+		return nil
+	}
+	if group == "" {
+		log.Warn("Instance isn't part of an autoscaling group, and no sns topic is configured")
+		return nil
+	}
+	topics, queueURLs, err := l.targets(ctx, group)
+	if err != nil {
+		log.WithError(err).WithField("group", group).Error("Failed to find lifecycle hook notification targets, autoscaling events won't be handled")
+		return nil
+	}
+	if len(topics) == 0 && len(queueURLs) == 0 {
+		log.WithField("group", group).Warn("No termination lifecycle hook with a notification target to listen to")
+		return nil
+	}
+	log.WithFields(logrus.Fields{
+		"group":  group,
+		"topics": topics,
+		"queues": queueURLs,
+	}).Info("Discovered lifecycle hook notification target")
+
+	// targets found one topic or queue, and so one listener for it.
+	return l.newListeners(topics, queueURLs)[0].Start(ctx, notices, log)
+}
+
+// InstanceGroup returns the name of the instance's autoscaling group from its
+// instance metadata tags, which cost nothing to read, falling back to the Auto
+// Scaling API when tags aren't in metadata. It returns "" if the instance isn't
+// in a group.
+func InstanceGroup(ctx context.Context, metadata MetadataClient, autoscaling AutoscalingClient, instanceID string) (string, error) {
+	if group, err := metadataValue(ctx, metadata, groupNameTagPath); err == nil && group != "" {
+		return group, nil
+	}
+	group, _, err := describeLifecycleState(ctx, autoscaling, instanceID)
+	return group, err
+}
+
+// targets returns the SNS topic or SQS queue URL that the group's termination
+// hooks notify, or that of the hook named hookName. It returns an error if the
+// hooks notify different targets: lifecycled can't tell which of them are its
+// own, and would complete hooks that other tools are handling.
+func (l *DiscoveryListener) targets(ctx context.Context, group string) ([]string, []string, error) {
+	out, err := l.autoscaling.DescribeLifecycleHooks(ctx, &autoscaling.DescribeLifecycleHooksInput{
+		AutoScalingGroupName: aws.String(group),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var topics, queueURLs, hooks []string
+	for _, hook := range out.LifecycleHooks {
+		target := aws.ToString(hook.NotificationTargetARN)
+		if aws.ToString(hook.LifecycleTransition) != terminatingTransition || target == "" {
+			continue
+		}
+		if l.hookName != "" && aws.ToString(hook.LifecycleHookName) != l.hookName {
+			continue
+		}
+		hooks = append(hooks, aws.ToString(hook.LifecycleHookName))
+		parsed, err := arn.Parse(target)
+		if err != nil {
+			return nil, nil, fmt.Errorf("hook %s: %w", aws.ToString(hook.LifecycleHookName), err)
+		}
+		if l.region != "" && parsed.Region != l.region {
+			return nil, nil, fmt.Errorf("hook %s: notification target %s is in region %s, not %s: %s", aws.ToString(hook.LifecycleHookName), target, parsed.Region, l.region, otherRegionAdvice(parsed))
+		}
+		switch parsed.Service {
+		case "sns":
+			if !slices.Contains(topics, target) {
+				topics = append(topics, target)
+			}
+		case "sqs":
+			url, err := l.queueURL(ctx, parsed)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !slices.Contains(queueURLs, url) {
+				queueURLs = append(queueURLs, url)
+			}
+		default:
+			return nil, nil, fmt.Errorf("hook %s: unsupported notification target %s", aws.ToString(hook.LifecycleHookName), target)
+		}
+	}
+	if len(topics)+len(queueURLs) > 1 {
+		return nil, nil, fmt.Errorf("termination hooks %s notify different targets, set --autoscaling-hook-name to lifecycled's own", strings.Join(hooks, ", "))
+	}
+	return topics, queueURLs, nil
+}
+
+// otherRegionAdvice says how to listen to a target in another region.
+func otherRegionAdvice(target arn.ARN) string {
+	if target.Service == "sns" {
+		return "give the topic with --sns-topic, which subscribes from the topic's region"
+	}
+	return "run lifecycled with the queue's region as its aws region"
+}
+
+// queueURL looks up the URL of the queue with the given ARN.
+func (l *DiscoveryListener) queueURL(ctx context.Context, queue arn.ARN) (string, error) {
+	out, err := l.sqsClient.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
+		QueueName:              aws.String(queue.Resource),
+		QueueOwnerAWSAccountId: aws.String(queue.AccountID),
+	})
+	if err != nil {
+		return "", fmt.Errorf("get url of queue %s: %w", queue.Resource, err)
+	}
+	if aws.ToString(out.QueueUrl) == "" {
+		return "", errors.New("no queue url returned")
+	}
+	return aws.ToString(out.QueueUrl), nil
+}
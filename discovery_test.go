@@ -0,0 +1,176 @@
+package lifecycled
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	astypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// startedListener records that it was started and returns straight away.
+type startedListener struct {
+	started bool
+}
+
+func (l *startedListener) Type() string { return "started" }
+
+func (l *startedListener) Start(context.Context, chan<- TerminationNotice, *logrus.Entry) error {
+	l.started = true
+	return nil
+}
+
+func hook(name, transition, target string) astypes.LifecycleHook {
+	h := astypes.LifecycleHook{LifecycleHookName: aws.String(name), LifecycleTransition: aws.String(transition)}
+	if target != "" {
+		h.NotificationTargetARN = aws.String(target)
+	}
+	return h
+}
+
+func TestDiscoveryListener(t *testing.T) {
+	const (
+		topic = "arn:aws:sns:us-east-1:111111111111:lifecycle"
+		queue = "arn:aws:sqs:us-east-1:111111111111:lifecycle"
+	)
+
+	tests := []struct {
+		name       string
+		tag        string
+		group      string
+		hookName   string
+		hooks      []astypes.LifecycleHook
+		wantTopics []string
+		wantQueues []string
+		wantWarn   string
+		wantError  string
+	}{
+		{
+			name:       "group from the api, topic from the termination hook",
+			group:      "group",
+			hooks:      []astypes.LifecycleHook{hook("launch", "autoscaling:EC2_INSTANCE_LAUNCHING", "arn:aws:sns:us-east-1:111111111111:launch"), hook("drain", terminatingTransition, topic)},
+			wantTopics: []string{topic},
+		},
+		{
+			name:       "group from the metadata tag",
+			tag:        "group",
+			hooks:      []astypes.LifecycleHook{hook("drain", terminatingTransition, topic)},
+			wantTopics: []string{topic},
+		},
+		{
+			name:       "a queue target is consumed directly",
+			group:      "group",
+			hooks:      []astypes.LifecycleHook{hook("drain", terminatingTransition, queue)},
+			wantQueues: []string{"https://sqs.us-east-1.amazonaws.com/111111111111/lifecycle"},
+		},
+		{
+			name:       "hooks sharing a target",
+			group:      "group",
+			hooks:      []astypes.LifecycleHook{hook("drain", terminatingTransition, topic), hook("backup", terminatingTransition, topic)},
+			wantTopics: []string{topic},
+		},
+		{
+			name:      "hooks with different targets",
+			group:     "group",
+			hooks:     []astypes.LifecycleHook{hook("drain", terminatingTransition, queue), hook("other", terminatingTransition, topic)},
+			wantError: "Failed to find lifecycle hook notification targets",
+		},
+		{
+			name:       "the named hook's target",
+			group:      "group",
+			hookName:   "drain",
+			hooks:      []astypes.LifecycleHook{hook("drain", terminatingTransition, queue), hook("other", terminatingTransition, topic)},
+			wantQueues: []string{"https://sqs.us-east-1.amazonaws.com/111111111111/lifecycle"},
+		},
+		{
+			name:     "no target",
+			group:    "group",
+			hooks:    []astypes.LifecycleHook{hook("drain", terminatingTransition, "")},
+			wantWarn: "No termination lifecycle hook",
+		},
+		{
+			name:     "not in a group",
+			wantWarn: "isn't part of an autoscaling group",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			metadata := &stubMetadataClient{err: notFoundError{}}
+			if tc.tag != "" {
+				metadata = &stubMetadataClient{out: &imds.GetMetadataOutput{Content: io.NopCloser(strings.NewReader(tc.tag))}}
+			}
+			as := &pollingASGClient{stubAutoscalingClient: stubAutoscalingClient{hooks: tc.hooks}, group: tc.group, states: []string{"InService"}}
+
+			var (
+				gotTopics, gotQueues []string
+				started              = &startedListener{}
+			)
+			listener := NewDiscoveryListener("i-1", metadata, as, &stubSQSClient{}, func(topics, queueURLs []string) []Listener {
+				gotTopics, gotQueues = topics, queueURLs
+				return []Listener{started}
+			})
+			listener.hookName = tc.hookName
+			logger, logs := logrustest.NewNullLogger()
+
+			if err := listener.Start(context.Background(), make(chan TerminationNotice, 1), logrus.NewEntry(logger)); err != nil {
+				t.Fatalf("Start returned error: %v", err)
+			}
+			if !slices.Equal(gotTopics, tc.wantTopics) || !slices.Equal(gotQueues, tc.wantQueues) {
+				t.Errorf("discovered topics %v and queues %v, want %v and %v", gotTopics, gotQueues, tc.wantTopics, tc.wantQueues)
+			}
+			if wantStarted := tc.wantWarn == "" && tc.wantError == ""; started.started != wantStarted {
+				t.Errorf("listener started = %v, want %v", started.started, wantStarted)
+			}
+			if tc.wantWarn != "" && !loggedAt(logs.AllEntries(), logrus.WarnLevel, tc.wantWarn) {
+				t.Errorf("expected a warning containing %q, got %v", tc.wantWarn, messages(logs.AllEntries()))
+			}
+			if tc.wantError != "" && !loggedAt(logs.AllEntries(), logrus.ErrorLevel, tc.wantError) {
+				t.Errorf("expected an error containing %q, got %v", tc.wantError, messages(logs.AllEntries()))
+			}
+		})
+	}
+}
+
+func TestDiscoveryListenerOtherRegion(t *testing.T) {
+	for _, target := range []string{
+		"arn:aws:sns:eu-west-1:111111111111:lifecycle",
+		"arn:aws:sqs:eu-west-1:111111111111:lifecycle",
+	} {
+		t.Run(target, func(t *testing.T) {
+			as := &pollingASGClient{
+				stubAutoscalingClient: stubAutoscalingClient{hooks: []astypes.LifecycleHook{hook("drain", terminatingTransition, target)}},
+				group:                 "group",
+				states:                []string{"InService"},
+			}
+			started := &startedListener{}
+			listener := NewDiscoveryListener("i-1", &stubMetadataClient{err: notFoundError{}}, as, &stubSQSClient{}, func([]string, []string) []Listener {
+				return []Listener{started}
+			})
+			listener.region = "us-east-1"
+			logger, logs := logrustest.NewNullLogger()
+
+			if err := listener.Start(context.Background(), make(chan TerminationNotice, 1), logrus.NewEntry(logger)); err != nil {
+				t.Fatalf("Start returned error: %v", err)
+			}
+			if started.started {
+				t.Error("listener started for a target in another region")
+			}
+			var err error
+			for _, e := range logs.AllEntries() {
+				if e.Level == logrus.ErrorLevel {
+					err, _ = e.Data[logrus.ErrorKey].(error)
+				}
+			}
+			if err == nil || !strings.Contains(err.Error(), "is in region eu-west-1, not us-east-1") {
+				t.Errorf("expected an error naming both regions, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package lifecycled
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// EventBridge detail types the listener understands.
+	detailSpotInterruption   = "EC2 Spot Instance Interruption Warning"
+	detailRebalance          = "EC2 Instance Rebalance Recommendation"
+	detailTerminateLifecycle = "EC2 Instance-terminate Lifecycle Action"
+
+	// spotInterruptionNotice is how long before a spot instance is interrupted the
+	// warning is sent.
+	spotInterruptionNotice = 2 * time.Minute
+
+	// rebalanceTransition is passed to the handler for a rebalance recommendation.
+	rebalanceTransition = "ec2:INSTANCE_REBALANCE_RECOMMENDATION"
+)
+
+// eventBridgeEvent is an EventBridge event as delivered to an SQS target.
+type eventBridgeEvent struct {
+	DetailType string          `json:"detail-type"`
+	Source     string          `json:"source"`
+	Time       time.Time       `json:"time"`
+	Resources  []string        `json:"resources"`
+	Detail     json.RawMessage `json:"detail"`
+}
+
+// instanceID returns the id of the instance the event is about, or "" if it
+// can't be told. Lifecycle actions name it in EC2InstanceId and EC2 events in
+// instance-id; both also list the instance's ARN as a resource.
+func (e *eventBridgeEvent) instanceID() string {
+	var detail struct {
+		EC2InstanceID string `json:"EC2InstanceId"`
+		InstanceID    string `json:"instance-id"`
+	}
+	if err := json.Unmarshal(e.Detail, &detail); err == nil {
+		if detail.EC2InstanceID != "" {
+			return detail.EC2InstanceID
+		}
+		if detail.InstanceID != "" {
+			return detail.InstanceID
+		}
+	}
+	for _, arn := range e.Resources {
+		if i := strings.LastIndex(arn, ":instance/"); i >= 0 {
+			return arn[i+len(":instance/"):]
+		}
+	}
+	return ""
+}
+
+// NewEventBridgeListener ...
+func NewEventBridgeListener(instanceID string, queue *Queue, autoscaling AutoscalingClient, heartbeatInterval time.Duration) *EventBridgeListener {
+	return &EventBridgeListener{
+		listenerType:      "eventbridge",
+		instanceID:        instanceID,
+		queue:             queue,
+		autoscaling:       autoscaling,
+		heartbeatInterval: heartbeatInterval,
+		seen:              newSeenMessages(nil),
+	}
+}
+
+// EventBridgeListener consumes EventBridge events from an SQS queue provisioned
+// outside lifecycled, which may be this instance's alone or shared by the fleet.
+// It handles spot interruption warnings, rebalance recommendations and
+// termination lifecycle actions for this instance, deletes its other events,
+// and releases events for other instances for other consumers to receive.
+type EventBridgeListener struct {
+	listenerType      string
+	instanceID        string
+	queue             *Queue
+	autoscaling       AutoscalingClient
+	heartbeatInterval time.Duration
+	seen              *seenMessages
+
+	// rebalance runs the handler for a rebalance recommendation. The daemon stops
+	// once the handler has run, so the interruption or lifecycle action that may
+	// follow goes unhandled; without it, recommendations are deleted.
+	rebalance bool
+}
+
+// Type returns a string describing the listener type.
+func (l *EventBridgeListener) Type() string {
+	return l.listenerType
+}
+
+// Start the EventBridge listener.
+func (l *EventBridgeListener) Start(ctx context.Context, notices chan<- TerminationNotice, log *logrus.Entry) error {
+	if err := l.seen.load(); err != nil {
+		log.WithError(err).Error("Failed to load seen lifecycle action tokens")
+	}
+
+	var pacing releaseBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		log.WithField("queueURL", l.queue.url).Debug("Polling sqs for events")
+		messages, err := l.queue.GetMessages(ctx)
+		if err != nil {
+			backoff := logPollError(log, err, "Failed to get messages from SQS")
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			continue
+		}
+
+		// The queue may be shared with other consumers, so events that aren't
+		// about this instance are released for them. Events about this instance
+		// that don't call for the handler are deleted, or they would keep coming
+		// back, and the one that does is deleted once handed off.
+		var (
+			notice  TerminationNotice
+			handle  string
+			discard []string
+			release []string
+		)
+		for _, m := range messages {
+			event, ok := l.parseEvent(m, log)
+			if !ok {
+				release = append(release, aws.ToString(m.ReceiptHandle))
+				continue
+			}
+			if notice != nil {
+				continue
+			}
+			n, err := l.notice(event)
+			if err != nil {
+				log.WithError(err).WithField("detailType", event.DetailType).Debug("Skipping event")
+				discard = append(discard, aws.ToString(m.ReceiptHandle))
+				continue
+			}
+			notice, handle = n, aws.ToString(m.ReceiptHandle)
+		}
+
+		if len(discard) > 0 {
+			if err := l.queue.DeleteMessages(ctx, discard); err != nil {
+				log.WithError(err).Warn("Failed to delete messages")
+			}
+		}
+		if len(release) > 0 {
+			if err := l.queue.ReleaseMessages(ctx, release); err != nil {
+				log.WithError(err).Warn("Failed to release messages")
+			}
+		}
+		if notice == nil {
+			if wait := pacing.next(len(messages), len(release)); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(wait):
+				}
+			}
+			continue
+		}
+
+		notices <- notice
+		// Record the action as seen only once handed off, so a crash before then
+		// leaves it to be handled when redelivered.
+		if n, ok := notice.(*autoscalingTerminationNotice); ok {
+			if err := l.seen.add(n.messages...); err != nil {
+				log.WithError(err).Error("Failed to persist lifecycle action token")
+			}
+		}
+		// The daemon stops listening once it has the notice, so acknowledge on a
+		// fresh, bounded context that outlives ctx.
+		ackCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		if err := l.queue.DeleteMessage(ackCtx, handle); err != nil {
+			log.WithError(err).Warn("Failed to delete message")
+		}
+		cancel()
+		return nil
+	}
+}
+
+// parseEvent decodes an EventBridge event from an SQS message, reporting false
+// if it can't be read or isn't about this instance.
+func (l *EventBridgeListener) parseEvent(m sqstypes.Message, log *logrus.Entry) (*eventBridgeEvent, bool) {
+	var event eventBridgeEvent
+	if err := json.Unmarshal([]byte(aws.ToString(m.Body)), &event); err != nil {
+		log.WithError(err).Warn("Failed to unmarshal EventBridge event")
+		return nil, false
+	}
+	if event.DetailType == "" {
+		log.Warn("Releasing message, not an EventBridge event")
+		return nil, false
+	}
+
+	log.WithFields(logrus.Fields{
+		"detailType": event.DetailType,
+		"source":     event.Source,
+	}).Debug("Received an EventBridge event")
+
+	if target := event.instanceID(); target != l.instanceID {
+		log.WithField("target", target).Debug("Releasing event, doesn't match instance id")
+		return nil, false
+	}
+	return &event, true
+}
+
+// notice returns the termination notice for an event about this instance, or an
+// error if the event doesn't call for the handler.
+func (l *EventBridgeListener) notice(event *eventBridgeEvent) (TerminationNotice, error) {
+	switch event.DetailType {
+	case detailTerminateLifecycle:
+		var msg Message
+		if err := json.Unmarshal(event.Detail, &msg); err != nil {
+			return nil, fmt.Errorf("unmarshal lifecycle action: %w", err)
+		}
+		if msg.Transition != terminatingTransition {
+			return nil, fmt.Errorf("not a termination notice: %s", msg.Transition)
+		}
+		if l.seen.contains(&msg) {
+			return nil, fmt.Errorf("duplicate lifecycle action for hook %s", msg.HookName)
+		}
+		msg.Time = event.Time
+		return &autoscalingTerminationNotice{
+			noticeType:        "autoscaling",
+			messages:          []*Message{&msg},
+			autoscaling:       l.autoscaling,
+			heartbeatInterval: l.heartbeatInterval,
+		}, nil
+
+	case detailSpotInterruption:
+		return &spotTerminationNotice{
+			noticeType:      "spot",
+			instanceID:      l.instanceID,
+			transition:      "ec2:SPOT_INSTANCE_TERMINATION",
+			terminationTime: event.Time.Add(spotInterruptionNotice),
+		}, nil
+
+	case detailRebalance:
+		if !l.rebalance {
+			return nil, fmt.Errorf("rebalance recommendations aren't handled")
+		}
+		return &spotTerminationNotice{
+			noticeType:      "rebalance",
+			instanceID:      l.instanceID,
+			transition:      rebalanceTransition,
+			terminationTime: event.Time,
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported event %q", event.DetailType)
+}
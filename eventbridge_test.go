@@ -0,0 +1,165 @@
+package lifecycled
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// eventSQSClient scripts received batches and records released receipt handles.
+type eventSQSClient struct {
+	scriptedSQSClient
+	released []string
+}
+
+func (c *eventSQSClient) ChangeMessageVisibilityBatch(_ context.Context, in *sqs.ChangeMessageVisibilityBatchInput, _ ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range in.Entries {
+		c.released = append(c.released, aws.ToString(e.ReceiptHandle))
+	}
+	return &sqs.ChangeMessageVisibilityBatchOutput{}, nil
+}
+
+var eventTime = time.Date(2026, 6, 29, 12, 0, 0, 0, time.UTC)
+
+func eventBridgeMessage(detailType, resources, detail, handle string) sqstypes.Message {
+	body := `{"version":"0","detail-type":"` + detailType + `","source":"aws.ec2","time":"` + eventTime.Format(time.RFC3339) + `","resources":[` + resources + `],"detail":` + detail + `}`
+	return sqstypes.Message{Body: aws.String(body), ReceiptHandle: aws.String(handle)}
+}
+
+func lifecycleActionEvent(instanceID, transition, handle string) sqstypes.Message {
+	detail := `{"LifecycleActionToken":"token","AutoScalingGroupName":"group","LifecycleHookName":"hook","EC2InstanceId":"` + instanceID + `","LifecycleTransition":"` + transition + `"}`
+	return eventBridgeMessage(detailTerminateLifecycle, "", detail, handle)
+}
+
+// On a shared queue, events for other instances and messages that can't be read
+// are released for other consumers, events for this instance that don't call
+// for the handler are deleted, and the termination lifecycle action becomes the
+// notice.
+func TestEventBridgeListenerSharedQueue(t *testing.T) {
+	const instanceID = "i-000000000000"
+	sq := &eventSQSClient{scriptedSQSClient: scriptedSQSClient{batches: [][]sqstypes.Message{{
+		eventBridgeMessage(detailSpotInterruption, "", `{"instance-id":"i-999999999999","instance-action":"terminate"}`, "h1"),
+		{Body: aws.String("not json"), ReceiptHandle: aws.String("h2")},
+		lifecycleActionEvent(instanceID, "autoscaling:EC2_INSTANCE_LAUNCHING", "h3"),
+		lifecycleActionEvent(instanceID, terminatingTransition, "h4"),
+	}}}}
+	listener := NewEventBridgeListener(instanceID, NewExistingQueue("https://sqs/queue", sq), &stubAutoscalingClient{}, time.Minute)
+
+	logger, _ := logrustest.NewNullLogger()
+	notices := make(chan TerminationNotice, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := listener.Start(ctx, notices, logrus.NewEntry(logger)); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	n, ok := (<-notices).(*autoscalingTerminationNotice)
+	if !ok {
+		t.Fatal("expected an autoscaling termination notice")
+	}
+	if m := n.messages[0]; m.ActionToken != "token" || m.HookName != "hook" || !m.Time.Equal(eventTime) {
+		t.Errorf("notice message = %+v, want the lifecycle action from the event", m)
+	}
+	if want := []string{"h1", "h2"}; !slices.Equal(sq.released, want) {
+		t.Errorf("released = %v, want %v", sq.released, want)
+	}
+	if want := []string{"h3"}; !slices.Equal(sq.deleted, want) {
+		t.Errorf("deleted = %v, want %v", sq.deleted, want)
+	}
+}
+
+func TestEventBridgeListenerNotices(t *testing.T) {
+	const instanceID = "i-000000000000"
+
+	tests := []struct {
+		name           string
+		message        sqstypes.Message
+		wantType       string
+		wantTransition string
+		wantTime       time.Time
+	}{
+		{
+			name:           "spot interruption warning",
+			message:        eventBridgeMessage(detailSpotInterruption, "", `{"instance-id":"`+instanceID+`","instance-action":"terminate"}`, "h"),
+			wantType:       "spot",
+			wantTransition: "ec2:SPOT_INSTANCE_TERMINATION",
+			wantTime:       eventTime.Add(spotInterruptionNotice),
+		},
+		{
+			name:           "rebalance recommendation identified by its resource",
+			message:        eventBridgeMessage(detailRebalance, `"arn:aws:ec2:us-east-1:123456789012:instance/`+instanceID+`"`, `{}`, "h"),
+			wantType:       "rebalance",
+			wantTransition: rebalanceTransition,
+			wantTime:       eventTime,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sq := &eventSQSClient{scriptedSQSClient: scriptedSQSClient{batches: [][]sqstypes.Message{{tc.message}}}}
+			listener := NewEventBridgeListener(instanceID, NewExistingQueue("https://sqs/queue", sq), &stubAutoscalingClient{}, time.Minute)
+			listener.rebalance = true
+
+			logger, _ := logrustest.NewNullLogger()
+			notices := make(chan TerminationNotice, 1)
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			if err := listener.Start(ctx, notices, logrus.NewEntry(logger)); err != nil {
+				t.Fatalf("Start returned error: %v", err)
+			}
+
+			n, ok := (<-notices).(*spotTerminationNotice)
+			if !ok {
+				t.Fatal("expected a spot termination notice")
+			}
+			if n.Type() != tc.wantType || n.transition != tc.wantTransition || n.instanceID != instanceID {
+				t.Errorf("notice = %q %q %q, want %q %q %q", n.Type(), n.transition, n.instanceID, tc.wantType, tc.wantTransition, instanceID)
+			}
+			if !n.terminationTime.Equal(tc.wantTime) {
+				t.Errorf("time = %s, want %s", n.terminationTime, tc.wantTime)
+			}
+		})
+	}
+}
+
+// The daemon exits once a notice is handled, so unless asked to, it doesn't end
+// on a rebalance recommendation, which is often followed by the interruption or
+// lifecycle action that needs handling. The recommendation is deleted rather
+// than left to come back.
+func TestEventBridgeListenerSkipsRebalance(t *testing.T) {
+	const instanceID = "i-000000000000"
+	sq := &eventSQSClient{scriptedSQSClient: scriptedSQSClient{batches: [][]sqstypes.Message{
+		{eventBridgeMessage(detailRebalance, "", `{"instance-id":"`+instanceID+`"}`, "h1")},
+		{eventBridgeMessage(detailSpotInterruption, "", `{"instance-id":"`+instanceID+`","instance-action":"terminate"}`, "h2")},
+	}}}
+	listener := NewEventBridgeListener(instanceID, NewExistingQueue("https://sqs/queue", sq), &stubAutoscalingClient{}, time.Minute)
+
+	logger, _ := logrustest.NewNullLogger()
+	notices := make(chan TerminationNotice, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := listener.Start(ctx, notices, logrus.NewEntry(logger)); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	if n := <-notices; n.Type() != "spot" {
+		t.Errorf("notice type = %q, want the spot interruption after the recommendation", n.Type())
+	}
+	if want := []string{"h1"}; !slices.Equal(sq.deleted, want) {
+		t.Errorf("deleted = %v, want %v", sq.deleted, want)
+	}
+	if len(sq.released) != 0 {
+		t.Errorf("released = %v, want none", sq.released)
+	}
+}
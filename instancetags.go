@@ -0,0 +1,106 @@
+package lifecycled
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// instanceTagsPath is the instance metadata path listing the instance's tag
+// keys, present when instance tags are allowed in metadata.
+const instanceTagsPath = "tags/instance"
+
+// EC2Client is the part of the EC2 API used to read the instance's tags when
+// they aren't in instance metadata.
+type EC2Client interface {
+	DescribeTags(context.Context, *ec2.DescribeTagsInput, ...func(*ec2.Options)) (*ec2.DescribeTagsOutput, error)
+}
+
+// ParseCopyTags parses a comma separated list of instance tag keys to copy onto
+// the queue, each optionally followed by =KEY to name the queue tag differently,
+// like "aws:autoscaling:groupName=AutoScalingGroup,Team". Queue tag keys can't
+// start with aws:, so an aws: key that isn't renamed loses that prefix. It
+// returns the queue tag key for each instance tag key.
+func ParseCopyTags(input string) (map[string]string, error) {
+	copies := map[string]string{}
+	for _, item := range splitList(input) {
+		from, to, renamed := strings.Cut(item, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !renamed {
+			to = from
+			if strings.HasPrefix(strings.ToLower(to), "aws:") {
+				to = to[4:]
+			}
+		}
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("invalid instance tag to copy %q", item)
+		}
+		if strings.HasPrefix(strings.ToLower(to), "aws:") {
+			return nil, fmt.Errorf("tag keys cannot start with 'aws:' prefix: %q", to)
+		}
+		if len(to) > maxTagKeyLength {
+			return nil, fmt.Errorf("tag key exceeds maximum length of %d characters: %q", maxTagKeyLength, to)
+		}
+		for other, key := range copies {
+			if key == to {
+				return nil, fmt.Errorf("instance tags %q and %q are both copied to %q", other, from, to)
+			}
+		}
+		copies[from] = to
+	}
+	return copies, nil
+}
+
+// InstanceTags returns the tags to put on the queue for the instance tags named
+// in copies, keyed by the queue tag key. Tags are read from instance metadata,
+// which costs nothing, falling back to the EC2 API when instance tags aren't in
+// metadata. Instance tags that aren't set are left out.
+func InstanceTags(ctx context.Context, metadata MetadataClient, ec2Client EC2Client, instanceID string, copies map[string]string) (map[string]string, error) {
+	if len(copies) == 0 {
+		return nil, nil
+	}
+	tags := map[string]string{}
+	if keys, err := metadataValue(ctx, metadata, instanceTagsPath); err == nil {
+		for _, key := range strings.Fields(keys) {
+			to, ok := copies[key]
+			if !ok {
+				continue
+			}
+			value, err := metadataValue(ctx, metadata, instanceTagsPath+"/"+key)
+			if err != nil {
+				return nil, fmt.Errorf("read instance tag %s: %w", key, err)
+			}
+			tags[to] = value
+		}
+		return tags, nil
+	}
+
+	keys := make([]string, 0, len(copies))
+	for key := range copies {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	paginator := ec2.NewDescribeTagsPaginator(ec2Client, &ec2.DescribeTagsInput{
+		Filters: []ec2types.Filter{
+			{Name: aws.String("resource-id"), Values: []string{instanceID}},
+			{Name: aws.String("key"), Values: keys},
+		},
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describe instance tags: %w", err)
+		}
+		for _, tag := range out.Tags {
+			if to, ok := copies[aws.ToString(tag.Key)]; ok {
+				tags[to] = aws.ToString(tag.Value)
+			}
+		}
+	}
+	return tags, nil
+}
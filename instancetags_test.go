@@ -0,0 +1,117 @@
+package lifecycled
+
+import (
+	"context"
+	"io"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// pathMetadataClient serves instance metadata by path, and a 404 for any
+// other path.
+type pathMetadataClient map[string]string
+
+func (c pathMetadataClient) GetMetadata(_ context.Context, in *imds.GetMetadataInput, _ ...func(*imds.Options)) (*imds.GetMetadataOutput, error) {
+	value, ok := c[in.Path]
+	if !ok {
+		return nil, notFoundError{}
+	}
+	return &imds.GetMetadataOutput{Content: io.NopCloser(strings.NewReader(value))}, nil
+}
+
+// stubEC2Client returns tags, recording the filters it was called with.
+type stubEC2Client struct {
+	tags    []ec2types.TagDescription
+	filters []ec2types.Filter
+}
+
+func (c *stubEC2Client) DescribeTags(_ context.Context, in *ec2.DescribeTagsInput, _ ...func(*ec2.Options)) (*ec2.DescribeTagsOutput, error) {
+	c.filters = in.Filters
+	return &ec2.DescribeTagsOutput{Tags: c.tags}, nil
+}
+
+func TestParseCopyTags(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{input: "", want: map[string]string{}},
+		{input: "Team, CostCenter", want: map[string]string{"Team": "Team", "CostCenter": "CostCenter"}},
+		{input: "aws:autoscaling:groupName=AutoScalingGroup", want: map[string]string{"aws:autoscaling:groupName": "AutoScalingGroup"}},
+		{input: "aws:autoscaling:groupName", want: map[string]string{"aws:autoscaling:groupName": "autoscaling:groupName"}},
+		{input: "Team=aws:team", wantErr: true},
+		{input: "=Team", wantErr: true},
+		{input: "Team=Owner,Owner", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := ParseCopyTags(tc.input)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseCopyTags returned %v, want error %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && !maps.Equal(got, tc.want) {
+				t.Errorf("ParseCopyTags = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInstanceTags(t *testing.T) {
+	copies := map[string]string{"aws:autoscaling:groupName": "AutoScalingGroup", "Team": "Team", "CostCenter": "CostCenter"}
+	want := map[string]string{"AutoScalingGroup": "agents", "Team": "platform"}
+
+	t.Run("from instance metadata", func(t *testing.T) {
+		metadata := pathMetadataClient{
+			"tags/instance":                           "Name\naws:autoscaling:groupName\nTeam",
+			"tags/instance/Name":                      "agent",
+			"tags/instance/aws:autoscaling:groupName": "agents",
+			"tags/instance/Team":                      "platform",
+		}
+		got, err := InstanceTags(context.Background(), metadata, nil, "i-1", copies)
+		if err != nil {
+			t.Fatalf("InstanceTags returned %v", err)
+		}
+		if !maps.Equal(got, want) {
+			t.Errorf("InstanceTags = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("from the ec2 api", func(t *testing.T) {
+		ec2Client := &stubEC2Client{tags: []ec2types.TagDescription{
+			{Key: aws.String("aws:autoscaling:groupName"), Value: aws.String("agents")},
+			{Key: aws.String("Team"), Value: aws.String("platform")},
+		}}
+		got, err := InstanceTags(context.Background(), pathMetadataClient{}, ec2Client, "i-1", copies)
+		if err != nil {
+			t.Fatalf("InstanceTags returned %v", err)
+		}
+		if !maps.Equal(got, want) {
+			t.Errorf("InstanceTags = %v, want %v", got, want)
+		}
+		if len(ec2Client.filters) != 2 || ec2Client.filters[0].Values[0] != "i-1" || len(ec2Client.filters[1].Values) != 3 {
+			t.Errorf("DescribeTags filters = %+v, want the instance and the copied keys", ec2Client.filters)
+		}
+	})
+}
+
+// Configured tags take precedence over tags copied from the instance.
+func TestQueueTags(t *testing.T) {
+	queue := NewQueue("q", "topic", nil, nil, "Team=override,Env=prod")
+	queue.instanceTags = map[string]string{"Team": "platform", "AutoScalingGroup": "agents"}
+
+	got, err := queue.queueTags()
+	if err != nil {
+		t.Fatalf("queueTags returned %v", err)
+	}
+	want := map[string]string{"Team": "override", "Env": "prod", "AutoScalingGroup": "agents"}
+	if !maps.Equal(got, want) {
+		t.Errorf("queueTags = %v, want %v", got, want)
+	}
+}
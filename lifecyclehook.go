@@ -0,0 +1,104 @@
+package lifecycled
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultHeartbeatInterval is used when no interval is configured and the
+	// hook's heartbeat timeout can't be looked up. It suits the shortest timeout
+	// a hook accepts (30s).
+	defaultHeartbeatInterval = 10 * time.Second
+
+	// heartbeatsPerTimeout is how many heartbeats are sent per heartbeat timeout,
+	// so a single failed heartbeat doesn't let the hook time out.
+	heartbeatsPerTimeout = 3
+
+	// maxGlobalTimeout is the longest an instance can remain in a wait state,
+	// whatever the hook's heartbeat timeout.
+	maxGlobalTimeout = 48 * time.Hour
+
+	// globalTimeoutWarning is how long before the global timeout the handler is
+	// warned about, capped at a tenth of the timeout for short-lived hooks.
+	globalTimeoutWarning = 5 * time.Minute
+)
+
+// lifecycleTiming is the heartbeat interval and the absolute deadline that apply
+// to a lifecycle action. A zero deadline means it couldn't be determined.
+type lifecycleTiming struct {
+	interval time.Duration
+	deadline time.Time
+	global   time.Duration
+}
+
+// warnAt returns when to warn that the handler is close to the deadline.
+func (t lifecycleTiming) warnAt() time.Time {
+	return t.deadline.Add(-min(globalTimeoutWarning, t.global/10))
+}
+
+// lifecycleTiming looks up the notice's lifecycle hooks and derives a heartbeat
+// interval that keeps every one of them alive, along with the global deadline
+// after which the group moves on regardless of heartbeats. A configured
+// interval is kept unless it is too long for a hook's heartbeat timeout.
+func (n *autoscalingTerminationNotice) lifecycleTiming(ctx context.Context, log *logrus.Entry) lifecycleTiming {
+	timing := lifecycleTiming{interval: n.heartbeatInterval}
+
+	ctx, cancel := context.WithTimeout(ctx, awsActionTimeout)
+	defer cancel()
+
+	for _, m := range n.messages {
+		log := log.WithField("hook", m.HookName)
+		out, err := n.autoscaling.DescribeLifecycleHooks(ctx, &autoscaling.DescribeLifecycleHooksInput{
+			AutoScalingGroupName: aws.String(m.GroupName),
+			LifecycleHookNames:   []string{m.HookName},
+		})
+		if err != nil {
+			log.WithError(err).Warn("Failed to describe lifecycle hook")
+			continue
+		}
+		if len(out.LifecycleHooks) == 0 {
+			log.Warn("Lifecycle hook not found")
+			continue
+		}
+		hook := out.LifecycleHooks[0]
+
+		heartbeatTimeout := time.Duration(aws.ToInt32(hook.HeartbeatTimeout)) * time.Second
+		if safe := heartbeatTimeout / heartbeatsPerTimeout; safe > 0 && (timing.interval == 0 || timing.interval > safe) {
+			if n.heartbeatInterval > safe {
+				log.WithFields(logrus.Fields{
+					"configured":       n.heartbeatInterval.String(),
+					"heartbeatTimeout": heartbeatTimeout.String(),
+				}).Warn("Heartbeat interval is too long for the lifecycle hook, shortening it")
+			}
+			timing.interval = safe
+		}
+
+		global := time.Duration(aws.ToInt32(hook.GlobalTimeout)) * time.Second
+		if global == 0 {
+			global = min(maxGlobalTimeout, 100*heartbeatTimeout)
+		}
+		if global == 0 {
+			continue
+		}
+		// The action started when the notification was sent; a message without
+		// a time is timed from now.
+		start := m.Time
+		if start.IsZero() {
+			start = time.Now()
+		}
+		if deadline := start.Add(global); timing.deadline.IsZero() || deadline.Before(timing.deadline) {
+			timing.deadline = deadline
+			timing.global = global
+		}
+	}
+
+	if timing.interval == 0 {
+		timing.interval = defaultHeartbeatInterval
+	}
+	return timing
+}
@@ -0,0 +1,129 @@
+package lifecycled
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	astypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestLifecycleTiming(t *testing.T) {
+	start := time.Date(2026, 6, 29, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		configured   time.Duration
+		hooks        []astypes.LifecycleHook
+		wantInterval time.Duration
+		wantDeadline time.Time
+		wantWarning  bool
+	}{
+		{
+			name:         "unknown hook falls back to the default interval",
+			wantInterval: defaultHeartbeatInterval,
+		},
+		{
+			name:         "interval is derived from the heartbeat timeout",
+			hooks:        []astypes.LifecycleHook{{HeartbeatTimeout: aws.Int32(300), GlobalTimeout: aws.Int32(30000)}},
+			wantInterval: 100 * time.Second,
+			wantDeadline: start.Add(30000 * time.Second),
+		},
+		{
+			name:         "a shorter configured interval is kept",
+			configured:   10 * time.Second,
+			hooks:        []astypes.LifecycleHook{{HeartbeatTimeout: aws.Int32(300), GlobalTimeout: aws.Int32(30000)}},
+			wantInterval: 10 * time.Second,
+			wantDeadline: start.Add(30000 * time.Second),
+		},
+		{
+			name:         "a configured interval too long for the hook is shortened",
+			configured:   10 * time.Minute,
+			hooks:        []astypes.LifecycleHook{{HeartbeatTimeout: aws.Int32(300), GlobalTimeout: aws.Int32(30000)}},
+			wantInterval: 100 * time.Second,
+			wantDeadline: start.Add(30000 * time.Second),
+			wantWarning:  true,
+		},
+		{
+			name:         "a missing global timeout is derived from the heartbeat timeout",
+			hooks:        []astypes.LifecycleHook{{HeartbeatTimeout: aws.Int32(7200)}},
+			wantInterval: 40 * time.Minute,
+			wantDeadline: start.Add(maxGlobalTimeout),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			notice := &autoscalingTerminationNotice{
+				messages:          []*Message{{GroupName: "group", HookName: "hook", InstanceID: "i-1", Time: start}},
+				autoscaling:       &stubAutoscalingClient{hooks: tc.hooks},
+				heartbeatInterval: tc.configured,
+			}
+			logger, hook := logrustest.NewNullLogger()
+
+			timing := notice.lifecycleTiming(context.Background(), logrus.NewEntry(logger))
+			if timing.interval != tc.wantInterval {
+				t.Errorf("interval = %s, want %s", timing.interval, tc.wantInterval)
+			}
+			if !timing.deadline.Equal(tc.wantDeadline) {
+				t.Errorf("deadline = %s, want %s", timing.deadline, tc.wantDeadline)
+			}
+			if got := logged(hook.AllEntries(), "Heartbeat interval is too long"); got != tc.wantWarning {
+				t.Errorf("logged a shortened interval = %v, want %v", got, tc.wantWarning)
+			}
+		})
+	}
+}
+
+// The warning fires a fixed margin before the deadline, or earlier in the
+// timeout's life for short timeouts.
+func TestLifecycleTimingWarnAt(t *testing.T) {
+	deadline := time.Date(2026, 6, 29, 12, 0, 0, 0, time.UTC)
+
+	long := lifecycleTiming{deadline: deadline, global: 48 * time.Hour}
+	if got, want := long.warnAt(), deadline.Add(-globalTimeoutWarning); !got.Equal(want) {
+		t.Errorf("warnAt = %s, want %s", got, want)
+	}
+	short := lifecycleTiming{deadline: deadline, global: 10 * time.Minute}
+	if got, want := short.warnAt(), deadline.Add(-time.Minute); !got.Equal(want) {
+		t.Errorf("warnAt = %s, want %s", got, want)
+	}
+}
+
+// deadlineHandler records the deadline of the context it was executed with.
+type deadlineHandler struct {
+	deadline    time.Time
+	hasDeadline bool
+}
+
+func (h *deadlineHandler) Execute(ctx context.Context, _ ...string) error {
+	h.deadline, h.hasDeadline = ctx.Deadline()
+	return nil
+}
+
+// The handler runs with the lifecycle action's global deadline.
+func TestAutoscalingNoticeHandlerDeadline(t *testing.T) {
+	start := time.Now()
+	notice := &autoscalingTerminationNotice{
+		noticeType: "autoscaling",
+		messages:   []*Message{{GroupName: "group", HookName: "hook", InstanceID: "i-1", ActionToken: "token", Time: start}},
+		autoscaling: &stubAutoscalingClient{hooks: []astypes.LifecycleHook{
+			{HeartbeatTimeout: aws.Int32(300), GlobalTimeout: aws.Int32(30000)},
+		}},
+	}
+	logger, _ := logrustest.NewNullLogger()
+
+	handler := &deadlineHandler{}
+	if err := notice.Handle(context.Background(), handler, logrus.NewEntry(logger)); err != nil {
+		t.Fatalf("Handle returned error: %v", err)
+	}
+	if !handler.hasDeadline {
+		t.Fatal("handler context had no deadline")
+	}
+	if want := start.Add(30000 * time.Second); !handler.deadline.Equal(want) {
+		t.Errorf("handler deadline = %s, want %s", handler.deadline, want)
+	}
+}
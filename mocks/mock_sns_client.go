@@ -41,6 +41,46 @@ func (m *MockSNSClient) EXPECT() *MockSNSClientMockRecorder {
 	return m.recorder
 }
 
+// ConfirmSubscription mocks base method.
+func (m *MockSNSClient) ConfirmSubscription(arg0 context.Context, arg1 *sns.ConfirmSubscriptionInput, arg2 ...func(*sns.Options)) (*sns.ConfirmSubscriptionOutput, error) {
+	m.ctrl.T.Helper()
+	varargs := []any{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "ConfirmSubscription", varargs...)
+	ret0, _ := ret[0].(*sns.ConfirmSubscriptionOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ConfirmSubscription indicates an expected call of ConfirmSubscription.
+func (mr *MockSNSClientMockRecorder) ConfirmSubscription(arg0, arg1 any, arg2 ...any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]any{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConfirmSubscription", reflect.TypeOf((*MockSNSClient)(nil).ConfirmSubscription), varargs...)
+}
+
+// GetSubscriptionAttributes mocks base method.
+func (m *MockSNSClient) GetSubscriptionAttributes(arg0 context.Context, arg1 *sns.GetSubscriptionAttributesInput, arg2 ...func(*sns.Options)) (*sns.GetSubscriptionAttributesOutput, error) {
+	m.ctrl.T.Helper()
+	varargs := []any{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "GetSubscriptionAttributes", varargs...)
+	ret0, _ := ret[0].(*sns.GetSubscriptionAttributesOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSubscriptionAttributes indicates an expected call of GetSubscriptionAttributes.
+func (mr *MockSNSClientMockRecorder) GetSubscriptionAttributes(arg0, arg1 any, arg2 ...any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]any{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSubscriptionAttributes", reflect.TypeOf((*MockSNSClient)(nil).GetSubscriptionAttributes), varargs...)
+}
+
 // Subscribe mocks base method.
 func (m *MockSNSClient) Subscribe(arg0 context.Context, arg1 *sns.SubscribeInput, arg2 ...func(*sns.Options)) (*sns.SubscribeOutput, error) {
 	m.ctrl.T.Helper()
@@ -41,6 +41,26 @@ func (m *MockSQSClient) EXPECT() *MockSQSClientMockRecorder {
 	return m.recorder
 }
 
+// ChangeMessageVisibilityBatch mocks base method.
+func (m *MockSQSClient) ChangeMessageVisibilityBatch(arg0 context.Context, arg1 *sqs.ChangeMessageVisibilityBatchInput, arg2 ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	m.ctrl.T.Helper()
+	varargs := []any{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "ChangeMessageVisibilityBatch", varargs...)
+	ret0, _ := ret[0].(*sqs.ChangeMessageVisibilityBatchOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ChangeMessageVisibilityBatch indicates an expected call of ChangeMessageVisibilityBatch.
+func (mr *MockSQSClientMockRecorder) ChangeMessageVisibilityBatch(arg0, arg1 any, arg2 ...any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]any{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChangeMessageVisibilityBatch", reflect.TypeOf((*MockSQSClient)(nil).ChangeMessageVisibilityBatch), varargs...)
+}
+
 // CreateQueue mocks base method.
 func (m *MockSQSClient) CreateQueue(arg0 context.Context, arg1 *sqs.CreateQueueInput, arg2 ...func(*sqs.Options)) (*sqs.CreateQueueOutput, error) {
 	m.ctrl.T.Helper()
@@ -81,6 +101,26 @@ func (mr *MockSQSClientMockRecorder) DeleteMessage(arg0, arg1 any, arg2 ...any)
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMessage", reflect.TypeOf((*MockSQSClient)(nil).DeleteMessage), varargs...)
 }
 
+// DeleteMessageBatch mocks base method.
+func (m *MockSQSClient) DeleteMessageBatch(arg0 context.Context, arg1 *sqs.DeleteMessageBatchInput, arg2 ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	m.ctrl.T.Helper()
+	varargs := []any{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "DeleteMessageBatch", varargs...)
+	ret0, _ := ret[0].(*sqs.DeleteMessageBatchOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteMessageBatch indicates an expected call of DeleteMessageBatch.
+func (mr *MockSQSClientMockRecorder) DeleteMessageBatch(arg0, arg1 any, arg2 ...any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]any{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMessageBatch", reflect.TypeOf((*MockSQSClient)(nil).DeleteMessageBatch), varargs...)
+}
+
 // DeleteQueue mocks base method.
 func (m *MockSQSClient) DeleteQueue(arg0 context.Context, arg1 *sqs.DeleteQueueInput, arg2 ...func(*sqs.Options)) (*sqs.DeleteQueueOutput, error) {
 	m.ctrl.T.Helper()
@@ -121,6 +161,26 @@ func (mr *MockSQSClientMockRecorder) GetQueueAttributes(arg0, arg1 any, arg2 ...
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetQueueAttributes", reflect.TypeOf((*MockSQSClient)(nil).GetQueueAttributes), varargs...)
 }
 
+// GetQueueUrl mocks base method.
+func (m *MockSQSClient) GetQueueUrl(arg0 context.Context, arg1 *sqs.GetQueueUrlInput, arg2 ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+	m.ctrl.T.Helper()
+	varargs := []any{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "GetQueueUrl", varargs...)
+	ret0, _ := ret[0].(*sqs.GetQueueUrlOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetQueueUrl indicates an expected call of GetQueueUrl.
+func (mr *MockSQSClientMockRecorder) GetQueueUrl(arg0, arg1 any, arg2 ...any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]any{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetQueueUrl", reflect.TypeOf((*MockSQSClient)(nil).GetQueueUrl), varargs...)
+}
+
 // ReceiveMessage mocks base method.
 func (m *MockSQSClient) ReceiveMessage(arg0 context.Context, arg1 *sqs.ReceiveMessageInput, arg2 ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
 	m.ctrl.T.Helper()
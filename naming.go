@@ -0,0 +1,155 @@
+package lifecycled
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultQueuePrefix is what {prefix} stands for unless configured.
+	DefaultQueuePrefix = "lifecycled"
+
+	// DefaultQueueNameTemplate names a queue after the instance it belongs to.
+	DefaultQueueNameTemplate = "{prefix}-{instance_id}"
+
+	// maxQueueNameLength is the longest queue name SQS accepts.
+	maxQueueNameLength = 80
+)
+
+var (
+	// queuePlaceholder matches a placeholder in a queue name template.
+	queuePlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+
+	// invalidQueueNameChars matches what SQS doesn't allow in a queue name.
+	invalidQueueNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+)
+
+// QueueNaming names the queues lifecycled creates from a template, in which
+// {prefix} stands for Prefix, {instance_id} for the instance id and {asg} for
+// the name of the instance's autoscaling group. lifecycled-queue-cleaner parses
+// names with the same template, so it can tell which instance a queue belongs
+// to. The zero value uses the defaults.
+type QueueNaming struct {
+	Template string
+	Prefix   string
+
+	// Queues is how many queues each instance has, one per SNS topic with
+	// --sns-queue-per-topic. Those after the first are suffixed -2, -3 and so
+	// on, and Name checks the longest of them fits.
+	Queues int
+}
+
+func (n QueueNaming) withDefaults() QueueNaming {
+	if n.Template == "" {
+		n.Template = DefaultQueueNameTemplate
+	}
+	if n.Prefix == "" {
+		n.Prefix = DefaultQueuePrefix
+	}
+	return n
+}
+
+// Validate returns an error if the template has an unknown placeholder, or no
+// {instance_id} to keep each instance's queue apart, or no fixed start to list
+// the queues by, or if the prefix has characters a queue name can't.
+func (n QueueNaming) Validate() error {
+	n = n.withDefaults()
+	if invalidQueueNameChars.MatchString(n.Prefix) {
+		return fmt.Errorf("queue prefix %q may only contain letters, digits, hyphens and underscores", n.Prefix)
+	}
+	for _, p := range queuePlaceholder.FindAllString(n.Template, -1) {
+		switch p {
+		case "{prefix}", "{instance_id}", "{asg}":
+		default:
+			return fmt.Errorf("unknown placeholder %s in queue name template %q", p, n.Template)
+		}
+	}
+	if !strings.Contains(n.Template, "{instance_id}") {
+		return fmt.Errorf("queue name template %q must contain {instance_id}", n.Template)
+	}
+	// The queue cleaner lists queues by the fixed start of their names, and with
+	// none it would list, and match against, every queue in the account.
+	if n.ListPrefix() == "" {
+		return fmt.Errorf("queue name template %q must start with {prefix} or literal text", n.Template)
+	}
+	literal := queuePlaceholder.ReplaceAllString(n.Template, "")
+	if invalidQueueNameChars.MatchString(literal) {
+		return fmt.Errorf("queue name template %q may only contain letters, digits, hyphens and underscores", n.Template)
+	}
+	return nil
+}
+
+// UsesGroup reports whether names include the autoscaling group.
+func (n QueueNaming) UsesGroup() bool {
+	return strings.Contains(n.withDefaults().Template, "{asg}")
+}
+
+// Name returns the queue name for an instance in group. Characters of the group
+// name that a queue name can't contain are replaced with hyphens.
+func (n QueueNaming) Name(instanceID, group string) (string, error) {
+	if err := n.Validate(); err != nil {
+		return "", err
+	}
+	n = n.withDefaults()
+	if n.UsesGroup() && group == "" {
+		return "", errors.New("queue name template uses {asg}, but the autoscaling group is not known")
+	}
+	name := strings.NewReplacer(
+		"{prefix}", n.Prefix,
+		"{instance_id}", instanceID,
+		"{asg}", invalidQueueNameChars.ReplaceAllString(group, "-"),
+	).Replace(n.Template)
+	if longest := name + queueSuffix(n.Queues-1); len(longest) > maxQueueNameLength {
+		return "", fmt.Errorf("queue name %q is longer than %d characters", longest, maxQueueNameLength)
+	}
+	return name, nil
+}
+
+// queueSuffix returns the suffix of an instance's i'th queue, counting from 0:
+// none for the first, so a single queue is named the same either way.
+func queueSuffix(i int) string {
+	if i <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("-%d", i+1)
+}
+
+// ListPrefix returns the fixed start of every queue name, for listing them.
+func (n QueueNaming) ListPrefix() string {
+	n = n.withDefaults()
+	template := strings.ReplaceAll(n.Template, "{prefix}", n.Prefix)
+	if i := strings.Index(template, "{"); i >= 0 {
+		return template[:i]
+	}
+	return template
+}
+
+// Pattern returns a regular expression that matches a whole queue name, with or
+// without the numeric suffix of a queue per SNS topic, capturing the instance
+// id in its first group.
+func (n QueueNaming) Pattern() (*regexp.Regexp, error) {
+	if err := n.Validate(); err != nil {
+		return nil, err
+	}
+	n = n.withDefaults()
+	var b strings.Builder
+	b.WriteString("^")
+	last := 0
+	for _, loc := range queuePlaceholder.FindAllStringIndex(n.Template, -1) {
+		b.WriteString(regexp.QuoteMeta(n.Template[last:loc[0]]))
+		switch n.Template[loc[0]:loc[1]] {
+		case "{prefix}":
+			b.WriteString(regexp.QuoteMeta(n.Prefix))
+		case "{instance_id}":
+			b.WriteString(`(i-[0-9A-Za-z]+)`)
+		case "{asg}":
+			b.WriteString(`[A-Za-z0-9_-]+`)
+		}
+		last = loc[1]
+	}
+	b.WriteString(regexp.QuoteMeta(n.Template[last:]))
+	b.WriteString(`(?:-\d+)?$`)
+	return regexp.Compile(b.String())
+}
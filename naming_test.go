@@ -0,0 +1,118 @@
+package lifecycled
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQueueNamingValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		naming  QueueNaming
+		wantErr string
+	}{
+		{name: "defaults", naming: QueueNaming{}},
+		{name: "group and suffix", naming: QueueNaming{Template: "{prefix}-{asg}-{instance_id}_term"}},
+		{name: "unknown placeholder", naming: QueueNaming{Template: "{prefix}-{region}-{instance_id}"}, wantErr: "unknown placeholder {region}"},
+		{name: "no instance id", naming: QueueNaming{Template: "{prefix}-{asg}"}, wantErr: "must contain {instance_id}"},
+		{name: "starts with a placeholder", naming: QueueNaming{Template: "{asg}-{instance_id}"}, wantErr: "must start with"},
+		{name: "starts with the instance id", naming: QueueNaming{Template: "{instance_id}-term"}, wantErr: "must start with"},
+		{name: "starts with literal text", naming: QueueNaming{Template: "term-{asg}-{instance_id}"}},
+		{name: "invalid literal", naming: QueueNaming{Template: "{prefix}.{instance_id}"}, wantErr: "may only contain"},
+		{name: "invalid prefix", naming: QueueNaming{Prefix: "my/prefix"}, wantErr: "queue prefix"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.naming.Validate()
+			if tc.wantErr == "" && err != nil {
+				t.Fatalf("Validate returned %v", err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Fatalf("Validate returned %v, want an error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestQueueNamingName(t *testing.T) {
+	tests := []struct {
+		name    string
+		naming  QueueNaming
+		group   string
+		want    string
+		wantErr bool
+	}{
+		{name: "defaults", want: "lifecycled-i-0123456789abcdef0"},
+		{name: "prefix", naming: QueueNaming{Prefix: "ci"}, want: "ci-i-0123456789abcdef0"},
+		{name: "group", naming: QueueNaming{Template: "{prefix}-{asg}-{instance_id}"}, group: "agents", want: "lifecycled-agents-i-0123456789abcdef0"},
+		{name: "group is sanitized", naming: QueueNaming{Template: "term-{asg}-{instance_id}"}, group: "ci agents.v2", want: "term-ci-agents-v2-i-0123456789abcdef0"},
+		{name: "group unknown", naming: QueueNaming{Template: "term-{asg}-{instance_id}"}, wantErr: true},
+		{name: "too long", naming: QueueNaming{Template: "term-{asg}-{instance_id}"}, group: strings.Repeat("a", 60), wantErr: true},
+		{name: "at the limit", naming: QueueNaming{Template: "term-{asg}-{instance_id}"}, group: strings.Repeat("a", 55), want: "term-" + strings.Repeat("a", 55) + "-i-0123456789abcdef0"},
+		{name: "too long with a queue per topic", naming: QueueNaming{Template: "term-{asg}-{instance_id}", Queues: 2}, group: strings.Repeat("a", 55), wantErr: true},
+		{name: "no fixed start", naming: QueueNaming{Template: "{asg}-{instance_id}"}, group: "agents", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.naming.Name("i-0123456789abcdef0", tc.group)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Name returned %v, want error %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("Name = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestQueueNamingListPrefix(t *testing.T) {
+	tests := []struct {
+		naming QueueNaming
+		want   string
+	}{
+		{naming: QueueNaming{}, want: "lifecycled-"},
+		{naming: QueueNaming{Prefix: "ci"}, want: "ci-"},
+		{naming: QueueNaming{Template: "{prefix}-{asg}-{instance_id}"}, want: "lifecycled-"},
+		{naming: QueueNaming{Template: "term-{instance_id}"}, want: "term-"},
+	}
+	for _, tc := range tests {
+		if got := tc.naming.ListPrefix(); got != tc.want {
+			t.Errorf("%+v ListPrefix = %q, want %q", tc.naming, got, tc.want)
+		}
+	}
+}
+
+// Pattern matches every name that Name returns for the same naming, including
+// the suffixed queues of a queue per topic, and captures the instance id.
+func TestQueueNamingPattern(t *testing.T) {
+	tests := []struct {
+		naming   QueueNaming
+		group    string
+		nonMatch []string
+	}{
+		{naming: QueueNaming{}, nonMatch: []string{"lifecycled-other", "other-lifecycled-i-1", "lifecycledxi-1"}},
+		{naming: QueueNaming{Prefix: "ci"}, nonMatch: []string{"lifecycled-i-1", "ci-i-"}},
+		{naming: QueueNaming{Template: "{prefix}-{asg}-{instance_id}-term"}, group: "agents", nonMatch: []string{"lifecycled-i-1", "lifecycled-agents-i-1"}},
+	}
+	for _, tc := range tests {
+		pattern, err := tc.naming.Pattern()
+		if err != nil {
+			t.Fatalf("%+v Pattern returned %v", tc.naming, err)
+		}
+		name, err := tc.naming.Name("i-0123456789abcdef0", tc.group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []string{name, name + "-2"} {
+			m := pattern.FindStringSubmatch(n)
+			if len(m) != 2 || m[1] != "i-0123456789abcdef0" {
+				t.Errorf("%s matched %q, want the instance id captured", pattern, m)
+			}
+		}
+		for _, n := range tc.nonMatch {
+			if pattern.MatchString(n) {
+				t.Errorf("%s matched %q", pattern, n)
+			}
+		}
+	}
+}
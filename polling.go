@@ -0,0 +1,187 @@
+package lifecycled
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// terminatingWait is the lifecycle state of an instance held by a termination
+	// lifecycle hook.
+	terminatingWait = "Terminating:Wait"
+
+	// terminatingTransition is the lifecycle transition of a termination hook.
+	terminatingTransition = "autoscaling:EC2_INSTANCE_TERMINATING"
+)
+
+// NewPollingListener returns a listener that detects termination by polling the
+// instance's lifecycle state, for when a per-instance queue isn't an option.
+func NewPollingListener(instanceID string, autoscaling AutoscalingClient, interval, heartbeatInterval time.Duration) *PollingListener {
+	return &PollingListener{
+		listenerType:      "autoscaling-polling",
+		instanceID:        instanceID,
+		autoscaling:       autoscaling,
+		interval:          interval,
+		heartbeatInterval: heartbeatInterval,
+	}
+}
+
+// PollingListener watches the instance's Auto Scaling lifecycle state with
+// DescribeAutoScalingInstances. It needs no SNS topic or SQS queue, at the cost
+// of noticing termination up to one interval late and of calling the Auto
+// Scaling API from every instance.
+type PollingListener struct {
+	listenerType      string
+	instanceID        string
+	autoscaling       AutoscalingClient
+	interval          time.Duration
+	heartbeatInterval time.Duration
+
+	// hookName, when set, is the termination hook completed; otherwise the
+	// group's one termination hook is.
+	hookName string
+}
+
+// Type returns a string describing the listener type.
+func (l *PollingListener) Type() string {
+	return l.listenerType
+}
+
+// Start the lifecycle state polling listener.
+func (l *PollingListener) Start(ctx context.Context, notices chan<- TerminationNotice, log *logrus.Entry) error {
+	// Look the instance up once so we fail fast when it isn't in a group.
+	group, _, err := describeLifecycleState(ctx, l.autoscaling, l.instanceID)
+	if err != nil {
+		return err
+	}
+	if group == "" {
+		return fmt.Errorf("instance %s is not part of an autoscaling group", l.instanceID)
+	}
+	log = log.WithField("group", group)
+	// Without a hook name, fail now rather than at termination if the group
+	// has more than one termination hook.
+	if l.hookName == "" {
+		if _, err := terminationHooks(ctx, l.autoscaling, group, l.instanceID, ""); errors.Is(err, errSeveralTerminationHooks) {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			log.Debug("Polling autoscaling for the instance's lifecycle state")
+
+			group, state, err := describeLifecycleState(ctx, l.autoscaling, l.instanceID)
+			if err != nil {
+				// Shutting down: the next loop iteration returns via ctx.Done().
+				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+					continue
+				}
+				// Poll no sooner than the failure's class calls for.
+				ticker.Reset(max(l.interval, logPollError(log, err, "Failed to get lifecycle state")))
+				continue
+			}
+			ticker.Reset(l.interval)
+			if state != terminatingWait {
+				continue
+			}
+			log.WithField("state", state).Info("Instance is waiting on a termination lifecycle hook")
+
+			messages, err := terminationHooks(ctx, l.autoscaling, group, l.instanceID, l.hookName)
+			if errors.Is(err, errSeveralTerminationHooks) {
+				log.WithError(err).Error("Can't tell which termination lifecycle hook is lifecycled's, none will be heartbeated or completed")
+				notices <- &targetLifecycleNotice{noticeType: l.Type(), instanceID: l.instanceID}
+				return nil
+			}
+			if err != nil {
+				ticker.Reset(max(l.interval, logPollError(log, err, "Failed to describe termination lifecycle hooks")))
+				continue
+			}
+			if len(messages) == 0 {
+				log.Error("No termination lifecycle hooks found for the group")
+				continue
+			}
+			notices <- &autoscalingTerminationNotice{
+				noticeType:        l.Type(),
+				messages:          messages,
+				autoscaling:       l.autoscaling,
+				heartbeatInterval: l.heartbeatInterval,
+			}
+			return nil
+		}
+	}
+}
+
+// describeLifecycleState returns the instance's group and lifecycle state. The
+// group is empty if the instance isn't part of one.
+func describeLifecycleState(ctx context.Context, client AutoscalingClient, instanceID string) (string, string, error) {
+	out, err := client.DescribeAutoScalingInstances(ctx, &autoscaling.DescribeAutoScalingInstancesInput{
+		InstanceIds: []string{instanceID},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if len(out.AutoScalingInstances) == 0 {
+		return "", "", nil
+	}
+	instance := out.AutoScalingInstances[0]
+	return aws.ToString(instance.AutoScalingGroupName), aws.ToString(instance.LifecycleState), nil
+}
+
+// errSeveralTerminationHooks is a group having more than one termination hook
+// when no hook name is configured. Others may belong to other systems, and
+// completing them early would cut those systems short.
+var errSeveralTerminationHooks = errors.New("the group has several termination hooks, set --autoscaling-hook-name to the one lifecycled owns")
+
+// terminationHooks returns a message for the named hook, or when hookName is
+// empty for the group's one termination hook. Without a notification the
+// lifecycle action token isn't known, so the messages carry none and the actions
+// are heartbeated and completed by instance id. The action started shortly
+// before it was noticed, so it is timed from now.
+func terminationHooks(ctx context.Context, client AutoscalingClient, group, instanceID, hookName string) ([]*Message, error) {
+	message := func(hook string) *Message {
+		return &Message{
+			Time:       time.Now(),
+			GroupName:  group,
+			InstanceID: instanceID,
+			Transition: terminatingTransition,
+			HookName:   hook,
+		}
+	}
+	if hookName != "" {
+		return []*Message{message(hookName)}, nil
+	}
+
+	out, err := client.DescribeLifecycleHooks(ctx, &autoscaling.DescribeLifecycleHooksInput{
+		AutoScalingGroupName: aws.String(group),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, hook := range out.LifecycleHooks {
+		if aws.ToString(hook.LifecycleTransition) == terminatingTransition {
+			names = append(names, aws.ToString(hook.LifecycleHookName))
+		}
+	}
+	switch len(names) {
+	case 0:
+		return nil, nil
+	case 1:
+		return []*Message{message(names[0])}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errSeveralTerminationHooks, strings.Join(names, ", "))
+	}
+}
@@ -0,0 +1,176 @@
+package lifecycled
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	astypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/smithy-go"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// pollingASGClient reports the lifecycle states in turn, repeating the last one,
+// and records the lifecycle actions it is asked to complete.
+type pollingASGClient struct {
+	stubAutoscalingClient
+	group  string
+	states []string
+
+	mu        sync.Mutex
+	completed []*autoscaling.CompleteLifecycleActionInput
+}
+
+func (c *pollingASGClient) DescribeAutoScalingInstances(context.Context, *autoscaling.DescribeAutoScalingInstancesInput, ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+	if c.group == "" {
+		return &autoscaling.DescribeAutoScalingInstancesOutput{}, nil
+	}
+	c.mu.Lock()
+	state := c.states[0]
+	if len(c.states) > 1 {
+		c.states = c.states[1:]
+	}
+	c.mu.Unlock()
+	return &autoscaling.DescribeAutoScalingInstancesOutput{
+		AutoScalingInstances: []astypes.AutoScalingInstanceDetails{{
+			AutoScalingGroupName: aws.String(c.group),
+			InstanceId:           aws.String("i-1"),
+			LifecycleState:       aws.String(state),
+		}},
+	}, nil
+}
+
+func (c *pollingASGClient) CompleteLifecycleAction(_ context.Context, in *autoscaling.CompleteLifecycleActionInput, _ ...func(*autoscaling.Options)) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.completed = append(c.completed, in)
+	return &autoscaling.CompleteLifecycleActionOutput{}, nil
+}
+
+// Once the instance is held in Terminating:Wait, the listener emits a notice for
+// each of the group's termination hooks, and the actions are completed by
+// instance id since polling never sees a lifecycle action token.
+func TestPollingListenerEmitsNoticeOnTerminatingWait(t *testing.T) {
+	as := &pollingASGClient{
+		stubAutoscalingClient: stubAutoscalingClient{hooks: []astypes.LifecycleHook{
+			{LifecycleHookName: aws.String("launch"), LifecycleTransition: aws.String("autoscaling:EC2_INSTANCE_LAUNCHING")},
+			{LifecycleHookName: aws.String("drain"), LifecycleTransition: aws.String(terminatingTransition)},
+		}},
+		group:  "group",
+		states: []string{"InService", "InService", terminatingWait},
+	}
+	listener := NewPollingListener("i-1", as, time.Millisecond, time.Minute)
+	logger, _ := logrustest.NewNullLogger()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	notices := make(chan TerminationNotice, 1)
+	if err := listener.Start(ctx, notices, logrus.NewEntry(logger)); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	var notice TerminationNotice
+	select {
+	case notice = <-notices:
+	default:
+		t.Fatal("expected a termination notice")
+	}
+	if err := notice.Handle(ctx, &countingHandler{}, logrus.NewEntry(logger)); err != nil {
+		t.Fatalf("Handle returned error: %v", err)
+	}
+
+	if len(as.completed) != 1 {
+		t.Fatalf("completed %d lifecycle actions, want 1", len(as.completed))
+	}
+	got := as.completed[0]
+	if aws.ToString(got.LifecycleHookName) != "drain" || aws.ToString(got.InstanceId) != "i-1" {
+		t.Errorf("completed hook %q for %q, want drain for i-1", aws.ToString(got.LifecycleHookName), aws.ToString(got.InstanceId))
+	}
+	if got.LifecycleActionToken != nil {
+		t.Errorf("completed with token %q, want none", aws.ToString(got.LifecycleActionToken))
+	}
+}
+
+// Other termination hooks may belong to other systems, so without a hook name
+// the listener won't start rather than complete them all.
+func TestPollingListenerRequiresHookNameForSeveralHooks(t *testing.T) {
+	as := &pollingASGClient{
+		stubAutoscalingClient: stubAutoscalingClient{hooks: []astypes.LifecycleHook{
+			{LifecycleHookName: aws.String("drain"), LifecycleTransition: aws.String(terminatingTransition)},
+			{LifecycleHookName: aws.String("log-archiver"), LifecycleTransition: aws.String(terminatingTransition)},
+		}},
+		group:  "group",
+		states: []string{"InService"},
+	}
+	listener := NewPollingListener("i-1", as, time.Millisecond, time.Minute)
+	logger, _ := logrustest.NewNullLogger()
+
+	err := listener.Start(context.Background(), make(chan TerminationNotice, 1), logrus.NewEntry(logger))
+	if !errors.Is(err, errSeveralTerminationHooks) || !strings.Contains(err.Error(), "drain, log-archiver") {
+		t.Errorf("Start returned %v, want an error naming both hooks", err)
+	}
+
+	listener.hookName = "drain"
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := listener.Start(ctx, make(chan TerminationNotice, 1), logrus.NewEntry(logger)); err != nil {
+		t.Errorf("Start with a hook name returned %v", err)
+	}
+}
+
+func TestPollingListenerFailsOutsideAGroup(t *testing.T) {
+	listener := NewPollingListener("i-1", &pollingASGClient{}, time.Millisecond, time.Minute)
+	logger, _ := logrustest.NewNullLogger()
+
+	if err := listener.Start(context.Background(), make(chan TerminationNotice, 1), logrus.NewEntry(logger)); err == nil {
+		t.Fatal("expected an error for an instance that isn't in an autoscaling group")
+	}
+}
+
+// deniedASGClient finds the instance's group, then is denied every later
+// lifecycle state lookup.
+type deniedASGClient struct {
+	pollingASGClient
+	calls int
+}
+
+func (c *deniedASGClient) DescribeAutoScalingInstances(ctx context.Context, in *autoscaling.DescribeAutoScalingInstancesInput, opts ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+	c.mu.Lock()
+	c.calls++
+	calls := c.calls
+	c.mu.Unlock()
+	if calls > 1 {
+		return nil, &smithy.GenericAPIError{Code: "AccessDenied"}
+	}
+	return c.pollingASGClient.DescribeAutoScalingInstances(ctx, in, opts...)
+}
+
+// A failed poll is logged at its class's level, and the next waits for the
+// class's backoff rather than the polling interval.
+func TestPollingListenerBacksOffOnError(t *testing.T) {
+	as := &deniedASGClient{pollingASGClient: pollingASGClient{group: "group", states: []string{"InService"}}}
+	listener := NewPollingListener("i-1", as, time.Millisecond, time.Minute)
+	logger, logs := logrustest.NewNullLogger()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := listener.Start(ctx, make(chan TerminationNotice, 1), logrus.NewEntry(logger)); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	if !loggedAt(logs.AllEntries(), logrus.ErrorLevel, "Failed to get lifecycle state") {
+		t.Errorf("expected the denied lookup logged as an error, got %v", messages(logs.AllEntries()))
+	}
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.calls != 2 {
+		t.Errorf("looked up the lifecycle state %d times, want 2: the group, then one denied poll", as.calls)
+	}
+}
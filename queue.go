@@ -2,37 +2,51 @@ package lifecycled
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
 )
 
 const (
 	longPollingWaitTimeSeconds = 20
-	queuePolicy                = `
-{
-  "Version":"2012-10-17",
-  "Statement":[
-    {
-      "Effect":"Allow",
-      "Principal":"*",
-      "Action":"sqs:SendMessage",
-      "Resource":"*",
-      "Condition":{
-        "ArnEquals":{
-          "aws:SourceArn":"%s"
-        }
-      }
-    }
-  ]
-}
-`
+
+	// messageVisibilityTimeout hides a received message from other receives while
+	// it is being processed. A message that isn't deleted in that time (because
+	// the daemon crashed before acknowledging it) is delivered again.
+	messageVisibilityTimeout = 60
+
+	// releaseVisibility is how many seconds a message released for another
+	// consumer stays hidden, just long enough that the releasing daemon's next
+	// poll doesn't receive it straight back. It is kept short and constant, since
+	// on a shared queue a notice may be received by many daemons before its own.
+	releaseVisibility = 1
+
+	// A daemon whose batches hold only messages released for other consumers
+	// waits before polling again, from releaseBackoffMin doubling up to
+	// releaseBackoffMax, so a message nobody claims, because its instance is
+	// gone, doesn't keep every daemon sharing the queue busy.
+	releaseBackoffMin = time.Second
+	releaseBackoffMax = 10 * time.Second
+
+	// maxBatchEntries is the most entries SQS accepts in a single batch request.
+	maxBatchEntries = 10
+
+	// SQS accepts a message retention period between a minute and 14 days.
+	minMessageRetention = time.Minute
+	maxMessageRetention = 14 * 24 * time.Hour
 )
 
 // SQSClient is the subset of the SQS API used by the daemon.
@@ -41,8 +55,11 @@ const (
 type SQSClient interface {
 	CreateQueue(context.Context, *sqs.CreateQueueInput, ...func(*sqs.Options)) (*sqs.CreateQueueOutput, error)
 	GetQueueAttributes(context.Context, *sqs.GetQueueAttributesInput, ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error)
+	GetQueueUrl(context.Context, *sqs.GetQueueUrlInput, ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error)
 	ReceiveMessage(context.Context, *sqs.ReceiveMessageInput, ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
 	DeleteMessage(context.Context, *sqs.DeleteMessageInput, ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+	DeleteMessageBatch(context.Context, *sqs.DeleteMessageBatchInput, ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error)
+	ChangeMessageVisibilityBatch(context.Context, *sqs.ChangeMessageVisibilityBatchInput, ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error)
 	DeleteQueue(context.Context, *sqs.DeleteQueueInput, ...func(*sqs.Options)) (*sqs.DeleteQueueOutput, error)
 }
 
@@ -52,16 +69,49 @@ type SQSClient interface {
 type SNSClient interface {
 	Subscribe(context.Context, *sns.SubscribeInput, ...func(*sns.Options)) (*sns.SubscribeOutput, error)
 	Unsubscribe(context.Context, *sns.UnsubscribeInput, ...func(*sns.Options)) (*sns.UnsubscribeOutput, error)
+	GetSubscriptionAttributes(context.Context, *sns.GetSubscriptionAttributesInput, ...func(*sns.Options)) (*sns.GetSubscriptionAttributesOutput, error)
+	ConfirmSubscription(context.Context, *sns.ConfirmSubscriptionInput, ...func(*sns.Options)) (*sns.ConfirmSubscriptionOutput, error)
 }
 
 // Queue manages the SQS queue and SNS subscription.
 type Queue struct {
-	name            string
-	url             string
-	arn             string
-	topicArn        string
-	subscriptionArn string
-	tags            string
+	name string
+	url  string
+	arn  string
+	tags string
+
+	// instanceTags are tags copied from the instance, which tags overrides.
+	instanceTags map[string]string
+
+	// topicArns are the SNS topics the queue is subscribed to, and
+	// subscriptionArns its subscriptions to them, by topic.
+	topicArns        []string
+	subscriptionArns map[string]string
+
+	// instanceID, when set, limits the subscription to this instance's events
+	// with a filter policy, so the queue doesn't receive a copy of every event
+	// for the topic.
+	instanceID string
+
+	// rawDelivery subscribes with raw message delivery, so message bodies are
+	// the autoscaling messages themselves rather than SNS envelopes.
+	rawDelivery bool
+
+	// policyTopicArns are further topics, beyond topicArns, that the queue policy
+	// lets send to the queue.
+	policyTopicArns []string
+
+	// managedSSE encrypts the queue with SQS managed keys, and kmsKeyID, which
+	// takes precedence, with a KMS key.
+	managedSSE bool
+	kmsKeyID   string
+
+	// messageRetention, when set, is how long the queue keeps a message.
+	messageRetention time.Duration
+
+	// existing is set for a queue provisioned outside lifecycled, which may be
+	// shared with other consumers: it is never created, subscribed or deleted.
+	existing bool
 
 	sqsClient SQSClient
 	snsClient SNSClient
@@ -70,27 +120,43 @@ type Queue struct {
 // NewQueue returns a new... Queue.
 func NewQueue(queueName, topicArn string, sqsClient SQSClient, snsClient SNSClient, tags string) *Queue {
 	return &Queue{
-		name:      queueName,
-		topicArn:  topicArn,
+		name:             queueName,
+		topicArns:        []string{topicArn},
+		subscriptionArns: map[string]string{},
+		sqsClient:        sqsClient,
+		snsClient:        snsClient,
+		tags:             tags,
+	}
+}
+
+// NewExistingQueue returns a Queue for a queue that was provisioned elsewhere.
+// It is read from but never created, subscribed or deleted.
+func NewExistingQueue(queueURL string, sqsClient SQSClient) *Queue {
+	return &Queue{
+		name:      path.Base(queueURL),
+		url:       queueURL,
 		sqsClient: sqsClient,
-		snsClient: snsClient,
-		tags:      tags,
+		existing:  true,
 	}
 }
 
 // Create the SQS queue.
 func (q *Queue) Create(ctx context.Context) error {
-	tags, err := parseTags(q.tags)
+	if q.existing {
+		return nil
+	}
+	tags, err := q.queueTags()
+	if err != nil {
+		return err
+	}
+	attributes, err := q.queueAttributes()
 	if err != nil {
 		return err
 	}
 	out, err := q.sqsClient.CreateQueue(ctx, &sqs.CreateQueueInput{
-		QueueName: aws.String(q.name),
-		Attributes: map[string]string{
-			"Policy":                        fmt.Sprintf(queuePolicy, q.topicArn),
-			"ReceiveMessageWaitTimeSeconds": strconv.Itoa(longPollingWaitTimeSeconds),
-		},
-		Tags: tags,
+		QueueName:  aws.String(q.name),
+		Attributes: attributes,
+		Tags:       tags,
 	})
 	if err != nil {
 		return err
@@ -99,6 +165,90 @@ func (q *Queue) Create(ctx context.Context) error {
 	return nil
 }
 
+// queueTags returns the tags to create the queue with: the instance's copied
+// tags, with the configured tags taking precedence.
+func (q *Queue) queueTags() (map[string]string, error) {
+	tags, err := parseTags(q.tags)
+	if err != nil || len(q.instanceTags) == 0 {
+		return tags, err
+	}
+	merged := maps.Clone(q.instanceTags)
+	maps.Copy(merged, tags)
+	if len(merged) > maxQueueTags {
+		return nil, fmt.Errorf("number of tags (%d) exceeds maximum allowed (%d)", len(merged), maxQueueTags)
+	}
+	return merged, nil
+}
+
+// queueAttributes returns the attributes to create the queue with.
+func (q *Queue) queueAttributes() (map[string]string, error) {
+	policy, err := q.policy()
+	if err != nil {
+		return nil, err
+	}
+	attributes := map[string]string{
+		"Policy":                        policy,
+		"ReceiveMessageWaitTimeSeconds": strconv.Itoa(longPollingWaitTimeSeconds),
+	}
+	switch {
+	case q.kmsKeyID != "":
+		attributes["KmsMasterKeyId"] = q.kmsKeyID
+	case q.managedSSE:
+		attributes["SqsManagedSseEnabled"] = "true"
+	}
+	if q.messageRetention != 0 {
+		if err := ValidateMessageRetention(q.messageRetention); err != nil {
+			return nil, err
+		}
+		attributes["MessageRetentionPeriod"] = strconv.Itoa(int(q.messageRetention / time.Second))
+	}
+	return attributes, nil
+}
+
+// ValidateMessageRetention returns an error if SQS won't accept retention as a
+// queue's message retention period. Zero leaves the SQS default.
+func ValidateMessageRetention(retention time.Duration) error {
+	if retention != 0 && (retention < minMessageRetention || retention > maxMessageRetention) {
+		return fmt.Errorf("message retention %s is not between %s and %s", retention, minMessageRetention, maxMessageRetention)
+	}
+	return nil
+}
+
+// policy returns the queue policy, which lets only SNS send to the queue, and
+// only from the topics it subscribes to, pinned by both ARN and owning account.
+// A topic that isn't an ARN has no account to pin; subscribing to it fails
+// anyway.
+func (q *Queue) policy() (string, error) {
+	topics := append(slices.Clone(q.topicArns), q.policyTopicArns...)
+	var accounts []string
+	for _, topic := range topics {
+		parsed, err := arn.Parse(topic)
+		if err == nil && !slices.Contains(accounts, parsed.AccountID) {
+			accounts = append(accounts, parsed.AccountID)
+		}
+	}
+	condition := map[string]any{
+		"ArnEquals": map[string][]string{"aws:SourceArn": topics},
+	}
+	if len(accounts) > 0 {
+		condition["StringEquals"] = map[string][]string{"aws:SourceAccount": accounts}
+	}
+	policy, err := json.Marshal(map[string]any{
+		"Version": "2012-10-17",
+		"Statement": []map[string]any{{
+			"Effect":    "Allow",
+			"Principal": map[string]string{"Service": "sns.amazonaws.com"},
+			"Action":    "sqs:SendMessage",
+			"Resource":  "*",
+			"Condition": condition,
+		}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(policy), nil
+}
+
 // GetArn for the SQS queue.
 func (q *Queue) getArn(ctx context.Context) (string, error) {
 	if q.arn == "" {
@@ -118,24 +268,128 @@ func (q *Queue) getArn(ctx context.Context) (string, error) {
 	return q.arn, nil
 }
 
-// Subscribe the queue to an SNS topic
+// Subscribe the queue to its SNS topics. Subscriptions made before an error
+// are kept, so Unsubscribe still removes them.
 func (q *Queue) Subscribe(ctx context.Context) error {
+	if q.existing {
+		return nil
+	}
+	for _, topic := range q.topicArns {
+		if err := q.subscribe(ctx, topic); err != nil {
+			return fmt.Errorf("subscribe to %s: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+func (q *Queue) subscribe(ctx context.Context, topicArn string) error {
 	arn, err := q.getArn(ctx)
 	if err != nil {
 		return err
 	}
+	attributes, err := q.subscriptionAttributes()
+	if err != nil {
+		return err
+	}
 	out, err := q.snsClient.Subscribe(ctx, &sns.SubscribeInput{
-		TopicArn: aws.String(q.topicArn),
-		Protocol: aws.String("sqs"),
-		Endpoint: aws.String(arn),
+		TopicArn:   aws.String(topicArn),
+		Protocol:   aws.String("sqs"),
+		Endpoint:   aws.String(arn),
+		Attributes: attributes,
+		// A subscription made from the topic's account to a queue in another
+		// account is pending until confirmed, but still has an ARN to track.
+		ReturnSubscriptionArn: true,
+	})
+	if err != nil {
+		return err
+	}
+	q.subscriptionArns[topicArn] = aws.ToString(out.SubscriptionArn)
+	return nil
+}
+
+// ConfirmSubscription confirms a pending subscription to one of the queue's
+// topics with the token SNS sent to the queue.
+func (q *Queue) ConfirmSubscription(ctx context.Context, topicArn, token string) error {
+	if q.existing || !slices.Contains(q.topicArns, topicArn) {
+		return fmt.Errorf("not subscribed to topic %s", topicArn)
+	}
+	out, err := q.snsClient.ConfirmSubscription(ctx, &sns.ConfirmSubscriptionInput{
+		TopicArn: aws.String(topicArn),
+		Token:    aws.String(token),
 	})
 	if err != nil {
 		return err
 	}
-	q.subscriptionArn = aws.ToString(out.SubscriptionArn)
+	q.subscriptionArns[topicArn] = aws.ToString(out.SubscriptionArn)
 	return nil
 }
 
+// MissingSubscriptions returns the topics whose subscription has been deleted
+// since the queue subscribed to them.
+func (q *Queue) MissingSubscriptions(ctx context.Context) ([]string, error) {
+	if q.existing {
+		return nil, nil
+	}
+	var missing []string
+	for _, topic := range q.topicArns {
+		subscriptionArn, ok := q.subscriptionArns[topic]
+		if !ok {
+			continue
+		}
+		_, err := q.snsClient.GetSubscriptionAttributes(ctx, &sns.GetSubscriptionAttributesInput{
+			SubscriptionArn: aws.String(subscriptionArn),
+		})
+		if err != nil {
+			var notFound *snstypes.NotFoundException
+			if !errors.As(err, &notFound) {
+				return nil, err
+			}
+			missing = append(missing, topic)
+		}
+	}
+	return missing, nil
+}
+
+// Recreate creates the queue again and subscribes it to the SNS topics, after
+// the queue was deleted from underneath the daemon. SQS refuses to create a
+// queue for a minute after one of the same name was deleted, so until Create
+// succeeds the queue keeps its old URL, and receiving from it fails the same
+// way, leading the listener to try again.
+func (q *Queue) Recreate(ctx context.Context) error {
+	if q.existing {
+		return nil
+	}
+	if err := q.Create(ctx); err != nil {
+		return err
+	}
+	q.arn = ""
+	return q.Subscribe(ctx)
+}
+
+// subscriptionAttributes returns the attributes to subscribe the queue with.
+// The filter policy matches EC2InstanceId in the autoscaling message itself,
+// rather than the SNS message attributes, which autoscaling doesn't set.
+func (q *Queue) subscriptionAttributes() (map[string]string, error) {
+	var attributes map[string]string
+	if q.instanceID != "" {
+		policy, err := json.Marshal(map[string][]string{"EC2InstanceId": {q.instanceID}})
+		if err != nil {
+			return nil, err
+		}
+		attributes = map[string]string{
+			"FilterPolicy":      string(policy),
+			"FilterPolicyScope": "MessageBody",
+		}
+	}
+	if q.rawDelivery {
+		if attributes == nil {
+			attributes = map[string]string{}
+		}
+		attributes["RawMessageDelivery"] = "true"
+	}
+	return attributes, nil
+}
+
 // GetMessages long polls for messages from the SQS queue.
 func (q *Queue) GetMessages(ctx context.Context) ([]sqstypes.Message, error) {
 	out, err := q.sqsClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
@@ -144,7 +398,7 @@ func (q *Queue) GetMessages(ctx context.Context) ([]sqstypes.Message, error) {
 		// instances' events, so draining a batch per poll beats one-at-a-time.
 		MaxNumberOfMessages: 10,
 		WaitTimeSeconds:     longPollingWaitTimeSeconds,
-		VisibilityTimeout:   0,
+		VisibilityTimeout:   messageVisibilityTimeout,
 	})
 	if err != nil {
 		// Ignore error if the context was cancelled (i.e. we are shutting down)
@@ -171,41 +425,143 @@ func (q *Queue) DeleteMessage(ctx context.Context, receiptHandle string) error {
 	return nil
 }
 
-// Unsubscribe the queue from the SNS topic.
+// DeleteMessages deletes a set of messages from the queue in batches.
+func (q *Queue) DeleteMessages(ctx context.Context, receiptHandles []string) error {
+	for start := 0; start < len(receiptHandles); start += maxBatchEntries {
+		end := min(start+maxBatchEntries, len(receiptHandles))
+		entries := make([]sqstypes.DeleteMessageBatchRequestEntry, 0, end-start)
+		for i, handle := range receiptHandles[start:end] {
+			entries = append(entries, sqstypes.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: aws.String(handle),
+			})
+		}
+		out, err := q.sqsClient.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(q.url),
+			Entries:  entries,
+		})
+		if err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return nil
+			}
+			return err
+		}
+		if len(out.Failed) > 0 {
+			f := out.Failed[0]
+			return fmt.Errorf("failed to delete %d of %d messages: %s: %s", len(out.Failed), len(entries), aws.ToString(f.Code), aws.ToString(f.Message))
+		}
+	}
+	return nil
+}
+
+// ReleaseMessages makes a set of received messages visible again soon, so
+// another consumer of a shared queue can receive them. They aren't made visible
+// straight away: the daemon's next poll would only receive them again.
+func (q *Queue) ReleaseMessages(ctx context.Context, receiptHandles []string) error {
+	for start := 0; start < len(receiptHandles); start += maxBatchEntries {
+		end := min(start+maxBatchEntries, len(receiptHandles))
+		entries := make([]sqstypes.ChangeMessageVisibilityBatchRequestEntry, 0, end-start)
+		for i, handle := range receiptHandles[start:end] {
+			entries = append(entries, sqstypes.ChangeMessageVisibilityBatchRequestEntry{
+				Id:                aws.String(strconv.Itoa(i)),
+				ReceiptHandle:     aws.String(handle),
+				VisibilityTimeout: releaseVisibility,
+			})
+		}
+		out, err := q.sqsClient.ChangeMessageVisibilityBatch(ctx, &sqs.ChangeMessageVisibilityBatchInput{
+			QueueUrl: aws.String(q.url),
+			Entries:  entries,
+		})
+		if err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return nil
+			}
+			return err
+		}
+		if len(out.Failed) > 0 {
+			f := out.Failed[0]
+			return fmt.Errorf("failed to release %d of %d messages: %s: %s", len(out.Failed), len(entries), aws.ToString(f.Code), aws.ToString(f.Message))
+		}
+	}
+	return nil
+}
+
+// releaseBackoff paces a polling loop while its batches hold only messages it
+// released for other consumers.
+type releaseBackoff struct {
+	wait time.Duration
+}
+
+// next returns how long to wait before the next poll, given how many messages
+// the last batch held and how many of them were released.
+func (b *releaseBackoff) next(received, released int) time.Duration {
+	if received == 0 || released < received {
+		b.wait = 0
+		return 0
+	}
+	b.wait = min(max(2*b.wait, releaseBackoffMin), releaseBackoffMax)
+	return b.wait
+}
+
+// Unsubscribe the queue from each SNS topic it subscribed to.
 func (q *Queue) Unsubscribe(ctx context.Context) error {
-	_, err := q.snsClient.Unsubscribe(ctx, &sns.UnsubscribeInput{
-		SubscriptionArn: aws.String(q.subscriptionArn),
-	})
-	return err
+	if q.existing {
+		return nil
+	}
+	var errs []error
+	for _, topic := range q.topicArns {
+		subscriptionArn, ok := q.subscriptionArns[topic]
+		if !ok {
+			continue
+		}
+		_, err := q.snsClient.Unsubscribe(ctx, &sns.UnsubscribeInput{
+			SubscriptionArn: aws.String(subscriptionArn),
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unsubscribe from %s: %w", topic, err))
+			continue
+		}
+		delete(q.subscriptionArns, topic)
+	}
+	return errors.Join(errs...)
 }
 
 // Delete the SQS queue.
 func (q *Queue) Delete(ctx context.Context) error {
+	if q.existing {
+		return nil
+	}
 	_, err := q.sqsClient.DeleteQueue(ctx, &sqs.DeleteQueueInput{
 		QueueUrl: aws.String(q.url),
 	})
 	if err != nil {
 		// Ignore error if queue does not exist (which is what we want)
-		var notExist *sqstypes.QueueDoesNotExist
-		if !errors.As(err, &notExist) {
+		if !queueMissing(err) {
 			return err
 		}
 	}
 	return nil
 }
 
+// queueMissing reports whether err is SQS saying the queue doesn't exist.
+func queueMissing(err error) bool {
+	var notExist *sqstypes.QueueDoesNotExist
+	return errors.As(err, &notExist)
+}
+
+// Limits SQS puts on queue tags.
+const (
+	maxQueueTags      = 50
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
 // Expects format like "key1=alpha,key2=beta"
 func parseTags(input string) (map[string]string, error) {
 	if input == "" {
 		return nil, nil
 	}
 
-	const (
-		maxTags        = 50
-		maxKeyLength   = 128
-		maxValueLength = 256
-	)
-
 	tags := make(map[string]string)
 	pairs := strings.Split(input, ",")
 
@@ -223,13 +579,13 @@ func parseTags(input string) (map[string]string, error) {
 		}
 
 		// Check key length
-		if len(key) > maxKeyLength {
-			return nil, fmt.Errorf("tag key exceeds maximum length of %d characters: %q", maxKeyLength, key)
+		if len(key) > maxTagKeyLength {
+			return nil, fmt.Errorf("tag key exceeds maximum length of %d characters: %q", maxTagKeyLength, key)
 		}
 
 		// Check value length
-		if len(value) > maxValueLength {
-			return nil, fmt.Errorf("tag value exceeds maximum length of %d characters for key %q", maxValueLength, key)
+		if len(value) > maxTagValueLength {
+			return nil, fmt.Errorf("tag value exceeds maximum length of %d characters for key %q", maxTagValueLength, key)
 		}
 
 		// Check for aws: prefix (case-insensitive)
@@ -241,8 +597,8 @@ func parseTags(input string) (map[string]string, error) {
 	}
 
 	// Check total number of tags
-	if len(tags) > maxTags {
-		return nil, fmt.Errorf("number of tags (%d) exceeds maximum allowed (%d)", len(tags), maxTags)
+	if len(tags) > maxQueueTags {
+		return nil, fmt.Errorf("number of tags (%d) exceeds maximum allowed (%d)", len(tags), maxQueueTags)
 	}
 
 	if len(tags) == 0 {
@@ -2,12 +2,22 @@ package lifecycled
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 )
 
 func TestParseTags(t *testing.T) {
@@ -321,3 +331,436 @@ func TestQueueDelete(t *testing.T) {
 		})
 	}
 }
+
+// batchDeleteSQSClient records the size of each DeleteMessageBatch request and
+// reports the configured entries as failed.
+type batchDeleteSQSClient struct {
+	stubSQSClient
+	batches []int
+	failed  []sqstypes.BatchResultErrorEntry
+}
+
+func (c *batchDeleteSQSClient) DeleteMessageBatch(_ context.Context, in *sqs.DeleteMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	c.batches = append(c.batches, len(in.Entries))
+	return &sqs.DeleteMessageBatchOutput{Failed: c.failed}, nil
+}
+
+// DeleteMessages splits the handles into batches SQS accepts and surfaces
+// entries that failed within an otherwise successful call.
+func TestQueueDeleteMessages(t *testing.T) {
+	handles := make([]string, 12)
+	for i := range handles {
+		handles[i] = fmt.Sprintf("h%d", i)
+	}
+
+	client := &batchDeleteSQSClient{}
+	q := NewQueue("queue", "topic", client, &stubSNSClient{}, "")
+	if err := q.DeleteMessages(context.Background(), handles); err != nil {
+		t.Fatalf("DeleteMessages returned error: %v", err)
+	}
+	if want := []int{10, 2}; !slices.Equal(client.batches, want) {
+		t.Errorf("batch sizes = %v, want %v", client.batches, want)
+	}
+
+	client = &batchDeleteSQSClient{failed: []sqstypes.BatchResultErrorEntry{{Code: aws.String("ReceiptHandleIsInvalid"), Id: aws.String("0")}}}
+	q = NewQueue("queue", "topic", client, &stubSNSClient{}, "")
+	if err := q.DeleteMessages(context.Background(), handles[:1]); err == nil {
+		t.Error("expected an error for a failed batch entry, got nil")
+	}
+}
+
+// releaseSQSClient records the receipt handles and visibility timeouts of each
+// ChangeMessageVisibilityBatch request.
+type releaseSQSClient struct {
+	stubSQSClient
+	mu       sync.Mutex
+	released []string
+	timeouts []int32
+}
+
+func (c *releaseSQSClient) ChangeMessageVisibilityBatch(_ context.Context, in *sqs.ChangeMessageVisibilityBatchInput, _ ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range in.Entries {
+		c.released = append(c.released, aws.ToString(e.ReceiptHandle))
+		c.timeouts = append(c.timeouts, e.VisibilityTimeout)
+	}
+	return &sqs.ChangeMessageVisibilityBatchOutput{}, nil
+}
+
+// ReleaseMessages makes messages visible again for another consumer of a shared
+// queue after a short, constant delay, so the releasing daemon's next poll
+// doesn't receive them straight back.
+func TestQueueReleaseMessages(t *testing.T) {
+	client := &releaseSQSClient{}
+	q := NewExistingQueue("https://sqs.us-east-1.amazonaws.com/123456789012/shared", client)
+	if q.name != "shared" {
+		t.Errorf("queue name = %q, want %q", q.name, "shared")
+	}
+	if err := q.ReleaseMessages(context.Background(), []string{"h1", "h2"}); err != nil {
+		t.Fatalf("ReleaseMessages returned error: %v", err)
+	}
+	if want := []string{"h1", "h2"}; !slices.Equal(client.released, want) {
+		t.Errorf("released = %v, want %v", client.released, want)
+	}
+	if want := []int32{releaseVisibility, releaseVisibility}; !slices.Equal(client.timeouts, want) {
+		t.Errorf("visibility timeouts = %v, want %v", client.timeouts, want)
+	}
+}
+
+// A loop backs off while its batches hold only released messages, and polls
+// straight away again once one holds anything else, or nothing.
+func TestReleaseBackoff(t *testing.T) {
+	var b releaseBackoff
+	steps := []struct {
+		received, released int
+		want               time.Duration
+	}{
+		{received: 3, released: 3, want: releaseBackoffMin},
+		{received: 1, released: 1, want: 2 * releaseBackoffMin},
+		{received: 2, released: 1, want: 0},
+		{received: 1, released: 1, want: releaseBackoffMin},
+		{received: 0, released: 0, want: 0},
+	}
+	for i, step := range steps {
+		if got := b.next(step.received, step.released); got != step.want {
+			t.Errorf("step %d: next(%d, %d) = %s, want %s", i, step.received, step.released, got, step.want)
+		}
+	}
+	for range 10 {
+		b.next(1, 1)
+	}
+	if got := b.next(1, 1); got != releaseBackoffMax {
+		t.Errorf("backoff = %s after many released batches, want the %s cap", got, releaseBackoffMax)
+	}
+}
+
+// subscribeSNSClient records the attributes the queue was subscribed with.
+type subscribeSNSClient struct {
+	stubSNSClient
+	attributes map[string]string
+}
+
+func (c *subscribeSNSClient) Subscribe(_ context.Context, in *sns.SubscribeInput, _ ...func(*sns.Options)) (*sns.SubscribeOutput, error) {
+	c.attributes = in.Attributes
+	return &sns.SubscribeOutput{SubscriptionArn: aws.String("arn")}, nil
+}
+
+// A queue for an instance subscribes with a filter policy on the message body,
+// so it only receives that instance's events.
+func TestQueueSubscribeFilterPolicy(t *testing.T) {
+	client := &subscribeSNSClient{}
+	q := NewQueue("queue", "topic", &stubSQSClient{}, client, "")
+	q.instanceID = "i-1"
+	if err := q.Subscribe(context.Background()); err != nil {
+		t.Fatalf("Subscribe returned error: %v", err)
+	}
+	if got, want := client.attributes["FilterPolicy"], `{"EC2InstanceId":["i-1"]}`; got != want {
+		t.Errorf("FilterPolicy = %s, want %s", got, want)
+	}
+	if got := client.attributes["FilterPolicyScope"]; got != "MessageBody" {
+		t.Errorf("FilterPolicyScope = %q, want MessageBody", got)
+	}
+
+	client = &subscribeSNSClient{}
+	q = NewQueue("queue", "topic", &stubSQSClient{}, client, "")
+	if err := q.Subscribe(context.Background()); err != nil {
+		t.Fatalf("Subscribe returned error: %v", err)
+	}
+	if client.attributes != nil {
+		t.Errorf("attributes = %v, want none without an instance id", client.attributes)
+	}
+}
+
+func TestQueueSubscribeRawDelivery(t *testing.T) {
+	client := &subscribeSNSClient{}
+	q := NewQueue("queue", "topic", &stubSQSClient{}, client, "")
+	q.rawDelivery = true
+	if err := q.Subscribe(context.Background()); err != nil {
+		t.Fatalf("Subscribe returned error: %v", err)
+	}
+	if got := client.attributes["RawMessageDelivery"]; got != "true" {
+		t.Errorf("RawMessageDelivery = %q, want true", got)
+	}
+}
+
+// topicSNSClient subscribes with an ARN derived from the topic, reports the
+// subscriptions in deleted as missing, and records unsubscribed ARNs.
+type topicSNSClient struct {
+	stubSNSClient
+	deleted      map[string]bool
+	err          error
+	unsubscribed []string
+}
+
+func (c *topicSNSClient) Subscribe(_ context.Context, in *sns.SubscribeInput, _ ...func(*sns.Options)) (*sns.SubscribeOutput, error) {
+	return &sns.SubscribeOutput{SubscriptionArn: aws.String(aws.ToString(in.TopicArn) + ":sub")}, nil
+}
+
+func (c *topicSNSClient) GetSubscriptionAttributes(_ context.Context, in *sns.GetSubscriptionAttributesInput, _ ...func(*sns.Options)) (*sns.GetSubscriptionAttributesOutput, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.deleted[aws.ToString(in.SubscriptionArn)] {
+		return nil, &snstypes.NotFoundException{}
+	}
+	return &sns.GetSubscriptionAttributesOutput{}, nil
+}
+
+func (c *topicSNSClient) Unsubscribe(_ context.Context, in *sns.UnsubscribeInput, _ ...func(*sns.Options)) (*sns.UnsubscribeOutput, error) {
+	c.unsubscribed = append(c.unsubscribed, aws.ToString(in.SubscriptionArn))
+	return &sns.UnsubscribeOutput{}, nil
+}
+
+func TestQueueMissingSubscriptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		client     *topicSNSClient
+		subscribed bool
+		want       []string
+		wantErr    bool
+	}{
+		{name: "subscribed", client: &topicSNSClient{}, subscribed: true},
+		{name: "one deleted", client: &topicSNSClient{deleted: map[string]bool{"b:sub": true}}, subscribed: true, want: []string{"b"}},
+		{name: "other error", client: &topicSNSClient{err: errors.New("throttled")}, subscribed: true, wantErr: true},
+		{name: "never subscribed", client: &topicSNSClient{err: errors.New("not called")}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewQueue("queue", "a", &stubSQSClient{}, tc.client, "")
+			q.topicArns = []string{"a", "b"}
+			if tc.subscribed {
+				if err := q.Subscribe(context.Background()); err != nil {
+					t.Fatalf("Subscribe returned error: %v", err)
+				}
+			}
+			got, err := q.MissingSubscriptions(context.Background())
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("MissingSubscriptions returned %v, want error %v", err, tc.wantErr)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("MissingSubscriptions = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// A queue with several topics subscribes to, and unsubscribes from, each.
+func TestQueueSubscribesToEachTopic(t *testing.T) {
+	client := &topicSNSClient{}
+	q := NewQueue("queue", "a", &stubSQSClient{}, client, "")
+	q.topicArns = []string{"a", "b"}
+
+	if err := q.Subscribe(context.Background()); err != nil {
+		t.Fatalf("Subscribe returned error: %v", err)
+	}
+	if err := q.Unsubscribe(context.Background()); err != nil {
+		t.Fatalf("Unsubscribe returned error: %v", err)
+	}
+	if want := []string{"a:sub", "b:sub"}; !slices.Equal(client.unsubscribed, want) {
+		t.Errorf("unsubscribed %v, want %v", client.unsubscribed, want)
+	}
+	if len(q.subscriptionArns) != 0 {
+		t.Errorf("subscriptions left after Unsubscribe: %v", q.subscriptionArns)
+	}
+}
+
+func TestQueueAttributes(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(*Queue)
+		want    map[string]string
+		absent  []string
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			setup:  func(*Queue) {},
+			want:   map[string]string{"ReceiveMessageWaitTimeSeconds": "20"},
+			absent: []string{"SqsManagedSseEnabled", "KmsMasterKeyId", "MessageRetentionPeriod"},
+		},
+		{
+			name:  "sqs managed encryption",
+			setup: func(q *Queue) { q.managedSSE = true },
+			want:  map[string]string{"SqsManagedSseEnabled": "true"},
+		},
+		{
+			name:   "kms key takes precedence",
+			setup:  func(q *Queue) { q.managedSSE, q.kmsKeyID = true, "alias/lifecycled" },
+			want:   map[string]string{"KmsMasterKeyId": "alias/lifecycled"},
+			absent: []string{"SqsManagedSseEnabled"},
+		},
+		{
+			name:  "message retention",
+			setup: func(q *Queue) { q.messageRetention = 2 * time.Hour },
+			want:  map[string]string{"MessageRetentionPeriod": "7200"},
+		},
+		{
+			name:    "message retention out of range",
+			setup:   func(q *Queue) { q.messageRetention = 15 * 24 * time.Hour },
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewQueue("queue", "arn:aws:sns:us-east-1:111111111111:topic", &stubSQSClient{}, &stubSNSClient{}, "")
+			tc.setup(q)
+			got, err := q.queueAttributes()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("queueAttributes returned %v, want error %v", err, tc.wantErr)
+			}
+			for k, v := range tc.want {
+				if got[k] != v {
+					t.Errorf("%s = %q, want %q", k, got[k], v)
+				}
+			}
+			for _, k := range tc.absent {
+				if _, ok := got[k]; ok {
+					t.Errorf("unexpected attribute %s", k)
+				}
+			}
+		})
+	}
+}
+
+// The policy lets only SNS send, from each topic, pinned to the owning accounts.
+func TestQueuePolicy(t *testing.T) {
+	q := NewQueue("queue", "arn:aws:sns:us-east-1:111111111111:topic", &stubSQSClient{}, &stubSNSClient{}, "")
+	q.policyTopicArns = []string{"arn:aws:sns:us-east-1:222222222222:other", "arn:aws:sns:us-west-2:111111111111:topic"}
+
+	policy, err := q.policy()
+	if err != nil {
+		t.Fatalf("policy returned error: %v", err)
+	}
+	var doc struct {
+		Statement []struct {
+			Principal map[string]string
+			Condition struct {
+				ArnEquals    map[string][]string
+				StringEquals map[string][]string
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(policy), &doc); err != nil {
+		t.Fatalf("policy is not JSON: %v", err)
+	}
+	statement := doc.Statement[0]
+	if got := statement.Principal["Service"]; got != "sns.amazonaws.com" {
+		t.Errorf("principal = %v, want the SNS service", statement.Principal)
+	}
+	wantTopics := append(slices.Clone(q.topicArns), q.policyTopicArns...)
+	if got := statement.Condition.ArnEquals["aws:SourceArn"]; !slices.Equal(got, wantTopics) {
+		t.Errorf("aws:SourceArn = %v, want %v", got, wantTopics)
+	}
+	if got, want := statement.Condition.StringEquals["aws:SourceAccount"], []string{"111111111111", "222222222222"}; !slices.Equal(got, want) {
+		t.Errorf("aws:SourceAccount = %v, want %v", got, want)
+	}
+}
+
+// Several topics share the instance's queue, or with SNSQueuePerTopic get one
+// queue each, the first keeping the usual name.
+func TestNewDaemonSNSTopics(t *testing.T) {
+	tests := []struct {
+		name       string
+		perTopic   bool
+		wantQueues map[string][]string
+	}{
+		{
+			name:       "shared queue",
+			wantQueues: map[string][]string{"lifecycled-i-1": {"a", "b"}},
+		},
+		{
+			name:       "queue per topic",
+			perTopic:   true,
+			wantQueues: map[string][]string{"lifecycled-i-1": {"a"}, "lifecycled-i-1-2": {"b"}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &Config{InstanceID: "i-1", SNSTopic: "a, b", SNSQueuePerTopic: tc.perTopic}
+			logger, _ := logrustest.NewNullLogger()
+			daemon := NewDaemon(config, &stubSQSClient{}, &stubSNSClient{}, &stubAutoscalingClient{}, &stubMetadataClient{}, logger)
+
+			got := map[string][]string{}
+			for _, l := range daemon.listeners {
+				queue := l.(*AutoscalingListener).queue
+				got[queue.name] = queue.topicArns
+			}
+			if len(got) != len(tc.wantQueues) {
+				t.Fatalf("queues = %v, want %v", got, tc.wantQueues)
+			}
+			for name, topics := range tc.wantQueues {
+				if !slices.Equal(got[name], topics) {
+					t.Errorf("queue %s topics = %v, want %v", name, got[name], topics)
+				}
+			}
+		})
+	}
+}
+
+func TestTopicRegion(t *testing.T) {
+	tests := []struct {
+		name     string
+		topics   []string
+		want     string
+		wantWarn bool
+	}{
+		{name: "no topics"},
+		{name: "not an arn", topics: []string{"topic"}},
+		{name: "topic region", topics: []string{"arn:aws:sns:eu-west-1:111111111111:topic"}, want: "eu-west-1"},
+		{
+			name:     "mixed regions use the first",
+			topics:   []string{"arn:aws:sns:eu-west-1:111111111111:a", "arn:aws:sns:us-east-1:111111111111:b"},
+			want:     "eu-west-1",
+			wantWarn: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logger, hook := logrustest.NewNullLogger()
+			if got := topicRegion(tc.topics, logger); got != tc.want {
+				t.Errorf("topicRegion = %q, want %q", got, tc.want)
+			}
+			if warned := loggedAt(hook.AllEntries(), logrus.WarnLevel, "different regions"); warned != tc.wantWarn {
+				t.Errorf("warned = %v, want %v", warned, tc.wantWarn)
+			}
+		})
+	}
+}
+
+func TestValidateMessageRetention(t *testing.T) {
+	tests := []struct {
+		retention time.Duration
+		wantErr   bool
+	}{
+		{retention: 0},
+		{retention: time.Minute},
+		{retention: 14 * 24 * time.Hour},
+		{retention: 30 * time.Second, wantErr: true},
+		{retention: 15 * 24 * time.Hour, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.retention.String(), func(t *testing.T) {
+			if err := ValidateMessageRetention(tc.retention); (err != nil) != tc.wantErr {
+				t.Errorf("ValidateMessageRetention(%s) = %v, want error %v", tc.retention, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateTopicRegions(t *testing.T) {
+	tests := []struct {
+		topics  string
+		wantErr bool
+	}{
+		{topics: ""},
+		{topics: "arn:aws:sns:eu-west-1:111111111111:a"},
+		{topics: "arn:aws:sns:eu-west-1:111111111111:a,arn:aws:sns:eu-west-1:222222222222:b"},
+		{topics: "arn:aws:sns:eu-west-1:111111111111:a, arn:aws:sns:us-east-1:111111111111:b", wantErr: true},
+	}
+	for _, tc := range tests {
+		if err := ValidateTopicRegions(tc.topics); (err != nil) != tc.wantErr {
+			t.Errorf("ValidateTopicRegions(%q) = %v, want error %v", tc.topics, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package lifecycled
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// setupBackoffBase is the first backoff after a throttled setup call, which
+	// doubles with each retry up to setupBackoffMax.
+	setupBackoffBase = time.Second
+	setupBackoffMax  = 30 * time.Second
+)
+
+// retryThrottled calls fn until it succeeds, fails other than by throttling, or
+// the next attempt would start after deadline, backing off exponentially with
+// full jitter between attempts so a fleet launched together spreads out. A zero
+// deadline means a single attempt. It returns the number of retries made.
+func retryThrottled(ctx context.Context, deadline time.Time, backoff time.Duration, log *logrus.Entry, call string, fn func(context.Context) error) (int, error) {
+	for retries := 0; ; retries++ {
+		err := fn(ctx)
+		if err == nil || ClassifyError(err) != ErrorThrottled {
+			return retries, err
+		}
+		wait := rand.N(backoff) + time.Millisecond
+		if deadline.IsZero() || time.Now().Add(wait).After(deadline) {
+			return retries, err
+		}
+		log.WithError(err).WithFields(logrus.Fields{
+			"call":  call,
+			"retry": retries + 1,
+			"wait":  wait,
+		}).Warn("Throttled during setup, retrying")
+		select {
+		case <-ctx.Done():
+			return retries, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, setupBackoffMax)
+	}
+}
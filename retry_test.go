@@ -0,0 +1,114 @@
+package lifecycled
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/smithy-go"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// throttlingSNSClient throttles the first throttles calls to Subscribe.
+type throttlingSNSClient struct {
+	*stubSNSClient
+	throttles int64
+}
+
+func (c *throttlingSNSClient) Subscribe(ctx context.Context, in *sns.SubscribeInput, opts ...func(*sns.Options)) (*sns.SubscribeOutput, error) {
+	if atomic.AddInt64(&c.throttles, -1) >= 0 {
+		atomic.AddInt64(&c.subscribeCalls, 1)
+		return nil, &snstypes.ThrottledException{Message: aws.String("Rate exceeded")}
+	}
+	return c.stubSNSClient.Subscribe(ctx, in, opts...)
+}
+
+func TestRetryThrottled(t *testing.T) {
+	throttle := &smithy.GenericAPIError{Code: "Throttling"}
+	denied := &smithy.GenericAPIError{Code: "AccessDenied"}
+
+	tests := []struct {
+		name        string
+		errs        []error
+		deadline    time.Duration
+		wantRetries int
+		wantErr     error
+	}{
+		{name: "succeeds after throttling", errs: []error{throttle, throttle}, deadline: time.Minute, wantRetries: 2},
+		{name: "no deadline makes one attempt", errs: []error{throttle}, wantErr: throttle},
+		{name: "other errors aren't retried", errs: []error{denied}, deadline: time.Minute, wantErr: denied},
+		{name: "gives up at the deadline", errs: slices.Repeat([]error{throttle}, 100), deadline: 20 * time.Millisecond, wantErr: throttle},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var deadline time.Time
+			if tc.deadline > 0 {
+				deadline = time.Now().Add(tc.deadline)
+			}
+			calls := 0
+			logger, _ := logrustest.NewNullLogger()
+			retries, err := retryThrottled(context.Background(), deadline, 10*time.Millisecond, logrus.NewEntry(logger), "Call", func(context.Context) error {
+				calls++
+				if calls <= len(tc.errs) {
+					return tc.errs[calls-1]
+				}
+				return nil
+			})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("retryThrottled returned %v, want %v", err, tc.wantErr)
+			}
+			if tc.wantErr == nil && retries != tc.wantRetries {
+				t.Errorf("retries = %d, want %d", retries, tc.wantRetries)
+			}
+			if calls != retries+1 {
+				t.Errorf("made %d calls with %d retries", calls, retries)
+			}
+		})
+	}
+}
+
+// A throttled Subscribe is retried until the setup deadline instead of stopping
+// the listener, and the time setup took is logged.
+func TestAutoscalingListenerRetriesThrottledSetup(t *testing.T) {
+	sn := &throttlingSNSClient{stubSNSClient: &stubSNSClient{}, throttles: 2}
+	listener := NewAutoscalingListener("i-1", NewQueue("queue", "topic", &scriptedSQSClient{}, sn, ""), &stubAutoscalingClient{}, time.Minute)
+	listener.setupJitter = time.Millisecond
+	listener.setupTimeout = time.Minute
+	listener.setupBackoff = time.Millisecond
+	logger, hook := logrustest.NewNullLogger()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- listener.Start(ctx, make(chan TerminationNotice, 1), logrus.NewEntry(logger))
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !logged(hook.AllEntries(), "Set up sqs queue") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	if got := atomic.LoadInt64(&sn.subscribeCalls); got != 3 {
+		t.Errorf("Subscribe called %d times, want 3", got)
+	}
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Set up sqs queue and sns subscriptions" {
+			if entry.Data["retries"] != 2 || entry.Data["latency"] == nil {
+				t.Errorf("setup logged with %v, want 2 retries and the latency", entry.Data)
+			}
+			return
+		}
+	}
+	t.Errorf("expected setup to be logged, got %v", messages(hook.AllEntries()))
+}
@@ -0,0 +1,238 @@
+package lifecycled
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha1" // registers SHA1 for SignatureVersion 1
+	_ "crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// certFetchTimeout bounds fetching a signing certificate from SNS.
+	certFetchTimeout = 10 * time.Second
+
+	// maxCertSize caps a fetched signing certificate, which is a few KB.
+	maxCertSize = 64 * 1024
+)
+
+// snsCertHost matches the hosts SNS serves its signing certificates from when no
+// hosts are configured. It is strict so a look-alike such as an S3 bucket under
+// amazonaws.com can't serve a certificate.
+var snsCertHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// snsVerifier checks the signature on SNS envelopes, so a message that didn't
+// come from SNS, such as a forged termination notice sent straight to the
+// queue, isn't acted on. Certificates come from a pinned PEM bundle or are
+// fetched over HTTPS from an allowed host and cached.
+type snsVerifier struct {
+	bundlePath string
+	hosts      []string
+	topicArns  []string
+	httpClient *http.Client
+
+	mu      sync.Mutex
+	pinned  []*x509.Certificate
+	fetched map[string]*x509.Certificate
+}
+
+// newSNSVerifier returns a verifier that uses the certificates in bundlePath if
+// it is set, and otherwise fetches them from the comma separated hosts, or from
+// SNS's own hosts if none are given. If topicArns are given, each message must
+// have been published to one of them.
+func newSNSVerifier(bundlePath, hosts string, topicArns []string) *snsVerifier {
+	return &snsVerifier{
+		bundlePath: bundlePath,
+		hosts:      splitList(hosts),
+		topicArns:  topicArns,
+		httpClient: &http.Client{Timeout: certFetchTimeout},
+		fetched:    map[string]*x509.Certificate{},
+	}
+}
+
+// load reads the pinned certificate bundle, if there is one.
+func (v *snsVerifier) load() error {
+	if v.bundlePath == "" {
+		return nil
+	}
+	b, err := os.ReadFile(v.bundlePath)
+	if err != nil {
+		return fmt.Errorf("read sns certificate bundle: %w", err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("parse sns certificate bundle: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificates in sns certificate bundle %s", v.bundlePath)
+	}
+	v.mu.Lock()
+	v.pinned = certs
+	v.mu.Unlock()
+	return nil
+}
+
+// verify returns an error unless the envelope carries a valid SNS signature.
+func (v *snsVerifier) verify(ctx context.Context, env *Envelope) error {
+	if len(v.topicArns) > 0 && !slices.Contains(v.topicArns, env.TopicArn) {
+		return fmt.Errorf("message is from topic %q, not one of %q", env.TopicArn, v.topicArns)
+	}
+
+	var hash crypto.Hash
+	switch env.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return fmt.Errorf("unsupported signature version %q", env.SignatureVersion)
+	}
+	signature, err := base64.StdEncoding.DecodeString(env.Signature)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	h := hash.New()
+	h.Write([]byte(env.signingString()))
+	digest := h.Sum(nil)
+
+	certs, err := v.certificates(ctx, env.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	for _, cert := range certs {
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+			return nil
+		}
+	}
+	return errors.New("signature does not match")
+}
+
+// certificates returns the certificates a message may be signed with: the
+// pinned bundle, or the one at certURL if its host is allowed.
+func (v *snsVerifier) certificates(ctx context.Context, certURL string) ([]*x509.Certificate, error) {
+	v.mu.Lock()
+	pinned, cached := v.pinned, v.fetched[certURL]
+	v.mu.Unlock()
+	if pinned != nil {
+		return pinned, nil
+	}
+	if cached != nil {
+		return []*x509.Certificate{cached}, nil
+	}
+
+	if err := v.allowedCertURL(certURL); err != nil {
+		return nil, err
+	}
+	cert, err := v.fetch(ctx, certURL)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	v.fetched[certURL] = cert
+	v.mu.Unlock()
+	return []*x509.Certificate{cert}, nil
+}
+
+// allowedCertURL returns an error unless certURL is an HTTPS URL on an allowed
+// host.
+func (v *snsVerifier) allowedCertURL(certURL string) error {
+	u, err := url.Parse(certURL)
+	if err != nil {
+		return fmt.Errorf("parse signing certificate url: %w", err)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("signing certificate url %q is not https", certURL)
+	}
+	host := u.Hostname()
+	if len(v.hosts) == 0 {
+		if snsCertHost.MatchString(host) {
+			return nil
+		}
+	}
+	for _, h := range v.hosts {
+		if host == h {
+			return nil
+		}
+	}
+	return fmt.Errorf("signing certificate host %q is not allowed", host)
+}
+
+func (v *snsVerifier) fetch(ctx context.Context, certURL string) (*x509.Certificate, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, certURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch signing certificate: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch signing certificate: %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxCertSize))
+	if err != nil {
+		return nil, fmt.Errorf("fetch signing certificate: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("signing certificate is not PEM encoded")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// signingString returns the string SNS signs for the envelope: selected fields
+// as name and value lines, in a fixed order that depends on the message type.
+func (e *Envelope) signingString() string {
+	type field struct{ name, value string }
+	var fields []field
+	switch e.Type {
+	case "SubscriptionConfirmation", "UnsubscribeConfirmation":
+		fields = []field{
+			{"Message", e.Message},
+			{"MessageId", e.MessageID},
+			{"SubscribeURL", e.SubscribeURL},
+			{"Timestamp", e.Timestamp},
+			{"Token", e.Token},
+			{"TopicArn", e.TopicArn},
+			{"Type", e.Type},
+		}
+	default:
+		fields = []field{{"Message", e.Message}, {"MessageId", e.MessageID}}
+		if e.Subject != "" {
+			fields = append(fields, field{"Subject", e.Subject})
+		}
+		fields = append(fields, field{"Timestamp", e.Timestamp}, field{"TopicArn", e.TopicArn}, field{"Type", e.Type})
+	}
+	var b strings.Builder
+	for _, f := range fields {
+		b.WriteString(f.name + "\n" + f.value + "\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,225 @@
+package lifecycled
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+)
+
+const testTopic = "arn:aws:sns:us-east-1:123456789012:lifecycle"
+
+// newSigningCert returns a key and a PEM encoded self-signed certificate for it.
+func newSigningCert(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// signedEnvelope returns a notification signed with key the way SNS signs it.
+func signedEnvelope(t *testing.T, key *rsa.PrivateKey, version string) *Envelope {
+	t.Helper()
+	env := &Envelope{
+		Type:             "Notification",
+		Subject:          "Auto Scaling: Lifecycle action 'TERMINATING'",
+		Message:          `{"EC2InstanceId":"i-1"}`,
+		MessageID:        "id",
+		TopicArn:         testTopic,
+		Timestamp:        "2026-06-29T12:00:00.000Z",
+		SignatureVersion: version,
+		SigningCertURL:   "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-abc.pem",
+	}
+	hash := crypto.SHA256
+	if version == "1" {
+		hash = crypto.SHA1
+	}
+	h := hash.New()
+	h.Write([]byte(env.signingString()))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, hash, h.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Signature = base64.StdEncoding.EncodeToString(sig)
+	return env
+}
+
+func writeBundle(t *testing.T, pemBytes []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sns.pem")
+	if err := os.WriteFile(path, pemBytes, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSNSVerifierPinnedBundle(t *testing.T) {
+	key, pemBytes := newSigningCert(t)
+	otherKey, _ := newSigningCert(t)
+
+	tests := []struct {
+		name    string
+		env     func() *Envelope
+		wantErr bool
+	}{
+		{name: "signature version 2", env: func() *Envelope { return signedEnvelope(t, key, "2") }},
+		{name: "signature version 1", env: func() *Envelope { return signedEnvelope(t, key, "1") }},
+		{
+			name: "tampered message",
+			env: func() *Envelope {
+				env := signedEnvelope(t, key, "2")
+				env.Message = `{"EC2InstanceId":"i-2"}`
+				return env
+			},
+			wantErr: true,
+		},
+		{name: "signed by another key", env: func() *Envelope { return signedEnvelope(t, otherKey, "2") }, wantErr: true},
+		{
+			name: "another topic",
+			env: func() *Envelope {
+				env := signedEnvelope(t, key, "2")
+				env.TopicArn = "arn:aws:sns:us-east-1:123456789012:other"
+				return env
+			},
+			wantErr: true,
+		},
+		{
+			name: "unsupported signature version",
+			env: func() *Envelope {
+				env := signedEnvelope(t, key, "2")
+				env.SignatureVersion = "3"
+				return env
+			},
+			wantErr: true,
+		},
+	}
+
+	v := newSNSVerifier(writeBundle(t, pemBytes), "", []string{testTopic})
+	if err := v.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := v.verify(context.Background(), tc.env())
+			if (err != nil) != tc.wantErr {
+				t.Errorf("verify returned %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSNSVerifierAllowedCertURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		hosts   string
+		wantErr bool
+	}{
+		{url: "https://sns.us-east-1.amazonaws.com/cert.pem"},
+		{url: "https://sns.cn-north-1.amazonaws.com.cn/cert.pem"},
+		{url: "http://sns.us-east-1.amazonaws.com/cert.pem", wantErr: true},
+		{url: "https://sns.bucket.s3.amazonaws.com/cert.pem", wantErr: true},
+		{url: "https://example.com/cert.pem", wantErr: true},
+		{url: "https://certs.internal/cert.pem", hosts: "certs.internal"},
+		{url: "https://sns.us-east-1.amazonaws.com/cert.pem", hosts: "certs.internal", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.url+" "+tc.hosts, func(t *testing.T) {
+			err := newSNSVerifier("", tc.hosts, nil).allowedCertURL(tc.url)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("allowedCertURL returned %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// Without a bundle the signing certificate is fetched from an allowed host once
+// and then cached.
+func TestSNSVerifierFetchesCertificate(t *testing.T) {
+	key, pemBytes := newSigningCert(t)
+	var fetches int64
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		_, _ = w.Write(pemBytes)
+	}))
+	defer server.Close()
+
+	v := newSNSVerifier("", "127.0.0.1", []string{testTopic})
+	v.httpClient = server.Client()
+
+	for i := 0; i < 2; i++ {
+		env := signedEnvelope(t, key, "2")
+		env.SigningCertURL = server.URL + "/cert.pem"
+		if err := v.verify(context.Background(), env); err != nil {
+			t.Fatalf("verify returned %v", err)
+		}
+	}
+	if got := atomic.LoadInt64(&fetches); got != 1 {
+		t.Errorf("fetched the certificate %d times, want 1", got)
+	}
+}
+
+// With verification on, the listener rejects and logs unsigned and raw messages.
+func TestAutoscalingListenerRejectsUnverifiedMessages(t *testing.T) {
+	key, pemBytes := newSigningCert(t)
+	signed, _ := json.Marshal(signedEnvelope(t, key, "2"))
+	unsigned, _ := json.Marshal(&Envelope{Type: "Notification", TopicArn: testTopic, Message: `{"EC2InstanceId":"i-1"}`})
+
+	tests := []struct {
+		name   string
+		body   string
+		wantOK bool
+	}{
+		{name: "signed", body: string(signed), wantOK: true},
+		{name: "unsigned", body: string(unsigned)},
+		{name: "raw", body: `{"EC2InstanceId":"i-1"}`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			listener := NewAutoscalingListener("i-1", nil, &stubAutoscalingClient{}, time.Minute)
+			listener.verifier = newSNSVerifier(writeBundle(t, pemBytes), "", []string{testTopic})
+			if err := listener.verifier.load(); err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			logger, hook := logrustest.NewNullLogger()
+
+			_, ok := listener.parseMessage(context.Background(), sqstypes.Message{Body: aws.String(tc.body)}, logrus.NewEntry(logger))
+			if ok != tc.wantOK {
+				t.Errorf("parseMessage ok = %v, want %v", ok, tc.wantOK)
+			}
+			if !tc.wantOK && !logged(hook.AllEntries(), "Rejecting") {
+				t.Errorf("expected the rejection to be logged, got %v", messages(hook.AllEntries()))
+			}
+		})
+	}
+}
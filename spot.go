@@ -44,7 +44,7 @@ func (l *SpotListener) Type() string {
 // Start the spot termination notice listener.
 func (l *SpotListener) Start(ctx context.Context, notices chan<- TerminationNotice, log *logrus.Entry) error {
 	// Probe the metadata service once so we fail fast when not on EC2.
-	if _, err := l.metadataValue(ctx, "instance-id"); err != nil {
+	if _, err := metadataValue(ctx, l.metadata, "instance-id"); err != nil {
 		return fmt.Errorf("ec2 metadata is not available: %w", err)
 	}
 
@@ -58,15 +58,14 @@ func (l *SpotListener) Start(ctx context.Context, notices chan<- TerminationNoti
 		case <-ticker.C:
 			log.Debug("Polling ec2 metadata for spot termination notices")
 
-			out, err := l.metadataValue(ctx, "spot/termination-time")
+			out, err := metadataValue(ctx, l.metadata, "spot/termination-time")
 			if err != nil {
 				// Shutting down: the next loop iteration returns via ctx.Done().
 				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 					continue
 				}
 				// Metadata returns 404 when there is no termination notice available
-				var statusErr interface{ HTTPStatusCode() int }
-				if errors.As(err, &statusErr) && statusErr.HTTPStatusCode() == http.StatusNotFound {
+				if metadataNotFound(err) {
 					continue
 				}
 				log.WithError(err).Warn("Failed to get spot termination")
@@ -93,8 +92,8 @@ func (l *SpotListener) Start(ctx context.Context, notices chan<- TerminationNoti
 }
 
 // metadataValue fetches a single instance metadata path and returns its value.
-func (l *SpotListener) metadataValue(ctx context.Context, path string) (string, error) {
-	out, err := l.metadata.GetMetadata(ctx, &imds.GetMetadataInput{Path: path})
+func metadataValue(ctx context.Context, metadata MetadataClient, path string) (string, error) {
+	out, err := metadata.GetMetadata(ctx, &imds.GetMetadataInput{Path: path})
 	if err != nil {
 		return "", err
 	}
@@ -106,6 +105,13 @@ func (l *SpotListener) metadataValue(ctx context.Context, path string) (string,
 	return strings.TrimSpace(string(b)), nil
 }
 
+// metadataNotFound reports whether err is the 404 the metadata service returns
+// for a path that has no value.
+func metadataNotFound(err error) bool {
+	var statusErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &statusErr) && statusErr.HTTPStatusCode() == http.StatusNotFound
+}
+
 type spotTerminationNotice struct {
 	noticeType      string
 	instanceID      string
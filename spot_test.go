@@ -167,6 +167,16 @@ func logged(entries []*logrus.Entry, substr string) bool {
 	return false
 }
 
+// loggedAt reports whether an entry at level contains substr.
+func loggedAt(entries []*logrus.Entry, level logrus.Level, substr string) bool {
+	for _, e := range entries {
+		if e.Level == level && strings.Contains(e.Message, substr) {
+			return true
+		}
+	}
+	return false
+}
+
 func messages(entries []*logrus.Entry) []string {
 	msgs := make([]string, 0, len(entries))
 	for _, e := range entries {
@@ -0,0 +1,223 @@
+package lifecycled
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// noticeStateFile holds the in-flight notice within the state directory.
+	noticeStateFile = "notice.json"
+
+	// seenMessagesFile holds the lifecycle action tokens already seen.
+	seenMessagesFile = "seen.json"
+
+	// Handler progress recorded against a persisted notice.
+	progressAccepted = "accepted"
+	progressHandling = "handling"
+	progressHandled  = "handled"
+)
+
+// noticeState is the on-disk record of an accepted termination notice. It holds
+// enough to rebuild the notice after a restart, so a daemon killed mid-drain (by
+// the OOM killer, say) resumes heartbeating and completing the action instead of
+// leaving the lifecycle hook to time out.
+type noticeState struct {
+	Type            string     `json:"type"`
+	Transition      string     `json:"transition"`
+	InstanceID      string     `json:"instanceId"`
+	Messages        []*Message `json:"messages,omitempty"`
+	TerminationTime time.Time  `json:"terminationTime,omitempty"`
+	Progress        string     `json:"progress"`
+}
+
+// stateStore persists daemon state as JSON files in a directory.
+type stateStore struct {
+	dir string
+}
+
+func newStateStore(dir string) *stateStore {
+	return &stateStore{dir: dir}
+}
+
+// load decodes the named file into v, reporting false if it doesn't exist.
+func (s *stateStore) load(name string, v interface{}) (bool, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, fmt.Errorf("decode %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// save writes v to the named file. It writes a temporary file and renames it
+// into place so a crash mid-write leaves the previous record intact.
+func (s *stateStore) save(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(s.dir, name))
+}
+
+// remove deletes the named file; a file that is already gone is not an error.
+func (s *stateStore) remove(name string) error {
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// newNoticeState returns the record for a notice, or false for a notice type
+// that can't be resumed.
+func newNoticeState(n TerminationNotice) (*noticeState, bool) {
+	switch n := n.(type) {
+	case *autoscalingTerminationNotice:
+		return &noticeState{
+			Type:       n.noticeType,
+			Transition: n.messages[0].Transition,
+			InstanceID: n.messages[0].InstanceID,
+			Messages:   n.messages,
+			Progress:   progressAccepted,
+		}, true
+	case *spotTerminationNotice:
+		return &noticeState{
+			Type:            n.noticeType,
+			Transition:      n.transition,
+			InstanceID:      n.instanceID,
+			TerminationTime: n.terminationTime,
+			Progress:        progressAccepted,
+		}, true
+	}
+	return nil, false
+}
+
+// restoreNotice rebuilds the notice a noticeState was recorded from.
+func (d *Daemon) restoreNotice(s *noticeState) (TerminationNotice, error) {
+	switch {
+	case len(s.Messages) > 0:
+		return &autoscalingTerminationNotice{
+			noticeType:        s.Type,
+			messages:          s.Messages,
+			autoscaling:       d.autoscaling,
+			heartbeatInterval: d.heartbeatInterval,
+		}, nil
+	case !s.TerminationTime.IsZero():
+		return &spotTerminationNotice{
+			noticeType:      s.Type,
+			instanceID:      s.InstanceID,
+			transition:      s.Transition,
+			terminationTime: s.TerminationTime,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown notice type %q", s.Type)
+}
+
+// persistNotice records an accepted notice and returns it wrapped so handler
+// progress is recorded too. Notices that can't be resumed are returned as is.
+func (d *Daemon) persistNotice(n TerminationNotice, log *logrus.Entry) TerminationNotice {
+	state, ok := newNoticeState(n)
+	if !ok {
+		return n
+	}
+	if err := d.state.save(noticeStateFile, state); err != nil {
+		log.WithError(err).Error("Failed to persist termination notice")
+	}
+	return &persistedNotice{TerminationNotice: n, store: d.state, state: state}
+}
+
+// resumeNotice returns the notice persisted by a previous run, if there is one.
+// A notice recorded for another instance, left in the state directory of the
+// image this instance was launched from, is removed rather than resumed.
+func (d *Daemon) resumeNotice(log *logrus.Entry) (TerminationNotice, error) {
+	var state noticeState
+	ok, err := d.state.load(noticeStateFile, &state)
+	if err != nil || !ok {
+		return nil, err
+	}
+	if state.InstanceID != d.instanceID {
+		log.WithField("noticeInstanceId", state.InstanceID).Warn("Discarding persisted termination notice for another instance")
+		return nil, d.state.remove(noticeStateFile)
+	}
+	n, err := d.restoreNotice(&state)
+	if err != nil {
+		return nil, err
+	}
+	return &persistedNotice{TerminationNotice: n, store: d.state, state: &state}, nil
+}
+
+// persistedNotice records handler progress for a notice in the state directory
+// and clears the record once the notice has been handled.
+type persistedNotice struct {
+	TerminationNotice
+	store *stateStore
+	state *noticeState
+}
+
+func (n *persistedNotice) Handle(ctx context.Context, handler Handler, log *logrus.Entry) error {
+	err := n.TerminationNotice.Handle(ctx, &progressHandler{handler: handler, notice: n, log: log}, log)
+	if rmErr := n.store.remove(noticeStateFile); rmErr != nil {
+		log.WithError(rmErr).Error("Failed to clear persisted termination notice")
+	}
+	return err
+}
+
+// setProgress records the handler's progress against the notice.
+func (n *persistedNotice) setProgress(progress string, log *logrus.Entry) {
+	n.state.Progress = progress
+	if err := n.store.save(noticeStateFile, n.state); err != nil {
+		log.WithError(err).Error("Failed to persist handler progress")
+	}
+}
+
+// progressHandler wraps the handler so a notice resumed after a restart doesn't
+// run a handler that already finished.
+type progressHandler struct {
+	handler Handler
+	notice  *persistedNotice
+	log     *logrus.Entry
+}
+
+func (h *progressHandler) Execute(ctx context.Context, args ...string) error {
+	if h.notice.state.Progress == progressHandled {
+		h.log.Info("Handler already finished before restart, skipping")
+		return nil
+	}
+	h.notice.setProgress(progressHandling, h.log)
+	err := h.handler.Execute(ctx, args...)
+	h.notice.setProgress(progressHandled, h.log)
+	return err
+}
@@ -0,0 +1,296 @@
+package lifecycled
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// staticListener emits a single notice and returns.
+type staticListener struct {
+	notice TerminationNotice
+}
+
+func (l *staticListener) Type() string {
+	return "static"
+}
+
+func (l *staticListener) Start(_ context.Context, notices chan<- TerminationNotice, _ *logrus.Entry) error {
+	notices <- l.notice
+	return nil
+}
+
+// countingHandler counts how often it is executed.
+type countingHandler struct {
+	calls int64
+}
+
+func (h *countingHandler) Execute(context.Context, ...string) error {
+	atomic.AddInt64(&h.calls, 1)
+	return nil
+}
+
+func TestStateStoreRoundTrip(t *testing.T) {
+	store := newStateStore(filepath.Join(t.TempDir(), "state"))
+
+	var got noticeState
+	if ok, err := store.load(noticeStateFile, &got); err != nil || ok {
+		t.Fatalf("load on an empty store = %v, %v; want false, nil", ok, err)
+	}
+
+	want := noticeState{Type: "spot", Transition: "ec2:SPOT_INSTANCE_TERMINATION", InstanceID: "i-1", Progress: progressHandling}
+	if err := store.save(noticeStateFile, &want); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if ok, err := store.load(noticeStateFile, &got); err != nil || !ok {
+		t.Fatalf("load = %v, %v; want true, nil", ok, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %+v, want %+v", got, want)
+	}
+
+	if err := store.remove(noticeStateFile); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := store.remove(noticeStateFile); err != nil {
+		t.Errorf("removing a missing file returned %v, want nil", err)
+	}
+}
+
+// An accepted notice is written to the state directory before the daemon hands
+// it back, and the record is cleared once the notice has been handled.
+func TestDaemonPersistsAcceptedNotice(t *testing.T) {
+	dir := t.TempDir()
+	logger, _ := logrustest.NewNullLogger()
+	daemon := NewDaemon(&Config{InstanceID: "i-1", StateDir: dir}, nil, nil, &stubAutoscalingClient{}, nil, logger)
+	daemon.AddListener(&staticListener{notice: &spotTerminationNotice{
+		noticeType:      "spot",
+		instanceID:      "i-1",
+		transition:      "ec2:SPOT_INSTANCE_TERMINATION",
+		terminationTime: time.Now(),
+	}})
+
+	notice, err := daemon.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	var state noticeState
+	if ok, err := newStateStore(dir).load(noticeStateFile, &state); err != nil || !ok {
+		t.Fatalf("expected the accepted notice to be persisted, got %v, %v", ok, err)
+	}
+	if state.Progress != progressAccepted {
+		t.Errorf("progress = %q, want %q", state.Progress, progressAccepted)
+	}
+
+	handler := &countingHandler{}
+	if err := notice.Handle(context.Background(), handler, logrus.NewEntry(logger)); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	if got := atomic.LoadInt64(&handler.calls); got != 1 {
+		t.Errorf("handler ran %d times, want 1", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, noticeStateFile)); !os.IsNotExist(err) {
+		t.Errorf("expected the notice record to be cleared after handling, stat returned %v", err)
+	}
+}
+
+// A notice persisted by another instance, such as one baked into the image the
+// instance was launched from, is removed instead of being resumed.
+func TestDaemonDiscardsNoticeForAnotherInstance(t *testing.T) {
+	dir := t.TempDir()
+	if err := newStateStore(dir).save(noticeStateFile, &noticeState{
+		Type:            "spot",
+		Transition:      "ec2:SPOT_INSTANCE_TERMINATION",
+		InstanceID:      "i-other",
+		TerminationTime: time.Now(),
+		Progress:        progressHandling,
+	}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	logger, hook := logrustest.NewNullLogger()
+	daemon := NewDaemon(&Config{InstanceID: "i-1", StateDir: dir}, nil, nil, &stubAutoscalingClient{}, nil, logger)
+	want := &spotTerminationNotice{noticeType: "spot", instanceID: "i-1", transition: "ec2:SPOT_INSTANCE_TERMINATION", terminationTime: time.Now()}
+	daemon.AddListener(&staticListener{notice: want})
+
+	notice, err := daemon.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	persisted, ok := notice.(*persistedNotice)
+	if !ok || persisted.TerminationNotice != want {
+		t.Fatalf("Start returned %v, want the listener's notice", notice)
+	}
+	if !logged(hook.AllEntries(), "Discarding persisted termination notice for another instance") {
+		t.Errorf("expected the discarded notice to be logged, got %v", messages(hook.AllEntries()))
+	}
+
+	var state noticeState
+	if ok, err := newStateStore(dir).load(noticeStateFile, &state); err != nil || !ok || state.InstanceID != "i-1" {
+		t.Errorf("persisted notice is for %q (%v, %v), want the new notice for i-1", state.InstanceID, ok, err)
+	}
+}
+
+// A restarted daemon resumes a persisted autoscaling notice without starting its
+// listeners, completes the lifecycle action, and only re-runs the handler if it
+// hadn't already finished.
+func TestDaemonResumesPersistedNotice(t *testing.T) {
+	tests := []struct {
+		progress    string
+		wantHandler int64
+	}{
+		{progress: progressAccepted, wantHandler: 1},
+		{progress: progressHandling, wantHandler: 1},
+		{progress: progressHandled, wantHandler: 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.progress, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := newStateStore(dir).save(noticeStateFile, &noticeState{
+				Type:       "autoscaling",
+				Transition: "autoscaling:EC2_INSTANCE_TERMINATING",
+				InstanceID: "i-1",
+				Messages:   []*Message{{GroupName: "group", HookName: "hook", InstanceID: "i-1", ActionToken: "token"}},
+				Progress:   tc.progress,
+			}); err != nil {
+				t.Fatalf("save: %v", err)
+			}
+
+			as := &stubAutoscalingClient{}
+			logger, _ := logrustest.NewNullLogger()
+			daemon := NewDaemon(&Config{InstanceID: "i-1", StateDir: dir, AutoscalingHeartbeatInterval: time.Minute}, nil, nil, as, nil, logger)
+			// A listener that would hand back a nil notice proves the resumed notice
+			// short-circuits the listeners.
+			daemon.AddListener(&staticListener{})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			notice, err := daemon.Start(ctx)
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			if notice == nil || notice.Type() != "autoscaling" {
+				t.Fatalf("expected the persisted autoscaling notice, got %v", notice)
+			}
+
+			handler := &countingHandler{}
+			if err := notice.Handle(ctx, handler, logrus.NewEntry(logger)); err != nil {
+				t.Fatalf("Handle: %v", err)
+			}
+			if got := atomic.LoadInt64(&handler.calls); got != tc.wantHandler {
+				t.Errorf("handler ran %d times, want %d", got, tc.wantHandler)
+			}
+			if got := atomic.LoadInt64(&as.completes); got != 1 {
+				t.Errorf("CompleteLifecycleAction called %d times, want 1", got)
+			}
+		})
+	}
+}
+
+// Listeners share one record of the messages seen, since they persist it to the
+// same file.
+func TestDaemonSharesSeenMessages(t *testing.T) {
+	logger, _ := logrustest.NewNullLogger()
+	daemon := NewDaemon(&Config{
+		InstanceID:          "i-1",
+		SQSQueueURL:         "https://sqs.us-east-1.amazonaws.com/123456789012/lifecycle",
+		EventBridgeQueueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/events",
+		StateDir:            t.TempDir(),
+	}, nil, nil, &stubAutoscalingClient{}, nil, logger)
+
+	var seen []*seenMessages
+	for _, l := range daemon.listeners {
+		switch l := l.(type) {
+		case *AutoscalingListener:
+			seen = append(seen, l.seen)
+		case *EventBridgeListener:
+			seen = append(seen, l.seen)
+		}
+	}
+	if len(seen) != 2 || seen[0] != seen[1] || seen[0].store == nil {
+		t.Errorf("listeners have seen records %p, want one shared record backed by the state directory", seen)
+	}
+}
+
+// With a queue per topic, the daemon merges the hooks of every queue's notice
+// that arrives within the hook window into the first.
+func TestDaemonCollectsHooksFromEveryQueue(t *testing.T) {
+	notice := func(hooks ...string) *autoscalingTerminationNotice {
+		n := &autoscalingTerminationNotice{noticeType: "autoscaling"}
+		for _, hook := range hooks {
+			n.messages = append(n.messages, &Message{GroupName: "group", HookName: hook, InstanceID: "i-1"})
+		}
+		return n
+	}
+	tests := []struct {
+		name    string
+		notices []*autoscalingTerminationNotice
+		want    []string
+	}{
+		{
+			name:    "every queue",
+			notices: []*autoscalingTerminationNotice{notice("hook-a"), notice("hook-b", "hook-a")},
+			want:    []string{"hook-a", "hook-b"},
+		},
+		{
+			name:    "window closes",
+			notices: []*autoscalingTerminationNotice{notice("hook-a")},
+			want:    []string{"hook-a"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logger, _ := logrustest.NewNullLogger()
+			daemon := NewDaemon(&Config{InstanceID: "i-1", AutoscalingHookWindow: 50 * time.Millisecond}, nil, nil, &stubAutoscalingClient{}, nil, logger)
+			daemon.hookQueues = 2
+			for _, n := range tc.notices {
+				daemon.AddListener(&staticListener{notice: n})
+			}
+
+			notice, err := daemon.Start(context.Background())
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			merged, ok := notice.(*autoscalingTerminationNotice)
+			if !ok {
+				t.Fatalf("Start returned %T, want an autoscaling notice", notice)
+			}
+			var hooks []string
+			for _, m := range merged.messages {
+				hooks = append(hooks, m.HookName)
+			}
+			slices.Sort(hooks)
+			if !slices.Equal(hooks, tc.want) {
+				t.Errorf("notice has hooks %v, want %v", hooks, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateQueuePerTopic(t *testing.T) {
+	tests := []struct {
+		topics  string
+		window  time.Duration
+		wantErr bool
+	}{
+		{topics: "arn:aws:sns:us-east-1:123456789012:a", wantErr: false},
+		{topics: "arn:aws:sns:us-east-1:123456789012:a,arn:aws:sns:us-east-1:123456789012:b", wantErr: true},
+		{topics: "arn:aws:sns:us-east-1:123456789012:a,arn:aws:sns:us-east-1:123456789012:b", window: time.Minute, wantErr: false},
+	}
+	for _, tc := range tests {
+		if err := ValidateQueuePerTopic(tc.topics, tc.window); (err != nil) != tc.wantErr {
+			t.Errorf("ValidateQueuePerTopic(%q, %s) = %v, want error %v", tc.topics, tc.window, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package lifecycled
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// targetLifecycleStatePath is the instance metadata path holding the lifecycle
+	// state Auto Scaling is moving the instance to.
+	targetLifecycleStatePath = "autoscaling/target-lifecycle-state"
+
+	// Target lifecycle states read from instance metadata.
+	targetInService  = "InService"
+	targetTerminated = "Terminated"
+	targetWarmed     = "Warmed:"
+)
+
+// NewTargetLifecycleListener returns a listener that detects termination, and a
+// return to the warm pool, from the instance's target lifecycle state in
+// instance metadata.
+func NewTargetLifecycleListener(instanceID string, metadata MetadataClient, autoscaling AutoscalingClient, interval, heartbeatInterval time.Duration) *TargetLifecycleListener {
+	return &TargetLifecycleListener{
+		listenerType:      "autoscaling-metadata",
+		instanceID:        instanceID,
+		metadata:          metadata,
+		autoscaling:       autoscaling,
+		interval:          interval,
+		heartbeatInterval: heartbeatInterval,
+	}
+}
+
+// TargetLifecycleListener polls autoscaling/target-lifecycle-state in instance
+// metadata. Like the spot listener it needs no SNS topic or SQS queue, and
+// polling metadata is free, but it only sees the state: the lifecycle hook is
+// looked up through the Auto Scaling API so it can still be completed.
+type TargetLifecycleListener struct {
+	listenerType      string
+	instanceID        string
+	metadata          MetadataClient
+	autoscaling       AutoscalingClient
+	interval          time.Duration
+	heartbeatInterval time.Duration
+
+	// hookName, when set, is the termination hook completed; otherwise the
+	// group's one termination hook is.
+	hookName string
+}
+
+// Type returns a string describing the listener type.
+func (l *TargetLifecycleListener) Type() string {
+	return l.listenerType
+}
+
+// Start the target lifecycle state listener.
+func (l *TargetLifecycleListener) Start(ctx context.Context, notices chan<- TerminationNotice, log *logrus.Entry) error {
+	// Probe the metadata service once so we fail fast when not on EC2, or when the
+	// instance isn't part of a group and the path doesn't exist.
+	state, err := metadataValue(ctx, l.metadata, targetLifecycleStatePath)
+	if err != nil {
+		if metadataNotFound(err) {
+			return fmt.Errorf("instance %s is not part of an autoscaling group", l.instanceID)
+		}
+		return fmt.Errorf("ec2 metadata is not available: %w", err)
+	}
+	// An instance launched into the warm pool starts with a Warmed target state,
+	// so only a move to the warm pool from service is a scale-in.
+	inService := state == targetInService
+
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			log.Debug("Polling ec2 metadata for the target lifecycle state")
+
+			state, err := metadataValue(ctx, l.metadata, targetLifecycleStatePath)
+			if err != nil {
+				// Shutting down: the next loop iteration returns via ctx.Done().
+				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+					continue
+				}
+				// Poll no sooner than the failure's class calls for.
+				ticker.Reset(max(l.interval, logPollError(log, err, "Failed to get target lifecycle state")))
+				continue
+			}
+			ticker.Reset(l.interval)
+
+			switch {
+			case state == targetInService:
+				inService = true
+				continue
+			case state == targetTerminated, state == targetWarmed+targetTerminated:
+			case strings.HasPrefix(state, targetWarmed) && inService:
+			default:
+				continue
+			}
+			log.WithField("state", state).Info("Instance is leaving service")
+			notices <- l.notice(ctx, state, log)
+			return nil
+		}
+	}
+}
+
+// notice returns the notice for a move to the target state. The hook is looked
+// up so it can be completed; if that fails the handler still runs, and the hook
+// is left to time out.
+func (l *TargetLifecycleListener) notice(ctx context.Context, state string, log *logrus.Entry) TerminationNotice {
+	noticeType := l.Type()
+	if strings.HasPrefix(state, targetWarmed) && state != targetWarmed+targetTerminated {
+		noticeType = "warm-pool"
+	}
+
+	group, _, err := describeLifecycleState(ctx, l.autoscaling, l.instanceID)
+	var messages []*Message
+	if err == nil && group != "" {
+		messages, err = terminationHooks(ctx, l.autoscaling, group, l.instanceID, l.hookName)
+	}
+	if err != nil || len(messages) == 0 {
+		switch {
+		case errors.Is(err, errSeveralTerminationHooks):
+			log.WithError(err).Error("Can't tell which termination lifecycle hook is lifecycled's, none will be heartbeated or completed")
+		case err != nil:
+			log.WithError(err).Warn("Failed to find the termination lifecycle hook, it won't be heartbeated or completed")
+		default:
+			log.Warn("Failed to find the termination lifecycle hook, it won't be heartbeated or completed")
+		}
+		return &targetLifecycleNotice{noticeType: noticeType, instanceID: l.instanceID, targetState: state}
+	}
+	for _, m := range messages {
+		m.TargetState = state
+	}
+	return &autoscalingTerminationNotice{
+		noticeType:        noticeType,
+		messages:          messages,
+		autoscaling:       l.autoscaling,
+		heartbeatInterval: l.heartbeatInterval,
+	}
+}
+
+// targetLifecycleNotice runs the handler for a termination, or a target state
+// change, whose lifecycle hook couldn't be found or told apart from others.
+type targetLifecycleNotice struct {
+	noticeType  string
+	instanceID  string
+	targetState string
+}
+
+func (n *targetLifecycleNotice) Type() string {
+	return n.noticeType
+}
+
+func (n *targetLifecycleNotice) Handle(ctx context.Context, handler Handler, _ *logrus.Entry) error {
+	args := []string{terminatingTransition, n.instanceID}
+	if n.targetState != "" {
+		args = append(args, n.targetState)
+	}
+	return handler.Execute(ctx, args...)
+}
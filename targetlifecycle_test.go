@@ -0,0 +1,164 @@
+package lifecycled
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	astypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// sequenceMetadataClient returns the target lifecycle states in turn, repeating
+// the last one.
+type sequenceMetadataClient struct {
+	mu     sync.Mutex
+	states []string
+}
+
+func (c *sequenceMetadataClient) GetMetadata(context.Context, *imds.GetMetadataInput, ...func(*imds.Options)) (*imds.GetMetadataOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := c.states[0]
+	if len(c.states) > 1 {
+		c.states = c.states[1:]
+	}
+	return &imds.GetMetadataOutput{Content: io.NopCloser(strings.NewReader(state))}, nil
+}
+
+// notFoundError is the 404 the metadata service returns for a missing path.
+type notFoundError struct{}
+
+func (notFoundError) Error() string       { return "404 - not found" }
+func (notFoundError) HTTPStatusCode() int { return http.StatusNotFound }
+
+// argsHandler records the arguments it is executed with.
+type argsHandler struct {
+	args []string
+}
+
+func (h *argsHandler) Execute(_ context.Context, args ...string) error {
+	h.args = args
+	return nil
+}
+
+func TestTargetLifecycleListener(t *testing.T) {
+	hooks := []astypes.LifecycleHook{
+		{LifecycleHookName: aws.String("drain"), LifecycleTransition: aws.String(terminatingTransition)},
+	}
+
+	tests := []struct {
+		name          string
+		states        []string
+		group         string
+		hooks         []astypes.LifecycleHook
+		hookName      string
+		wantType      string
+		wantArgs      []string
+		wantCompleted []string
+	}{
+		{
+			name:          "termination completes the group's termination hooks",
+			states:        []string{"InService", "InService", "Terminated"},
+			group:         "group",
+			wantType:      "autoscaling-metadata",
+			wantArgs:      []string{terminatingTransition, "i-1", "Terminated"},
+			wantCompleted: []string{"drain"},
+		},
+		{
+			name:          "a configured hook name is completed without looking it up",
+			states:        []string{"InService", "Terminated"},
+			group:         "group",
+			hookName:      "configured",
+			wantType:      "autoscaling-metadata",
+			wantArgs:      []string{terminatingTransition, "i-1", "Terminated"},
+			wantCompleted: []string{"configured"},
+		},
+		{
+			name:          "a return to the warm pool from service is a warm pool notice",
+			states:        []string{"Warmed:Stopped", "Warmed:Stopped", "InService", "Warmed:Stopped"},
+			group:         "group",
+			wantType:      "warm-pool",
+			wantArgs:      []string{terminatingTransition, "i-1", "Warmed:Stopped"},
+			wantCompleted: []string{"drain"},
+		},
+		{
+			name:   "several termination hooks aren't guessed between",
+			states: []string{"InService", "Terminated"},
+			group:  "group",
+			hooks: append(slices.Clone(hooks),
+				astypes.LifecycleHook{LifecycleHookName: aws.String("log-archiver"), LifecycleTransition: aws.String(terminatingTransition)}),
+			wantType: "autoscaling-metadata",
+			wantArgs: []string{terminatingTransition, "i-1", "Terminated"},
+		},
+		{
+			name:     "an unknown hook still runs the handler",
+			states:   []string{"InService", "Terminated"},
+			wantType: "autoscaling-metadata",
+			wantArgs: []string{terminatingTransition, "i-1", "Terminated"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			groupHooks := hooks
+			if tc.hooks != nil {
+				groupHooks = tc.hooks
+			}
+			as := &pollingASGClient{
+				stubAutoscalingClient: stubAutoscalingClient{hooks: groupHooks},
+				group:                 tc.group,
+				states:                []string{"Terminating:Wait"},
+			}
+			listener := NewTargetLifecycleListener("i-1", &sequenceMetadataClient{states: tc.states}, as, time.Millisecond, time.Minute)
+			listener.hookName = tc.hookName
+			logger, _ := logrustest.NewNullLogger()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			notices := make(chan TerminationNotice, 1)
+			if err := listener.Start(ctx, notices, logrus.NewEntry(logger)); err != nil {
+				t.Fatalf("Start returned error: %v", err)
+			}
+			notice := <-notices
+			if notice.Type() != tc.wantType {
+				t.Errorf("notice type = %q, want %q", notice.Type(), tc.wantType)
+			}
+
+			handler := &argsHandler{}
+			if err := notice.Handle(ctx, handler, logrus.NewEntry(logger)); err != nil {
+				t.Fatalf("Handle returned error: %v", err)
+			}
+			if !slices.Equal(handler.args, tc.wantArgs) {
+				t.Errorf("handler args = %v, want %v", handler.args, tc.wantArgs)
+			}
+
+			var completed []string
+			for _, in := range as.completed {
+				completed = append(completed, aws.ToString(in.LifecycleHookName))
+			}
+			if !slices.Equal(completed, tc.wantCompleted) {
+				t.Errorf("completed hooks = %v, want %v", completed, tc.wantCompleted)
+			}
+		})
+	}
+}
+
+func TestTargetLifecycleListenerFailsOutsideAGroup(t *testing.T) {
+	listener := NewTargetLifecycleListener("i-1", &stubMetadataClient{err: notFoundError{}}, &pollingASGClient{}, time.Millisecond, time.Minute)
+	logger, _ := logrustest.NewNullLogger()
+
+	err := listener.Start(context.Background(), make(chan TerminationNotice, 1), logrus.NewEntry(logger))
+	if err == nil || !strings.Contains(err.Error(), "not part of an autoscaling group") {
+		t.Fatalf("Start returned %v, want an error for an instance outside a group", err)
+	}
+}
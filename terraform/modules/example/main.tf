@@ -165,6 +165,7 @@ data "aws_iam_policy_document" "permissions" {
     actions = [
       "sns:Subscribe",
       "sns:Unsubscribe",
+      "sns:GetSubscriptionAttributes",
     ]
 
     resources = [
@@ -201,6 +202,7 @@ data "aws_iam_policy_document" "permissions" {
     actions = [
       "autoscaling:RecordLifecycleActionHeartbeat",
       "autoscaling:CompleteLifecycleAction",
+      "autoscaling:DescribeLifecycleHooks",
     ]
 
     resources = ["*"]
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"flag"
 	"log"
+	"path"
 	"regexp"
 	"strings"
 	"sync"
@@ -17,16 +18,25 @@ import (
 	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
-	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/aws/smithy-go"
+	"github.com/buildkite/lifecycled"
 )
 
 func main() {
 	parallel := flag.Int("parallel", 20, "The number of parallel deletes to run")
 	account := flag.String("account", "", "If set, abort unless the resolved AWS account ID matches")
+	template := flag.String("queue-name-template", lifecycled.DefaultQueueNameTemplate, "The queue name template lifecycled was run with")
+	prefix := flag.String("queue-prefix", lifecycled.DefaultQueuePrefix, "The queue prefix lifecycled was run with")
 	flag.Parse()
 
+	naming := lifecycled.QueueNaming{Template: *template, Prefix: *prefix}
+	pattern, err := naming.Pattern()
+	if err != nil {
+		log.Fatalf("Invalid queue name template: %s", err)
+	}
+	log.Printf("Matching queues named like %s", pattern)
+
 	ctx := context.Background()
 
 	// LoadDefaultConfig loads ~/.aws/config so region, named profiles, and SSO
@@ -56,7 +66,7 @@ func main() {
 	log.Printf("Using account %s as %s", aws.ToString(ident.Account), aws.ToString(ident.Arn))
 
 	for {
-		count, err := deleteInactiveSubscriptions(ctx, snsClient)
+		count, err := deleteInactiveSubscriptions(ctx, snsClient, pattern)
 		if err != nil {
 			fatalAWS(err)
 		}
@@ -69,7 +79,7 @@ func main() {
 	}
 
 	for {
-		count, err := deleteInactiveQueues(ctx, sqsClient, ec2Client, *parallel)
+		count, err := deleteInactiveQueues(ctx, sqsClient, ec2Client, naming.ListPrefix(), pattern, *parallel)
 		if err != nil {
 			fatalAWS(err)
 		}
@@ -98,40 +108,35 @@ func accountMatches(expected, resolved string) bool {
 	return expected == "" || expected == resolved
 }
 
-// credentialExpiryCodes are the AWS error codes meaning the credentials
-// (temporary STS credentials or the cached SSO token) expired and need a refresh.
-var credentialExpiryCodes = map[string]struct{}{
-	`ExpiredToken`:            {},
-	`ExpiredTokenException`:   {},
-	`RequestExpired`:          {},
-	`SSOProviderInvalidToken`: {},
-}
-
 // fatalAWS ends the run, adding a re-auth hint when the failure is expired
-// credentials. Re-running is safe: each run re-lists from scratch and resumes
+// or invalid credentials, and naming the missing permission when access was
+// denied. Re-running is safe: each run re-lists from scratch and resumes
 // where the last left off. Aborting on any AWS error (rather than skipping the
 // offending resource) is deliberate: the SDK already retries transient failures,
 // so an error reaching here is unexpected and worth stopping on.
 func fatalAWS(err error) {
 	if apiErr, expired := expiredCredential(err); expired {
-		log.Fatalf("Credentials expired mid-run (%s); refresh them (e.g. `aws sso login`) and run again to resume: %s", apiErr.ErrorCode(), err)
+		log.Fatalf("Credentials expired or invalid mid-run (%s); refresh them (e.g. `aws sso login`) and run again to resume: %s", apiErr.ErrorCode(), err)
+	}
+	if action := lifecycled.FailedAction(err); action != "" && lifecycled.ClassifyError(err) == lifecycled.ErrorAccessDenied {
+		log.Fatalf("Access denied; the credentials need %s (see Required IAM permissions in the README): %s", action, err)
 	}
 	log.Fatal(err)
 }
 
 // expiredCredential returns the AWS API error and true when its code means the
-// credentials (temporary STS credentials or the cached SSO token) expired.
+// credentials (temporary STS credentials or the cached SSO token) expired or
+// are invalid, classified the same way as in lifecycled itself.
 func expiredCredential(err error) (smithy.APIError, bool) {
 	var apiErr smithy.APIError
 	if !errors.As(err, &apiErr) {
 		return nil, false
 	}
-	_, expired := credentialExpiryCodes[apiErr.ErrorCode()]
-	return apiErr, expired
+	return apiErr, lifecycled.ClassifyError(err) == lifecycled.ErrorCredentials
 }
 
-func deleteInactiveQueues(ctx context.Context, sqsClient *sqs.Client, ec2Client *ec2.Client, parallel int) (uint64, error) {
-	queues, err := listInactiveQueues(ctx, sqsClient, ec2Client)
+func deleteInactiveQueues(ctx context.Context, sqsClient *sqs.Client, ec2Client *ec2.Client, prefix string, pattern *regexp.Regexp, parallel int) (uint64, error) {
+	queues, err := listInactiveQueues(ctx, sqsClient, ec2Client, prefix, pattern)
 	if err != nil {
 		return 0, err
 	}
@@ -241,12 +246,13 @@ type SQSClient interface {
 	DeleteQueue(context.Context, *sqs.DeleteQueueInput, ...func(*sqs.Options)) (*sqs.DeleteQueueOutput, error)
 }
 
-func listQueues(ctx context.Context, client SQSClient) ([]string, error) {
+// listQueues returns the URLs of the queues whose names start with prefix.
+func listQueues(ctx context.Context, client SQSClient, prefix string) ([]string, error) {
 	var urls []string
 	// MaxResults is required for SQS to return a NextToken; without it the
 	// response caps at 1000 URLs and the paginator stops after one page.
 	paginator := sqs.NewListQueuesPaginator(client, &sqs.ListQueuesInput{
-		QueueNamePrefix: aws.String(`lifecycled-`),
+		QueueNamePrefix: aws.String(prefix),
 		MaxResults:      aws.Int32(1000),
 	})
 	for paginator.HasMorePages() {
@@ -259,9 +265,7 @@ func listQueues(ctx context.Context, client SQSClient) ([]string, error) {
 	return urls, nil
 }
 
-var queueRegex = regexp.MustCompile(`^https://sqs\.(.+?)\.amazonaws\.com(?:\.cn)?/(.+?)/lifecycled-(i-.+)$`)
-
-func listInactiveQueues(ctx context.Context, sqsClient *sqs.Client, ec2Client *ec2.Client) ([]string, error) {
+func listInactiveQueues(ctx context.Context, sqsClient *sqs.Client, ec2Client *ec2.Client, prefix string, pattern *regexp.Regexp) ([]string, error) {
 	instances, err := listInstances(ctx, ec2Client)
 	if err != nil {
 		return nil, err
@@ -275,30 +279,30 @@ func listInactiveQueues(ctx context.Context, sqsClient *sqs.Client, ec2Client *e
 		instancesMap[instance] = struct{}{}
 	}
 
-	queues, err := listQueues(ctx, sqsClient)
+	queues, err := listQueues(ctx, sqsClient, prefix)
 	if err != nil {
 		return nil, err
 	}
 
 	log.Printf("Found %d lifecycled queues total", len(queues))
 
-	inactiveQueues := filterInactiveQueues(queues, instancesMap)
+	inactiveQueues := filterInactiveQueues(queues, instancesMap, pattern)
 
 	log.Printf("Found %d inactive queues", len(inactiveQueues))
 
 	return inactiveQueues, nil
 }
 
-// filterInactiveQueues returns the lifecycled- queue URLs whose instance id is
-// not in running. URLs that don't match the lifecycled- naming scheme are ignored.
-func filterInactiveQueues(urls []string, running map[string]struct{}) []string {
+// filterInactiveQueues returns the URLs of lifecycled queues whose instance id
+// is not in running. Queues whose names don't match pattern are ignored.
+func filterInactiveQueues(urls []string, running map[string]struct{}, pattern *regexp.Regexp) []string {
 	var inactive []string
 	for _, queue := range urls {
-		matches := queueRegex.FindStringSubmatch(queue)
-		if len(matches) != 4 {
+		matches := pattern.FindStringSubmatch(path.Base(queue))
+		if len(matches) != 2 {
 			continue
 		}
-		instanceID := matches[3]
+		instanceID := matches[1]
 		if _, exists := running[instanceID]; !exists {
 			inactive = append(inactive, queue)
 		}
@@ -310,8 +314,7 @@ func deleteQueue(ctx context.Context, client SQSClient, queueURL string) error {
 	_, err := client.DeleteQueue(ctx, &sqs.DeleteQueueInput{
 		QueueUrl: aws.String(queueURL),
 	})
-	var notExist *sqstypes.QueueDoesNotExist
-	if errors.As(err, &notExist) {
+	if lifecycled.ClassifyError(err) == lifecycled.ErrorNotFound {
 		// Already gone; deleting a non-existent queue is success.
 		return nil
 	}
@@ -331,8 +334,7 @@ func topicExists(ctx context.Context, client SNSClient, snsTopic string) (bool,
 		TopicArn: aws.String(snsTopic),
 	})
 	if err != nil {
-		var apiErr smithy.APIError
-		if errors.As(err, &apiErr) && apiErr.ErrorCode() == `NotFound` {
+		if lifecycled.ClassifyError(err) == lifecycled.ErrorNotFound {
 			return false, nil
 		}
 		log.Printf("Failed to get topic attributes: %s", err)
@@ -341,7 +343,9 @@ func topicExists(ctx context.Context, client SNSClient, snsTopic string) (bool,
 	return true, nil
 }
 
-func listInactiveSubscriptions(ctx context.Context, client SNSClient) ([]string, error) {
+// listInactiveSubscriptions returns the subscriptions of lifecycled queues,
+// those whose queue name matches pattern, to topics that no longer exist.
+func listInactiveSubscriptions(ctx context.Context, client SNSClient, pattern *regexp.Regexp) ([]string, error) {
 	var subs []string
 	var topics = map[string]bool{}
 	var count int
@@ -354,7 +358,8 @@ func listInactiveSubscriptions(ctx context.Context, client SNSClient) ([]string,
 		}
 		count = count + len(page.Subscriptions)
 		for _, s := range page.Subscriptions {
-			if !strings.Contains(aws.ToString(s.Endpoint), "lifecycled-i") {
+			endpoint := aws.ToString(s.Endpoint)
+			if !pattern.MatchString(endpoint[strings.LastIndex(endpoint, ":")+1:]) {
 				continue
 			}
 			topicArn := aws.ToString(s.TopicArn)
@@ -384,8 +389,8 @@ func listInactiveSubscriptions(ctx context.Context, client SNSClient) ([]string,
 	return subs, nil
 }
 
-func deleteInactiveSubscriptions(ctx context.Context, client SNSClient) (int, error) {
-	subs, err := listInactiveSubscriptions(ctx, client)
+func deleteInactiveSubscriptions(ctx context.Context, client SNSClient, pattern *regexp.Regexp) (int, error) {
+	subs, err := listInactiveSubscriptions(ctx, client, pattern)
 	if err != nil {
 		return 0, err
 	}
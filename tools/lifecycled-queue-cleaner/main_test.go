@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"regexp"
 	"slices"
 	"strconv"
 	"sync/atomic"
@@ -14,21 +15,38 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/aws/smithy-go"
+	"github.com/buildkite/lifecycled"
 )
 
+// defaultPattern matches the names of queues created with the default template.
+func defaultPattern(t *testing.T) *regexp.Regexp {
+	t.Helper()
+	pattern, err := lifecycled.QueueNaming{}.Pattern()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pattern
+}
+
 func TestFilterInactiveQueues(t *testing.T) {
 	const (
 		dead    = "https://sqs.us-east-1.amazonaws.com/123456789012/lifecycled-i-dead"
 		running = "https://sqs.us-east-1.amazonaws.com/123456789012/lifecycled-i-running"
 		other   = "https://sqs.us-east-1.amazonaws.com/123456789012/some-other-queue"
 		chinaCN = "https://sqs.cn-north-1.amazonaws.com.cn/123456789012/lifecycled-i-dead"
+		deadN   = "https://sqs.us-east-1.amazonaws.com/123456789012/lifecycled-i-dead-2"
+		runN    = "https://sqs.us-east-1.amazonaws.com/123456789012/lifecycled-i-running-2"
+		named   = "https://sqs.us-east-1.amazonaws.com/123456789012/ci-agents-i-dead-term"
+		namedR  = "https://sqs.us-east-1.amazonaws.com/123456789012/ci-agents-i-running-term"
 	)
 	runningSet := map[string]struct{}{"i-running": {}}
+	custom := lifecycled.QueueNaming{Template: "{prefix}-{asg}-{instance_id}-term", Prefix: "ci"}
 
 	tests := []struct {
-		name string
-		urls []string
-		want []string
+		name   string
+		naming lifecycled.QueueNaming
+		urls   []string
+		want   []string
 	}{
 		{name: "empty input", urls: nil, want: nil},
 		{name: "keeps queue for terminated instance", urls: []string{dead}, want: []string{dead}},
@@ -36,11 +54,17 @@ func TestFilterInactiveQueues(t *testing.T) {
 		{name: "ignores non-lifecycled queue", urls: []string{other}, want: nil},
 		{name: "matches china partition url", urls: []string{chinaCN}, want: []string{chinaCN}},
 		{name: "mixed", urls: []string{dead, running, other}, want: []string{dead}},
+		{name: "queue per topic", urls: []string{deadN, runN}, want: []string{deadN}},
+		{name: "custom template", naming: custom, urls: []string{named, namedR, dead}, want: []string{named}},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := filterInactiveQueues(tt.urls, runningSet); !slices.Equal(got, tt.want) {
+			pattern, err := tt.naming.Pattern()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filterInactiveQueues(tt.urls, runningSet, pattern); !slices.Equal(got, tt.want) {
 				t.Errorf("filterInactiveQueues() = %v, want %v", got, tt.want)
 			}
 		})
@@ -82,6 +106,7 @@ func TestExpiredCredential(t *testing.T) {
 		{name: "ExpiredTokenException", err: &smithy.GenericAPIError{Code: "ExpiredTokenException"}, want: true},
 		{name: "RequestExpired", err: &smithy.GenericAPIError{Code: "RequestExpired"}, want: true},
 		{name: "SSOProviderInvalidToken", err: &smithy.GenericAPIError{Code: "SSOProviderInvalidToken"}, want: true},
+		{name: "InvalidClientTokenId", err: &smithy.GenericAPIError{Code: "InvalidClientTokenId"}, want: true},
 	}
 
 	for _, tt := range tests {
@@ -234,7 +259,7 @@ func TestListInactiveSubscriptions(t *testing.T) {
 		existing: map[string]bool{"topic-live": true},
 	}
 
-	got, err := listInactiveSubscriptions(context.Background(), fake)
+	got, err := listInactiveSubscriptions(context.Background(), fake, defaultPattern(t))
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
@@ -260,7 +285,7 @@ func TestDeleteInactiveSubscriptions(t *testing.T) {
 		existing: map[string]bool{"topic-live": true},
 	}
 
-	count, err := deleteInactiveSubscriptions(context.Background(), fake)
+	count, err := deleteInactiveSubscriptions(context.Background(), fake, defaultPattern(t))
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
@@ -282,7 +307,7 @@ func TestDeleteInactiveSubscriptionsUnsubscribeError(t *testing.T) {
 		unsubErr: map[string]error{"sub-dead": boom},
 	}
 
-	count, err := deleteInactiveSubscriptions(context.Background(), fake)
+	count, err := deleteInactiveSubscriptions(context.Background(), fake, defaultPattern(t))
 	if !errors.Is(err, boom) {
 		t.Fatalf("error = %v, want %v", err, boom)
 	}
@@ -302,7 +327,7 @@ func TestListInactiveSubscriptionsAbortsOnTopicError(t *testing.T) {
 		topicErr: map[string]error{"topic-err": sentinel},
 	}
 
-	got, err := listInactiveSubscriptions(context.Background(), fake)
+	got, err := listInactiveSubscriptions(context.Background(), fake, defaultPattern(t))
 	if !errors.Is(err, sentinel) {
 		t.Fatalf("error = %v, want it to wrap %v", err, sentinel)
 	}
@@ -350,7 +375,7 @@ func TestListQueuesPaginates(t *testing.T) {
 		{"q5"},
 	}}
 
-	got, err := listQueues(context.Background(), fake)
+	got, err := listQueues(context.Background(), fake, "lifecycled-")
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
@@ -361,6 +386,9 @@ func TestListQueuesPaginates(t *testing.T) {
 	if len(fake.listInputs) != len(fake.pages) {
 		t.Fatalf("ListQueues calls = %d, want %d (one per page)", len(fake.listInputs), len(fake.pages))
 	}
+	if got := aws.ToString(fake.listInputs[0].QueueNamePrefix); got != "lifecycled-" {
+		t.Errorf("QueueNamePrefix = %q, want lifecycled-", got)
+	}
 	if aws.ToInt32(fake.listInputs[0].MaxResults) != 1000 {
 		t.Errorf("MaxResults = %d, want 1000", aws.ToInt32(fake.listInputs[0].MaxResults))
 	}